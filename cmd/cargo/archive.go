@@ -0,0 +1,373 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+)
+
+func packageCmd(cmd *cli.Cmd) {
+	addLogLevelOption(cmd)
+	outDir := cmd.StringOpt("o output", ".", "Dir to write the package tarball and its checksum into.")
+	keyPath := cmd.StringOpt("key", "", "Private ed25519 key in PEM format to sign the package with, "+
+		"defaults to Cargo.keyFile.")
+	pkgPath := cmd.StringArg("PACKAGE", PackageFile, "Specify cargo.yaml of the package, or its dir.")
+
+	cmd.Spec = "[OPTIONS] [PACKAGE]"
+	cmd.Action = func() {
+		pkg, err := LoadPackage(*pkgPath)
+		if err != nil {
+			fatalln(err)
+		}
+		archive, err := pkg.WriteArchive(*outDir, *keyPath)
+		if err != nil {
+			fatalln(err)
+		}
+		log.Infoln("packaged", archive.Files, "files")
+		if len(archive.Signature) == 0 {
+			log.Warningln("the package is not signed, specify --key or Cargo.keyFile to sign it")
+		}
+		fmt.Println(archive.Path)
+	}
+}
+
+// archiveModTime is the modification time of all files in package archives,
+// so archives of the same files are identical.
+var archiveModTime = time.Unix(0, 0).UTC()
+
+// packageNameRx matches names of packages that are safe to be used in file names.
+var packageNameRx = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// PackageArchive is a package tarball written by WriteArchive.
+type PackageArchive struct {
+	Path string
+	// Hash is SHA-256 of the tarball, in the same format as in the generated files manifest.
+	Hash string
+	// Signature is the base64 encoded ed25519 signature of the tarball, empty if it's not signed.
+	Signature string
+	Files     int
+}
+
+// ArchiveName returns the file name of the package tarball, after checking
+// that the package has a valid name and a semver version.
+func (p *Package) ArchiveName() (string, error) {
+	name := p.Name()
+	if len(name) == 0 {
+		err := errors.New("Cargo.name of the package is not specified")
+		return "", err
+	} else if !packageNameRx.MatchString(name) {
+		err := fmt.Errorf("Cargo.name of the package is not a valid file name: %s", name)
+		return "", err
+	}
+	v, err := semver.NewVersion(p.Version())
+	if err != nil {
+		err = fmt.Errorf("Cargo.version of the package is not a valid semver: %s", p.Version())
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s.tgz", name, v.String()), nil
+}
+
+// Files returns slash-separated paths of all package files relative to the package dir,
+// sorted: cargo.yaml, the files of all manifest entries, partials and schemas.
+func (p *Package) Files() ([]string, error) {
+	seen := make(map[string]struct{})
+	var files []string
+	add := func(path string) error {
+		rel, err := filepath.Rel(p.Dir, path)
+		if err != nil {
+			return err
+		} else if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			err := fmt.Errorf("file is outside of the package dir: %s", path)
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := seen[rel]; !ok {
+			seen[rel] = struct{}{}
+			files = append(files, rel)
+		}
+		return nil
+	}
+	if err := add(p.File); err != nil {
+		return nil, err
+	}
+	for _, entry := range p.Entries {
+		from := filepath.Join(p.Dir, filepath.FromSlash(entry.From))
+		if err := filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			} else if info.IsDir() {
+				return nil
+			} else if !info.Mode().IsRegular() {
+				log.WithField("path", path).Warningln("not a regular file, skipping")
+				return nil
+			}
+			return add(path)
+		}); err != nil {
+			err = fmt.Errorf("Cargo.manifest.%s: %v", entry.Name, err)
+			return nil, err
+		}
+	}
+	partials, err := ParsePartials(p.Cargo, p.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, partial := range partials {
+		if err := add(partial.Path); err != nil {
+			return nil, err
+		}
+	}
+	schemas, err := ParseSchemas(p.Cargo, p.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, schema := range schemas {
+		if err := add(schema.Path); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// WriteArchive writes the package tarball into the dir, with a checksum file next to it.
+// The tarball is reproducible: entries are sorted and have fixed times and owners.
+// It is signed with the key at keyPath or Cargo.keyFile, if any, the detached
+// signature is written next to it as well.
+func (p *Package) WriteArchive(dir, keyPath string) (*PackageArchive, error) {
+	name, err := p.ArchiveName()
+	if err != nil {
+		return nil, err
+	}
+	files, err := p.Files()
+	if err != nil {
+		return nil, err
+	}
+	var key ed25519.PrivateKey
+	if keyPath, err = p.signingKeyPath(keyPath); err != nil {
+		return nil, err
+	} else if len(keyPath) > 0 {
+		if rel, err := filepath.Rel(p.Dir, keyPath); err == nil {
+			for _, file := range files {
+				if file == filepath.ToSlash(rel) {
+					err := fmt.Errorf("private key %s must not be packaged, move it out of the package folders", file)
+					return nil, err
+				}
+			}
+		}
+		if key, err = ReadPrivateKey(keyPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, "."+name+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	if err := p.writeTarball(io.MultiWriter(f, h), files); err != nil {
+		return nil, err
+	} else if err := f.Chmod(0644); err != nil {
+		return nil, err
+	} else if err := f.Close(); err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	path := filepath.Join(dir, name)
+	if err := os.Rename(f.Name(), path); err != nil {
+		return nil, err
+	}
+	// the format of sha256sum(1), so the tarball can be checked with sha256sum -c
+	checksum := fmt.Sprintf("%s  %s\n", sum, name)
+	if err := ioutil.WriteFile(path+".sha256", []byte(checksum), 0644); err != nil {
+		return nil, err
+	}
+	archive := &PackageArchive{
+		Path:  path,
+		Hash:  "sha256:" + sum,
+		Files: len(files),
+	}
+	if key == nil {
+		// a stale signature of the previous tarball would fail verification
+		if err := os.Remove(path + SignatureExt); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return archive, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	archive.Signature = SignArchive(key, data)
+	if err := ioutil.WriteFile(path+SignatureExt, []byte(archive.Signature+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+func (p *Package) writeTarball(w io.Writer, files []string) error {
+	zw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	for _, file := range files {
+		if err := writeTarFile(tw, filepath.Join(p.Dir, filepath.FromSlash(file)), file); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var mode int64 = 0644
+	if info.Mode()&0111 != 0 {
+		mode = 0755
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     mode,
+		Size:     info.Size(),
+		ModTime:  archiveModTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// OpenArchive verifies the package tarball with its detached signature, and extracts it
+// into a temporary dir, which is removed by cleanup.
+func OpenArchive(path string, verifier *Verifier) (*Package, func(), error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	signature, err := readSignature(path)
+	if err != nil {
+		return nil, nil, err
+	} else if err := verifier.Verify(filepath.Base(path), data, signature); err != nil {
+		return nil, nil, err
+	}
+	dir, err := ioutil.TempDir("", "cargo-package-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	if err := extractArchive(data, dir); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	pkg, err := LoadPackage(dir)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return pkg, cleanup, nil
+}
+
+// readArchiveFile returns contents of the named file in the package tarball.
+func readArchiveFile(data []byte, name string) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if path.Clean(hdr.Name) == name {
+			return ioutil.ReadAll(tr)
+		}
+	}
+	err = fmt.Errorf("%s is not found in the archive", name)
+	return nil, err
+}
+
+// extractArchive extracts the package tarball into the dir. Only regular files
+// are extracted, since package archives contain nothing else.
+func extractArchive(data []byte, dir string) error {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+		case tar.TypeDir:
+			continue
+		default:
+			return fmt.Errorf("unsupported archive entry: %s", hdr.Name)
+		}
+		if err := checkRelativePath(hdr.Name); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		var mode os.FileMode = 0644
+		if hdr.Mode&0111 != 0 {
+			mode = 0755
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
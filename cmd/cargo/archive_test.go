@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackageArchiveWithSchema(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "cargo-archive-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	pkgDir := filepath.Join(root, "demo")
+	writeTestPackage(pkgDir, "1.0.0")
+	manifest, err := ioutil.ReadFile(filepath.Join(pkgDir, PackageFile))
+	if !assert.NoError(err) {
+		return
+	}
+	manifest = append(manifest, "  schemas:\n    Cargo: schemas/cargo.yaml\n"...)
+	assert.NoError(ioutil.WriteFile(filepath.Join(pkgDir, PackageFile), manifest, 0644))
+	assert.NoError(os.MkdirAll(filepath.Join(pkgDir, "schemas"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(pkgDir, "schemas", "cargo.yaml"), []byte(`type: object
+properties:
+  title:
+    type: string
+    default: Demo site
+`), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(pkgDir, "cargo", "_title.txt"), []byte("{{ .Cargo.title }}"), 0644))
+
+	pkg, err := LoadPackage(pkgDir)
+	if !assert.NoError(err) {
+		return
+	}
+	files, err := pkg.Files()
+	if assert.NoError(err) {
+		assert.Equal([]string{"cargo.yaml", "cargo/_title.txt", "cargo/index.html", "schemas/cargo.yaml"}, files)
+	}
+	archive, err := pkg.WriteArchive(filepath.Join(root, "dist"), "")
+	if !assert.NoError(err) {
+		return
+	}
+
+	// the package installed from the archive validates its context against the schema packed
+	installed, cleanup, err := OpenArchive(archive.Path, &Verifier{Insecure: true})
+	if !assert.NoError(err) {
+		return
+	}
+	defer cleanup()
+	entries, err := installed.Select(nil)
+	if !assert.NoError(err) {
+		return
+	}
+	dstDir := filepath.Join(root, "dst")
+	config := &PassConfig{
+		DstDir: dstDir,
+		Loader: TemplateLoaderOptions{
+			ModePrefix: "_",
+			LeftDelim:  "{{",
+			RightDelim: "}}",
+		},
+		OnConflict: string(ConflictOverwrite),
+	}
+	pass, err := installed.NewPass(config, nil, entries, nil)
+	if !assert.NoError(err) || !assert.NoError(pass.Exec()) {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dstDir, "title.txt"))
+	if assert.NoError(err) {
+		assert.Equal("Demo site", string(data))
+	}
+}
+
+func TestPackageArchiveReproducible(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "cargo-archive-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	pkgDir := filepath.Join(root, "demo")
+	writeTestPackage(pkgDir, "1.0.0")
+	pkg, err := LoadPackage(pkgDir)
+	if !assert.NoError(err) {
+		return
+	}
+	var sums []string
+	for i, dir := range []string{"dist1", "dist2"} {
+		if i > 0 {
+			// times of files must not change the tarball
+			modTime := time.Now().Add(time.Hour)
+			for _, file := range []string{PackageFile, filepath.Join("cargo", "index.html")} {
+				assert.NoError(os.Chtimes(filepath.Join(pkgDir, file), modTime, modTime))
+			}
+		}
+		archive, err := pkg.WriteArchive(filepath.Join(root, dir), "")
+		if !assert.NoError(err) {
+			return
+		}
+		data, err := ioutil.ReadFile(archive.Path)
+		if !assert.NoError(err) {
+			return
+		}
+		sum := sha256.Sum256(data)
+		assert.Equal("sha256:"+hex.EncodeToString(sum[:]), archive.Hash)
+		sums = append(sums, archive.Hash)
+	}
+	assert.Equal(sums[0], sums[1], "packing the same package twice must give identical tarballs")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictPolicy defines what happens to an existing target in the destination dir.
+type ConflictPolicy string
+
+const (
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictSkip      ConflictPolicy = "skip"
+	ConflictFail      ConflictPolicy = "fail"
+	ConflictPrompt    ConflictPolicy = "prompt"
+)
+
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(strings.TrimSpace(policy))); p {
+	case ConflictOverwrite, ConflictSkip, ConflictFail, ConflictPrompt:
+		return p, nil
+	}
+	err := fmt.Errorf("unknown conflict policy: %s", policy)
+	return "", err
+}
+
+// ConflictRules resolve the policy for existing targets. Globs are matched
+// against target paths relative to the destination dir, the longest matching glob wins,
+// of matching globs of the same length the first one in lexical order.
+type ConflictRules struct {
+	Default ConflictPolicy
+	Globs   map[string]ConflictPolicy
+
+	// Prompt asks whether the target should be overwritten, it is used by the prompt
+	// policy. If there is no Prompt, targets are planned for overwrite with a note.
+	Prompt func(target string) (bool, error)
+
+	// Manifest of the destination dir allows to refuse overwriting files that
+	// have been generated and edited since, unless Force is set.
+	Manifest *Manifest
+	Force    bool
+}
+
+// NewConflictRules builds rules with the default policy and per-glob overrides
+// from the onConflict field of global Cargo context, if any.
+func NewConflictRules(defaultPolicy string, global Cargo) (*ConflictRules, error) {
+	policy, err := ParseConflictPolicy(defaultPolicy)
+	if err != nil {
+		return nil, err
+	}
+	rules := &ConflictRules{
+		Default: policy,
+		Globs:   make(map[string]ConflictPolicy),
+	}
+	v, ok := global.Lookup("onConflict")
+	if !ok {
+		return rules, nil
+	}
+	globs, ok := v.(map[string]interface{})
+	if !ok {
+		err := errors.New("Cargo.onConflict must map file globs to conflict policies")
+		return nil, err
+	}
+	for glob, v := range globs {
+		policy, err := ParseConflictPolicy(fmt.Sprintf("%v", v))
+		if err != nil {
+			err = fmt.Errorf("Cargo.onConflict for %s: %v", glob, err)
+			return nil, err
+		}
+		if _, err := path.Match(strings.Replace(glob, "**", "*", -1), ""); err != nil {
+			err = fmt.Errorf("Cargo.onConflict glob %s: %v", glob, err)
+			return nil, err
+		}
+		rules.Globs[glob] = policy
+	}
+	return rules, nil
+}
+
+// PolicyFor returns the policy for a target path relative to the destination dir.
+func (r *ConflictRules) PolicyFor(relPath string) ConflictPolicy {
+	if r == nil {
+		return ConflictOverwrite
+	}
+	var longest string
+	policy := r.Default
+	for glob, globPolicy := range r.Globs {
+		if !matchGlob(glob, relPath) {
+			continue
+		} else if len(glob) > len(longest) || (len(glob) == len(longest) && glob < longest) {
+			longest = glob
+			policy = globPolicy
+		}
+	}
+	return policy
+}
+
+// existingTargetAction returns the action for an output whose target exists already.
+func (r *ConflictRules) existingTargetAction(dstDir string, output *Output) (QueueAction, error) {
+	relPath, err := filepath.Rel(dstDir, output.Target)
+	if err != nil {
+		return nil, err
+	}
+	overwrite := func() QueueAction {
+		if output.IsCopy() {
+			return CopyFileAction(dstDir, output.Target, output.Source)
+		}
+		return OverwriteFileAction(dstDir, output.Target, output.Contents)
+	}
+	switch policy := r.PolicyFor(filepath.ToSlash(relPath)); policy {
+	case ConflictOverwrite:
+		if r != nil && !r.Force && r.Manifest.IsEdited(dstDir, output.Target) {
+			err := fmt.Errorf("target has been edited since it was generated, use --force to overwrite: %s",
+				dstPath(dstDir, output.Target))
+			return nil, err
+		}
+		return overwrite(), nil
+	case ConflictSkip:
+		return SkipFileAction(dstDir, output.Target), nil
+	case ConflictFail:
+		err := fmt.Errorf("target exists and must not be overwritten: %s", dstPath(dstDir, output.Target))
+		return nil, err
+	case ConflictPrompt:
+		if r.Prompt == nil {
+			return &annotatedAction{overwrite(), "prompt"}, nil
+		}
+		ok, err := r.Prompt(dstPath(dstDir, output.Target))
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return SkipFileAction(dstDir, output.Target), nil
+		}
+		return overwrite(), nil
+	default:
+		err := fmt.Errorf("unknown conflict policy: %s", policy)
+		return nil, err
+	}
+}
+
+// ErrPromptAborted is returned when user quits from an overwrite prompt.
+var ErrPromptAborted = errors.New("aborted by user")
+
+// NewOverwritePrompt returns a function that asks user whether a target should be overwritten.
+// Answering "all" overwrites all the following targets without asking.
+func NewOverwritePrompt(in io.Reader, out io.Writer) func(target string) (bool, error) {
+	if f, ok := in.(*os.File); ok && !isTerminal(f) {
+		return func(target string) (bool, error) {
+			err := fmt.Errorf("cannot prompt to overwrite %s: stdin is not a terminal", target)
+			return false, err
+		}
+	}
+	r := bufio.NewReader(in)
+	var all bool
+	return func(target string) (bool, error) {
+		if all {
+			return true, nil
+		}
+		for {
+			fmt.Fprintf(out, "overwrite %s? [y]es, [n]o, [a]ll, [q]uit: ", target)
+			answer, err := r.ReadString('\n')
+			if err != nil && len(answer) == 0 {
+				return false, err
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				return true, nil
+			case "n", "no":
+				return false, nil
+			case "a", "all":
+				all = true
+				return true, nil
+			case "q", "quit":
+				return false, ErrPromptAborted
+			}
+		}
+	}
+}
+
+// matchGlob matches a slash-separated path against a glob, where "**" matches any
+// number of path segments. A glob without slashes matches the file name at any depth.
+func matchGlob(glob, relPath string) bool {
+	if !strings.Contains(glob, "/") {
+		ok, _ := path.Match(glob, path.Base(relPath))
+		return ok
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(glob, "/"), "/"), strings.Split(relPath, "/"))
+}
+
+func matchSegments(glob, parts []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(glob[1:], parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], parts[0]); !ok {
+			return false
+		}
+		glob, parts = glob[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
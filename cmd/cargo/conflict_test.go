@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConflictRulesPolicyFor(t *testing.T) {
+	assert := assert.New(t)
+	rules := &ConflictRules{
+		Default: ConflictOverwrite,
+		Globs: map[string]ConflictPolicy{
+			"*.md":          ConflictSkip,
+			"docs/*.md":     ConflictFail,
+			"docs/a.m?":     ConflictPrompt,
+			"docs/sub/*.md": ConflictSkip,
+			"README.*":      ConflictPrompt,
+			"*.txt":         ConflictSkip,
+			"a.tx?":         ConflictFail,
+		},
+	}
+	tests := []struct {
+		path   string
+		policy ConflictPolicy
+	}{
+		{"main.go", ConflictOverwrite},
+		{"CHANGES.md", ConflictSkip},
+		{"README.md", ConflictPrompt},
+		{"docs/b.md", ConflictFail},
+		{"docs/sub/b.md", ConflictSkip},
+		// docs/*.md and docs/a.m? have the same length, docs/*.md is the first one in lexical order
+		{"docs/a.md", ConflictFail},
+		{"b.txt", ConflictSkip},
+		// *.txt and a.tx? have the same length too
+		{"a.txt", ConflictSkip},
+	}
+	for _, test := range tests {
+		// map order is random, so ties are checked more than once
+		for i := 0; i < 20; i++ {
+			assert.Equal(test.policy, rules.PolicyFor(test.path), test.path)
+		}
+	}
+}
+
+func TestPassConflictFail(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := newTestPassConfig(t, map[string]string{
+		"cargo.yaml":    "Cargo:\n  Name: demo\n",
+		"src/a.txt":     "a\n",
+		"src/_b.txt":    "{{ .Cargo.Name }}\n",
+		"dst/other.txt": "other\n",
+	})
+	defer cleanup()
+	config.OnConflict = string(ConflictFail)
+	if !assert.NoError(runTestPass(config)) {
+		return
+	}
+	// planning fails, so dry-run reports the conflict as well
+	_, err := config.NewPass(nil)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "target exists and must not be overwritten: [dst]/a.txt")
+	}
+	assert.FileExists(filepath.Join(config.DstDir, "b.txt"))
+}
@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ghodss/yaml"
@@ -34,6 +36,26 @@ func NewTemplateContext() TemplateContext {
 
 type Cargo map[string]interface{}
 
+// Lookup returns the value of a Cargo field, ignoring case of its name,
+// so that both Cargo.Name and Cargo.name styles can be used in cargo.yaml.
+func (c Cargo) Lookup(name string) (interface{}, bool) {
+	if v, ok := c[name]; ok {
+		return v, true
+	}
+	for k, v := range c {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Global returns the global Cargo context.
+func (c TemplateContext) Global() Cargo {
+	global, _ := c["Cargo"].(Cargo)
+	return global
+}
+
 // LengthOf returns length of a collection specified by selector. If there is no
 // field matching selector, or its value is not indexable, it will return false.
 func (c TemplateContext) LengthOf(selector string) (int, bool) {
@@ -132,37 +154,78 @@ func (c TemplateContext) Item(selector string) (interface{}, bool) {
 	return structwalk.FieldValue(selector, c)
 }
 
-// LoadFromJSON parses a JSON source and builds context from that, setting it to
+// LoadFromJSON parses a JSON source and builds context from that, merging it into
 // the root field of context specified by name.
 func (c TemplateContext) LoadFromJSON(name string, data []byte) error {
-	var fields interface{}
-	if existingFields, ok := c[name]; ok {
-		fields = existingFields
-	}
-	if err := json.Unmarshal(data, &fields); err != nil {
-		return err
-	}
-	c[name] = fields
-	return nil
+	return c.loadFrom(name, ContextFormatJSON, data, newContextMerger(nil), "")
 }
 
-// LoadFromYAML parses a YAML source and builds context from that, setting it to
+// LoadFromYAML parses a YAML source and builds context from that, merging it into
 // the root field of context specified by name.
 func (c TemplateContext) LoadFromYAML(name string, data []byte) error {
+	return c.loadFrom(name, ContextFormatYAML, data, newContextMerger(nil), "")
+}
+
+// LoadFromTOML parses a TOML source and builds context from that, merging it into
+// the root field of context specified by name.
+func (c TemplateContext) LoadFromTOML(name string, data []byte) error {
+	return c.loadFrom(name, ContextFormatTOML, data, newContextMerger(nil), "")
+}
+
+// LoadFromDotenv parses a .env source and merges its variables into the root field
+// of context specified by name.
+func (c TemplateContext) LoadFromDotenv(name string, data []byte) error {
+	return c.loadFrom(name, ContextFormatEnv, data, newContextMerger(nil), "")
+}
+
+// LoadFromCSV parses a CSV source with a header row, and merges the rows into the root field
+// of context specified by name, as a collection of maps keyed by the header.
+func (c TemplateContext) LoadFromCSV(name string, data []byte) error {
+	return c.loadFrom(name, ContextFormatCSV, data, newContextMerger(nil), "")
+}
+
+// LoadFromXML parses an XML source and merges its root element into the root field
+// of context specified by name.
+func (c TemplateContext) LoadFromXML(name string, data []byte) error {
+	return c.loadFrom(name, ContextFormatXML, data, newContextMerger(nil), "")
+}
+
+// loadFrom parses a source in the format and merges it into the root field of context
+// specified by name, source is the path of the source to be reported.
+func (c TemplateContext) loadFrom(name string, format ContextFormat, data []byte, m *contextMerger, source string) error {
 	var fields interface{}
-	if existingFields, ok := c[name]; ok {
-		fields = existingFields
+	var err error
+	switch format {
+	case ContextFormatJSON:
+		err = json.Unmarshal(data, &fields)
+	case ContextFormatYAML:
+		err = yaml.Unmarshal(data, &fields)
+	case ContextFormatTOML:
+		fields, err = parseTOML(data)
+	case ContextFormatEnv:
+		fields, err = parseDotenv(data)
+	case ContextFormatCSV:
+		fields, err = parseCSV(data)
+	case ContextFormatXML:
+		fields, err = parseXML(data)
+	default:
+		err := fmt.Errorf("unsupported Context source format: %s", format)
+		return err
 	}
-	if err := yaml.Unmarshal(data, &fields); err != nil {
+	if err != nil {
 		return err
 	}
-	c[name] = fields
+	c[name] = m.merge(name, name, c[name], fields, source)
 	return nil
 }
 
-// LoadGlobalFromYAML parses a YAML source and builds global Cargo context from that, setting it to
+// LoadGlobalFromYAML parses a YAML source and builds global Cargo context from that, merging it into
 // the "Cargo" field of the context object.
 func (c TemplateContext) LoadGlobalFromYAML(data []byte) error {
+	return c.loadGlobalFrom(data, newContextMerger(nil), "")
+}
+
+func (c TemplateContext) loadGlobalFrom(data []byte, m *contextMerger, source string) error {
 	var fields map[string]map[string]interface{}
 	if err := yaml.Unmarshal(data, &fields); err != nil {
 		return err
@@ -170,19 +233,13 @@ func (c TemplateContext) LoadGlobalFromYAML(data []byte) error {
 	if fields["Cargo"] == nil {
 		return errors.New("context is missing root Cargo field, not a valid global context")
 	}
-	global := c["Cargo"].(Cargo)
+	global := c.Global()
 	for k, v := range fields["Cargo"] {
-		global[k] = v
+		global[k] = m.merge("Cargo."+k, "Cargo."+k, global[k], v, source)
 	}
 	for k, v := range fields {
 		if k != "Cargo" && k != "Env" {
-			if c[k] == nil {
-				c[k] = make(map[string]interface{})
-			}
-			for k2, v2 := range v {
-				container := c[k].(map[string]interface{})
-				container[k2] = v2
-			}
+			c[k] = m.merge(k, k, c[k], v, source)
 		}
 	}
 	return nil
@@ -216,3 +273,129 @@ func (c TemplateContext) LoadOsVars() error {
 	c["OS"] = osVars
 	return nil
 }
+
+// StdinPath is the path of a context source read from the standard input.
+const StdinPath = "-"
+
+// ContextSource specifies a file to be loaded into the context under the root field Name.
+// A source without name is a global context, like cargo.yaml.
+type ContextSource struct {
+	Name string
+	Path string
+	// Format of the source, it's chosen by the file extension if empty.
+	Format ContextFormat `json:",omitempty"`
+
+	// Optional sources are skipped silently if they fail to load.
+	Optional bool
+}
+
+// ParseContextSource parses a source specification in format Name=[format:]<file>,
+// or just <yaml file> for a global context. The file is - for the standard input.
+func ParseContextSource(spec string) (ContextSource, error) {
+	parts := strings.Split(spec, "=")
+	switch len(parts) {
+	case 1:
+		return ContextSource{
+			Path: strings.TrimSpace(parts[0]),
+		}, nil
+	case 2:
+		source := ContextSource{
+			Name: strings.TrimSpace(parts[0]),
+			Path: strings.TrimSpace(parts[1]),
+		}
+		if idx := strings.Index(source.Path, ":"); idx > 0 {
+			if format, ok := ParseContextFormat(source.Path[:idx]); ok {
+				source.Format = format
+				source.Path = source.Path[idx+1:]
+			}
+		}
+		return source, nil
+	}
+	err := fmt.Errorf("incorrect context source specification: %s", spec)
+	return ContextSource{}, err
+}
+
+// stdin keeps the standard input once read, since context is loaded many times, e.g.
+// once per entry of a package, and the standard input can be read only once.
+var stdin struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// readContextSource reads the context source file, or the standard input.
+func readContextSource(path string) ([]byte, error) {
+	if path != StdinPath {
+		return ioutil.ReadFile(path)
+	}
+	stdin.once.Do(func() {
+		stdin.data, stdin.err = ioutil.ReadAll(os.Stdin)
+	})
+	return stdin.data, stdin.err
+}
+
+// Roots returns the names of context root fields the source has been loaded into.
+func (s ContextSource) Roots() []string {
+	if len(s.Name) > 0 {
+		return []string{s.Name}
+	}
+	roots := []string{"Cargo"}
+	data, err := readContextSource(s.Path)
+	if err != nil {
+		return roots
+	}
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal(data, &fields); err != nil {
+		return roots
+	}
+	for k := range fields {
+		if k != "Cargo" && k != "Env" {
+			roots = append(roots, k)
+		}
+	}
+	return roots
+}
+
+// LoadSources loads all context sources into context, in order. Sources loaded into the same root
+// field are merged: maps recursively, scalars override, and arrays according to the merge rules.
+func (c TemplateContext) LoadSources(sources []ContextSource, rules MergeRules) error {
+	m := newContextMerger(rules)
+	for _, source := range sources {
+		if err := c.loadSource(source, m); err != nil {
+			if source.Optional {
+				continue
+			}
+			return err
+		}
+	}
+	m.logOrigins()
+	return nil
+}
+
+// LoadSource loads a context source, the format is chosen by file extension, unless it's specified.
+func (c TemplateContext) LoadSource(source ContextSource) error {
+	return c.loadSource(source, newContextMerger(nil))
+}
+
+func (c TemplateContext) loadSource(source ContextSource, m *contextMerger) error {
+	data, err := readContextSource(source.Path)
+	if err != nil {
+		return err
+	}
+	if len(source.Name) == 0 {
+		if err := c.loadGlobalFrom(data, m, source.Path); err != nil {
+			err = fmt.Errorf("incorrect context source specification: %s", source.Path)
+			return err
+		}
+		return nil
+	}
+	format, err := contextFormatOf(source)
+	if err != nil {
+		return err
+	}
+	if err := c.loadFrom(source.Name, format, data, m, source.Path); err != nil {
+		err = fmt.Errorf("error loading %s: %v", source.Path, err)
+		return err
+	}
+	return nil
+}
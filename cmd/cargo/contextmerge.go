@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MergeStrategy tells how an array of a context source is merged into the array loaded before.
+type MergeStrategy string
+
+const (
+	// MergeReplace replaces the array, it's the default.
+	MergeReplace MergeStrategy = "replace"
+	// MergeAppend appends items to the array.
+	MergeAppend MergeStrategy = "append"
+	// MergeByKey merges items with the same value of the key field, other items are appended.
+	MergeByKey MergeStrategy = "key"
+)
+
+// MergeRule sets the strategy for arrays at a path of the context, or under it. The path is a context
+// root, e.g. Values, or a dotted path of map keys in it, e.g. Values.servers, without array indexes.
+type MergeRule struct {
+	Path     string
+	Strategy MergeStrategy
+	// Key is the field items are matched by, for the key strategy.
+	Key string `json:",omitempty"`
+}
+
+// MergeRules are merge rules of the context, the rule with the longest path applies.
+type MergeRules []*MergeRule
+
+// ParseMergeRule parses a rule in format PATH=STRATEGY, where the strategy is replace, append or key:FIELD.
+func ParseMergeRule(spec string) (*MergeRule, error) {
+	idx := strings.Index(spec, "=")
+	if idx <= 0 {
+		err := fmt.Errorf("incorrect merge rule: %s, use PATH=replace, PATH=append or PATH=key:FIELD", spec)
+		return nil, err
+	}
+	rule := &MergeRule{
+		Path:     strings.TrimSpace(spec[:idx]),
+		Strategy: MergeStrategy(strings.TrimSpace(spec[idx+1:])),
+	}
+	if strings.HasPrefix(string(rule.Strategy), string(MergeByKey)+":") {
+		rule.Key = strings.TrimSpace(string(rule.Strategy)[len(MergeByKey)+1:])
+		rule.Strategy = MergeByKey
+	}
+	switch rule.Strategy {
+	case MergeReplace, MergeAppend:
+	case MergeByKey:
+		if len(rule.Key) == 0 {
+			err := fmt.Errorf("incorrect merge rule: %s, the key field is missing", spec)
+			return nil, err
+		}
+	default:
+		err := fmt.Errorf("unknown merge strategy: %s, use replace, append or key:FIELD", rule.Strategy)
+		return nil, err
+	}
+	return rule, nil
+}
+
+// ruleFor returns the rule with the longest path that is the path given, or its parent.
+func (r MergeRules) ruleFor(path string) *MergeRule {
+	var found *MergeRule
+	for _, rule := range r {
+		if path != rule.Path && !strings.HasPrefix(path, rule.Path+".") {
+			continue
+		}
+		if found == nil || len(rule.Path) > len(found.Path) {
+			found = rule
+		}
+	}
+	return found
+}
+
+// contextMerger merges context sources loaded one after another: maps are merged recursively,
+// scalars override, and arrays are merged according to the rules. It records the source each
+// key comes from, so they can be reported.
+type contextMerger struct {
+	rules   MergeRules
+	origins map[string]*keyOrigin
+}
+
+// keyOrigin is the source a key of the context comes from, and the source it has overridden, if any.
+type keyOrigin struct {
+	Source     string
+	Overridden string
+}
+
+func newContextMerger(rules MergeRules) *contextMerger {
+	return &contextMerger{
+		rules:   rules,
+		origins: make(map[string]*keyOrigin),
+	}
+}
+
+// merge merges src from the source into dst at the path, returning the merged value. The rule path
+// has no array indexes, while the key path locates items of arrays, so keys can be reported.
+func (m *contextMerger) merge(rulePath, keyPath string, dst, src interface{}, source string) interface{} {
+	switch src := src.(type) {
+	case map[string]interface{}:
+		dstMap, ok := asMap(dst)
+		if !ok {
+			break
+		}
+		for k, v := range src {
+			dstMap[k] = m.merge(rulePath+"."+k, keyPath+"."+k, dstMap[k], v, source)
+		}
+		return dstMap
+	case []interface{}:
+		dstItems, ok := dst.([]interface{})
+		rule := m.rules.ruleFor(rulePath)
+		if (!ok && dst != nil) || rule == nil || rule.Strategy == MergeReplace {
+			break
+		} else if rule.Strategy == MergeAppend {
+			m.record(keyPath, source, false)
+			return append(dstItems, src...)
+		}
+		return m.mergeByKey(rulePath, keyPath, rule.Key, dstItems, src, source)
+	}
+	m.record(keyPath, source, true)
+	return src
+}
+
+// mergeByKey merges items of src into items of dst with the same value of the key field,
+// the other items are appended, so items with the same key in src are kept.
+func (m *contextMerger) mergeByKey(rulePath, keyPath, key string, dst, src []interface{}, source string) []interface{} {
+	merged := append(make([]interface{}, 0, len(dst)+len(src)), dst...)
+	for _, item := range src {
+		itemMap, ok := asMap(item)
+		if !ok || itemMap[key] == nil {
+			merged = append(merged, item)
+			m.record(keyPath, source, false)
+			continue
+		}
+		itemPath := fmt.Sprintf("%s[%s=%v]", keyPath, key, itemMap[key])
+		found := false
+		for i, existing := range merged[:len(dst)] {
+			existingMap, ok := asMap(existing)
+			if ok && fmt.Sprintf("%v", existingMap[key]) == fmt.Sprintf("%v", itemMap[key]) {
+				merged[i] = m.merge(rulePath, itemPath, existingMap, itemMap, source)
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, m.merge(rulePath, itemPath, nil, itemMap, source))
+		}
+	}
+	return merged
+}
+
+// record records the source of the key, replacing the sources of keys under it, if the key is replaced.
+func (m *contextMerger) record(keyPath, source string, replaced bool) {
+	origin := &keyOrigin{
+		Source: source,
+	}
+	if prev, ok := m.origins[keyPath]; ok && prev.Source != source {
+		origin.Overridden = prev.Source
+	}
+	if replaced {
+		for path, prev := range m.origins {
+			if strings.HasPrefix(path, keyPath+".") || strings.HasPrefix(path, keyPath+"[") {
+				delete(m.origins, path)
+				if len(origin.Overridden) == 0 && prev.Source != source {
+					origin.Overridden = prev.Source
+				}
+			}
+		}
+	}
+	m.origins[keyPath] = origin
+}
+
+// logOrigins reports the source of every key loaded, in debug mode.
+func (m *contextMerger) logOrigins() {
+	if !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	paths := make([]string, 0, len(m.origins))
+	for path := range m.origins {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		origin := m.origins[path]
+		fields := log.Fields{
+			"source": origin.Source,
+		}
+		if len(origin.Overridden) > 0 {
+			fields["overrides"] = origin.Overridden
+		}
+		log.WithFields(fields).Debugln("context key", path)
+	}
+}
+
+// asMap returns a map that can be merged into, a new one for nil values.
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case nil:
+		return make(map[string]interface{}), true
+	case map[string]interface{}:
+		return v, true
+	}
+	return nil, false
+}
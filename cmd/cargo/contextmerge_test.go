@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSourcesMerge(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "cargo-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base.yaml")
+	prod := filepath.Join(dir, "prod.json")
+	assert.NoError(ioutil.WriteFile(base, []byte(`
+image:
+  repository: nginx
+  tag: latest
+tags: [web]
+args: [--verbose]
+servers:
+  - name: web
+    port: 80
+    tls: false
+  - name: api
+    port: 8080
+`), 0644))
+	assert.NoError(ioutil.WriteFile(prod, []byte(`{
+  "image": {"tag": "1.25"},
+  "tags": ["prod"],
+  "args": ["--quiet"],
+  "servers": [{"name": "web", "tls": true}, {"name": "admin", "port": 9000}]
+}`), 0644))
+
+	ctx := NewTemplateContext()
+	err = ctx.LoadSources([]ContextSource{
+		{Name: "Values", Path: base},
+		{Name: "Values", Path: prod},
+	}, MergeRules{
+		{Path: "Values", Strategy: MergeAppend},
+		{Path: "Values.args", Strategy: MergeReplace},
+		{Path: "Values.servers", Strategy: MergeByKey, Key: "name"},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(map[string]interface{}{
+		"image": map[string]interface{}{"repository": "nginx", "tag": "1.25"},
+		"tags":  []interface{}{"web", "prod"},
+		"args":  []interface{}{"--quiet"},
+		"servers": []interface{}{
+			map[string]interface{}{"name": "web", "port": float64(80), "tls": true},
+			map[string]interface{}{"name": "api", "port": float64(8080)},
+			map[string]interface{}{"name": "admin", "port": float64(9000)},
+		},
+	}, ctx["Values"])
+}
+
+func TestContextMergerOrigins(t *testing.T) {
+	assert := assert.New(t)
+	m := newContextMerger(MergeRules{
+		{Path: "Values.servers", Strategy: MergeByKey, Key: "name"},
+	})
+	var v interface{}
+	v = m.merge("Values", "Values", v, map[string]interface{}{
+		"image":   map[string]interface{}{"repository": "nginx", "tag": "latest"},
+		"servers": []interface{}{map[string]interface{}{"name": "web", "port": 80}},
+	}, "base.yaml")
+	m.merge("Values", "Values", v, map[string]interface{}{
+		"image":   map[string]interface{}{"tag": "1.25"},
+		"servers": []interface{}{map[string]interface{}{"name": "web", "port": 443}},
+	}, "prod.yaml")
+	assert.Equal(&keyOrigin{Source: "base.yaml"}, m.origins["Values.image.repository"])
+	assert.Equal(&keyOrigin{Source: "prod.yaml", Overridden: "base.yaml"}, m.origins["Values.image.tag"])
+	assert.Equal(&keyOrigin{Source: "prod.yaml", Overridden: "base.yaml"}, m.origins["Values.servers[name=web].port"])
+}
+
+func TestParseMergeRule(t *testing.T) {
+	assert := assert.New(t)
+	rule, err := ParseMergeRule("Values.servers=key:name")
+	if assert.NoError(err) {
+		assert.Equal(&MergeRule{Path: "Values.servers", Strategy: MergeByKey, Key: "name"}, rule)
+	}
+	rule, err = ParseMergeRule("Values=append")
+	if assert.NoError(err) {
+		assert.Equal(&MergeRule{Path: "Values", Strategy: MergeAppend}, rule)
+	}
+	_, err = ParseMergeRule("Values=key:")
+	assert.Error(err)
+	_, err = ParseMergeRule("Values=union")
+	assert.Error(err)
+	_, err = ParseMergeRule("append")
+	assert.Error(err)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/ghodss/yaml"
+	log "github.com/sirupsen/logrus"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// LockFile records the versions of dependencies resolved, it is next to cargo.yaml of the package.
+const LockFile = "cargo.lock"
+
+// maxResolveRounds limits rounds of dependency resolution, each round may pick versions
+// with dependencies of their own, that constrain the versions picked before.
+const maxResolveRounds = 100
+
+// PackageDependency is an entry of Cargo.dependencies, it requires a package from repositories.
+//
+//	dependencies:
+//	    service-skeleton: ^1.2.0
+//	    troven/auth-addon:
+//	        version: ">= 0.3, < 1"
+type PackageDependency struct {
+	Name string
+	// Repo restricts the dependency to a repository, all of them are searched if empty.
+	Repo string
+	// Version is the semver constraint, any version is allowed if empty.
+	Version    string
+	constraint *semver.Constraints
+}
+
+// Lock is the list of dependencies resolved for a package, installed until
+// its dependencies change, or they are updated explicitly.
+type Lock struct {
+	Packages []*LockedPackage `json:"packages"`
+}
+
+// LockedPackage is a dependency resolved to a version of package in a repository.
+type LockedPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Repo    string `json:"repo"`
+	// Digest is the hash of the package tarball, as in the repository index.
+	Digest string `json:"digest"`
+}
+
+func parsePackageDependencies(doc yamlv2.MapSlice) ([]*PackageDependency, error) {
+	global, _ := lookupMapSlice(doc, "Cargo").(yamlv2.MapSlice)
+	v := lookupMapSlice(global, "dependencies")
+	if v == nil {
+		return nil, nil
+	}
+	fields, ok := v.(yamlv2.MapSlice)
+	if !ok {
+		err := errors.New("Cargo.dependencies must map package names to versions")
+		return nil, err
+	}
+	deps := make([]*PackageDependency, 0, len(fields))
+	for _, item := range fields {
+		key := fmt.Sprintf("%v", item.Key)
+		dep := &PackageDependency{
+			Name: key,
+		}
+		if idx := strings.Index(key, "/"); idx >= 0 {
+			dep.Repo = key[:idx]
+			dep.Name = key[idx+1:]
+		}
+		switch v := item.Value.(type) {
+		case nil:
+		case string:
+			dep.Version = v
+		case yamlv2.MapSlice:
+			if version := lookupMapSlice(v, "version"); version != nil {
+				dep.Version = fmt.Sprintf("%v", version)
+			}
+			if repo, ok := lookupMapSlice(v, "repo").(string); ok {
+				dep.Repo = repo
+			}
+		default:
+			dep.Version = fmt.Sprintf("%v", v)
+		}
+		if err := dep.compile(); err != nil {
+			err = fmt.Errorf("Cargo.dependencies.%s: %v", key, err)
+			return nil, err
+		}
+		deps = append(deps, dep)
+	}
+	return deps, nil
+}
+
+// ParseDependency parses a package required on the command line, in format
+// [REPO/]NAME[@CONSTRAINT], e.g. troven/service-skeleton@^1.2.
+func ParseDependency(spec string) (*PackageDependency, error) {
+	dep := &PackageDependency{
+		Name: spec,
+	}
+	if idx := strings.Index(dep.Name, "@"); idx >= 0 {
+		dep.Version = dep.Name[idx+1:]
+		dep.Name = dep.Name[:idx]
+	}
+	if idx := strings.Index(dep.Name, "/"); idx >= 0 {
+		dep.Repo = dep.Name[:idx]
+		dep.Name = dep.Name[idx+1:]
+	}
+	if err := dep.compile(); err != nil {
+		err = fmt.Errorf("%s: %v", spec, err)
+		return nil, err
+	}
+	return dep, nil
+}
+
+// compile checks the package name and parses the version constraint.
+func (d *PackageDependency) compile() error {
+	if !packageNameRx.MatchString(d.Name) {
+		return errors.New("package name is not valid")
+	}
+	constraint := strings.TrimSpace(d.Version)
+	if len(constraint) == 0 {
+		constraint = "*"
+	}
+	var err error
+	d.constraint, err = semver.NewConstraint(constraint)
+	return err
+}
+
+func (d *PackageDependency) String() string {
+	name := d.Name
+	if len(d.Repo) > 0 {
+		name = d.Repo + "/" + name
+	}
+	if len(d.Version) == 0 {
+		return name
+	}
+	return name + " " + d.Version
+}
+
+// allows reports whether the version of package from the repository satisfies the dependency.
+func (d *PackageDependency) allows(info *PackageInfo) bool {
+	if len(d.Repo) > 0 && d.Repo != info.Repo {
+		return false
+	}
+	v, err := semver.NewVersion(info.Version)
+	if err != nil {
+		return false
+	}
+	return d.constraint.Check(v)
+}
+
+// ReadLock reads the lock file of the package.
+func ReadLock(path string) (*Lock, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lock Lock
+	if err := yaml.Unmarshal(data, &lock); err != nil {
+		err = fmt.Errorf("error loading %s: %v", path, err)
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// Write writes the lock file.
+func (l *Lock) Write(path string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// requirement is a dependency declared by a package, which is named by.
+type requirement struct {
+	dep *PackageDependency
+	by  string
+}
+
+// resolver picks versions of dependencies from the cached repository indexes.
+type resolver struct {
+	config   *RepoConfig
+	indexes  map[string]*RepoIndex
+	packages map[string]*Package
+}
+
+// Resolve picks the latest versions of dependencies of the package, and of their dependencies,
+// that satisfy all the constraints. The versions locked are kept, as long as they satisfy the
+// constraints, the lock can be nil. Packages are resolved against the cached repository indexes,
+// and loaded from the cache. Dependencies are returned in order they should be installed in,
+// dependencies of a package go before it.
+func (c *RepoConfig) Resolve(pkg *Package, lock *Lock) (*Lock, []*Package, error) {
+	r := c.newResolver()
+	if lock != nil {
+		choices, err := r.locked(lock)
+		if err != nil {
+			return nil, nil, err
+		}
+		reqs, err := r.walk(pkg, choices)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r.satisfied(reqs, choices) {
+			return r.result(pkg, choices)
+		}
+		log.Infoln(LockFile, "does not match dependencies, resolving them again")
+	}
+	choices := make(map[string]*PackageInfo)
+	for round := 0; round < maxResolveRounds; round++ {
+		reqs, err := r.walk(pkg, choices)
+		if err != nil {
+			return nil, nil, err
+		}
+		changed := false
+		for name := range choices {
+			if _, ok := reqs[name]; !ok {
+				delete(choices, name)
+				changed = true
+			}
+		}
+		for name, rs := range reqs {
+			info, err := r.pick(name, rs)
+			if err != nil {
+				return nil, nil, err
+			}
+			if choices[name] != info {
+				choices[name] = info
+				changed = true
+			}
+		}
+		if !changed {
+			return r.result(pkg, choices)
+		}
+	}
+	err := errors.New("dependencies can't be resolved, their versions keep changing")
+	return nil, nil, err
+}
+
+// FindPackage picks the latest version of the package that satisfies the dependency from the
+// cached repository indexes, and loads it from the cache. The package is named by in errors.
+func (c *RepoConfig) FindPackage(dep *PackageDependency, by string) (*LockedPackage, *Package, error) {
+	r := c.newResolver()
+	info, err := r.pick(dep.Name, []requirement{{dep: dep, by: by}})
+	if err != nil {
+		return nil, nil, err
+	}
+	pkg, err := r.load(info)
+	if err != nil {
+		return nil, nil, err
+	}
+	locked := &LockedPackage{
+		Name:    info.Name,
+		Version: info.Version,
+		Repo:    info.Repo,
+		Digest:  info.Digest,
+	}
+	return locked, pkg, nil
+}
+
+func (c *RepoConfig) newResolver() *resolver {
+	return &resolver{
+		config:   c,
+		indexes:  make(map[string]*RepoIndex),
+		packages: make(map[string]*Package),
+	}
+}
+
+// locked finds the locked versions in the repository indexes, checking their digests.
+func (r *resolver) locked(lock *Lock) (map[string]*PackageInfo, error) {
+	choices := make(map[string]*PackageInfo, len(lock.Packages))
+	for _, locked := range lock.Packages {
+		index, err := r.index(locked.Repo)
+		if err != nil {
+			return nil, err
+		}
+		var found *PackageInfo
+		for _, info := range index.Packages[locked.Name] {
+			if info.Version == locked.Version {
+				found = info
+				break
+			}
+		}
+		if found == nil {
+			err := fmt.Errorf("%s: package %s %s is not found in repository %s",
+				LockFile, locked.Name, locked.Version, locked.Repo)
+			return nil, err
+		} else if found.Digest != locked.Digest {
+			err := fmt.Errorf("%s: digest of package %s %s mismatch: %s, locked %s",
+				LockFile, locked.Name, locked.Version, found.Digest, locked.Digest)
+			return nil, err
+		}
+		found.Repo = locked.Repo
+		choices[locked.Name] = found
+	}
+	return choices, nil
+}
+
+// index returns the cached index of the repository.
+func (r *resolver) index(repo string) (*RepoIndex, error) {
+	if index, ok := r.indexes[repo]; ok {
+		return index, nil
+	} else if r.config.Repo(repo) == nil {
+		err := fmt.Errorf("repository %s is not added", repo)
+		return nil, err
+	}
+	index, err := ReadRepoIndex(filepath.Join(r.config.CacheDir(repo), RepoIndexFile))
+	if os.IsNotExist(err) {
+		err := fmt.Errorf("repository %s is not refreshed yet, run cargo repo refresh", repo)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	r.indexes[repo] = index
+	return index, nil
+}
+
+// load loads the package from the cache.
+func (r *resolver) load(info *PackageInfo) (*Package, error) {
+	key := info.Repo + "/" + info.Name + "/" + info.Version
+	if pkg, ok := r.packages[key]; ok {
+		return pkg, nil
+	}
+	dir := r.config.PackageDir(info.Repo, info.Name, info.Version)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		err := fmt.Errorf("package %s %s is not cached, run cargo repo refresh %s",
+			info.Name, info.Version, info.Repo)
+		return nil, err
+	}
+	pkg, err := LoadPackage(dir)
+	if err != nil {
+		return nil, err
+	}
+	r.packages[key] = pkg
+	return pkg, nil
+}
+
+// walk collects requirements of the package and of the versions chosen for its dependencies.
+func (r *resolver) walk(pkg *Package, choices map[string]*PackageInfo) (map[string][]requirement, error) {
+	reqs := make(map[string][]requirement)
+	visited := make(map[string]struct{})
+	queue := []*Package{pkg}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		by := current.Name()
+		if current != pkg {
+			by += " " + current.Version()
+		}
+		for _, dep := range current.Dependencies {
+			reqs[dep.Name] = append(reqs[dep.Name], requirement{dep: dep, by: by})
+			info, ok := choices[dep.Name]
+			if !ok {
+				continue
+			} else if _, ok := visited[dep.Name]; ok {
+				continue
+			}
+			visited[dep.Name] = struct{}{}
+			depPkg, err := r.load(info)
+			if err != nil {
+				return nil, err
+			}
+			queue = append(queue, depPkg)
+		}
+	}
+	return reqs, nil
+}
+
+// satisfied reports whether the versions chosen are exactly the ones required, and satisfy all requirements.
+func (r *resolver) satisfied(reqs map[string][]requirement, choices map[string]*PackageInfo) bool {
+	if len(reqs) != len(choices) {
+		return false
+	}
+	for name, rs := range reqs {
+		info, ok := choices[name]
+		if !ok {
+			return false
+		}
+		for _, req := range rs {
+			if !req.dep.allows(info) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pick returns the latest version of the package that satisfies all requirements,
+// repositories are searched in order they have been added.
+func (r *resolver) pick(name string, reqs []requirement) (*PackageInfo, error) {
+	var candidates []*PackageInfo
+	for _, repo := range r.config.Repositories {
+		index, err := r.index(repo.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range index.Packages[name] {
+			info.Repo = repo.Name
+			candidates = append(candidates, info)
+		}
+	}
+	if len(candidates) == 0 {
+		err := fmt.Errorf("package %s is not found in repositories, required by %s", name, reqs[0].by)
+		return nil, err
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		vi, _ := semver.NewVersion(candidates[i].Version)
+		vj, _ := semver.NewVersion(candidates[j].Version)
+		return vi.GreaterThan(vj)
+	})
+next:
+	for _, info := range candidates {
+		for _, req := range reqs {
+			if !req.dep.allows(info) {
+				continue next
+			}
+		}
+		return info, nil
+	}
+	required := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		required = append(required, fmt.Sprintf("%s (required by %s)", req.dep, req.by))
+	}
+	err := fmt.Errorf("no version of package %s satisfies %s", name, strings.Join(required, ", "))
+	return nil, err
+}
+
+// result returns the lock of the versions chosen, and the packages in order of installation.
+func (r *resolver) result(pkg *Package, choices map[string]*PackageInfo) (*Lock, []*Package, error) {
+	lock := &Lock{
+		Packages: make([]*LockedPackage, 0, len(choices)),
+	}
+	for name, info := range choices {
+		lock.Packages = append(lock.Packages, &LockedPackage{
+			Name:    name,
+			Version: info.Version,
+			Repo:    info.Repo,
+			Digest:  info.Digest,
+		})
+	}
+	sort.Slice(lock.Packages, func(i, j int) bool {
+		return lock.Packages[i].Name < lock.Packages[j].Name
+	})
+	var ordered []*Package
+	visited := make(map[string]struct{})
+	var visit func(current *Package) error
+	visit = func(current *Package) error {
+		for _, dep := range current.Dependencies {
+			if _, ok := visited[dep.Name]; ok {
+				continue
+			}
+			visited[dep.Name] = struct{}{}
+			depPkg, err := r.load(choices[dep.Name])
+			if err != nil {
+				return err
+			} else if err := visit(depPkg); err != nil {
+				return err
+			}
+			ordered = append(ordered, depPkg)
+		}
+		return nil
+	}
+	if err := visit(pkg); err != nil {
+		return nil, nil, err
+	}
+	return lock, ordered, nil
+}
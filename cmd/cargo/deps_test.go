@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testDepPackage is a package published into the test repository, deps are
+// lines of Cargo.dependencies, e.g. "c: ^1.0.0".
+type testDepPackage struct {
+	name    string
+	version string
+	deps    []string
+}
+
+func writeTestDepPackage(dir string, p testDepPackage) error {
+	if err := os.MkdirAll(filepath.Join(dir, "cargo"), 0755); err != nil {
+		return err
+	}
+	manifest := fmt.Sprintf("Cargo:\n  name: %s\n  version: %s\n", p.name, p.version)
+	if len(p.deps) > 0 {
+		manifest += "  dependencies:\n    " + strings.Join(p.deps, "\n    ") + "\n"
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, PackageFile), []byte(manifest), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "cargo", p.name+".txt"), []byte(p.version), 0644)
+}
+
+// newTestDepsRepo publishes packages into a local repository, added and refreshed in the config.
+func newTestDepsRepo(root string, packages []testDepPackage) (*RepoConfig, error) {
+	repoDir := filepath.Join(root, "repo")
+	for _, p := range packages {
+		dir := filepath.Join(root, "packages", p.name+"-"+p.version)
+		if err := writeTestDepPackage(dir, p); err != nil {
+			return nil, err
+		}
+		pkg, err := LoadPackage(dir)
+		if err != nil {
+			return nil, err
+		} else if _, err := pkg.WriteArchive(repoDir, ""); err != nil {
+			return nil, err
+		}
+	}
+	index, err := BuildRepoIndex(repoDir)
+	if err != nil {
+		return nil, err
+	} else if err := index.Write(filepath.Join(repoDir, RepoIndexFile)); err != nil {
+		return nil, err
+	}
+	config, err := LoadRepoConfig(filepath.Join(root, "home"))
+	if err != nil {
+		return nil, err
+	}
+	repo, err := config.Add("local", repoDir)
+	if err != nil {
+		return nil, err
+	} else if _, err := config.Refresh(repo, &Verifier{Insecure: true}); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func TestRepoConfigResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		deps     []string
+		packages []testDepPackage
+		// locked are name@version of the lock, in order of names
+		locked []string
+		// installed are names of dependencies in order of installation
+		installed []string
+		err       string
+	}{{
+		name: "latest version",
+		deps: []string{`a: ">= 1.0.0, < 2.0.0"`},
+		packages: []testDepPackage{
+			{"a", "1.0.0", nil},
+			{"a", "1.5.0", nil},
+			{"a", "2.0.0", nil},
+		},
+		locked:    []string{"a@1.5.0"},
+		installed: []string{"a"},
+	}, {
+		name: "transitive",
+		deps: []string{"a: ^1.0.0"},
+		packages: []testDepPackage{
+			{"a", "1.0.0", []string{"b: ^1.0.0"}},
+			{"b", "1.0.0", nil},
+			{"b", "1.1.0", nil},
+		},
+		locked:    []string{"a@1.0.0", "b@1.1.0"},
+		installed: []string{"b", "a"},
+	}, {
+		name: "diamond",
+		deps: []string{"a: ^1.0.0", "b: ^1.0.0"},
+		packages: []testDepPackage{
+			{"a", "1.0.0", []string{"c: ^1.0.0"}},
+			{"b", "1.0.0", []string{"c: ~1.1.0"}},
+			{"c", "1.0.0", nil},
+			{"c", "1.1.0", nil},
+			{"c", "1.1.5", nil},
+			{"c", "1.2.0", nil},
+		},
+		locked:    []string{"a@1.0.0", "b@1.0.0", "c@1.1.5"},
+		installed: []string{"c", "a", "b"},
+	}, {
+		name: "version conflict",
+		deps: []string{"a: ^1.0.0", "b: ^1.0.0"},
+		packages: []testDepPackage{
+			{"a", "1.0.0", []string{"c: ^1.0.0"}},
+			{"b", "1.0.0", []string{"c: ^2.0.0"}},
+			{"c", "1.0.0", nil},
+			{"c", "2.0.0", nil},
+		},
+		err: "no version of package c satisfies c ^1.0.0 (required by a 1.0.0), c ^2.0.0 (required by b 1.0.0)",
+	}, {
+		name: "conflict with the package",
+		deps: []string{"a: ^1.0.0", "c: ^1.0.0"},
+		packages: []testDepPackage{
+			{"a", "1.0.0", []string{"c: ^2.0.0"}},
+			{"c", "1.0.0", nil},
+			{"c", "2.0.0", nil},
+		},
+		err: "no version of package c satisfies c ^1.0.0 (required by app), c ^2.0.0 (required by a 1.0.0)",
+	}, {
+		name: "no version",
+		deps: []string{"a: ^3.0.0"},
+		packages: []testDepPackage{
+			{"a", "1.0.0", nil},
+		},
+		err: "no version of package a satisfies a ^3.0.0 (required by app)",
+	}, {
+		name: "not found",
+		deps: []string{"a: ^1.0.0"},
+		packages: []testDepPackage{
+			{"a", "1.0.0", []string{"z: ^1.0.0"}},
+		},
+		err: "package z is not found in repositories, required by a 1.0.0",
+	}, {
+		name: "cycle",
+		deps: []string{"a: ^1.0.0"},
+		packages: []testDepPackage{
+			{"a", "1.0.0", []string{"b: ^1.0.0"}},
+			{"b", "1.0.0", []string{"a: ^1.0.0"}},
+		},
+		locked:    []string{"a@1.0.0", "b@1.0.0"},
+		installed: []string{"b", "a"},
+	}, {
+		name: "cycle with conflict",
+		deps: []string{"a: ^1.0.0"},
+		packages: []testDepPackage{
+			{"a", "1.0.0", []string{"b: ^1.0.0"}},
+			{"b", "1.0.0", []string{"a: ^2.0.0"}},
+		},
+		err: "no version of package a satisfies a ^1.0.0 (required by app), a ^2.0.0 (required by b 1.0.0)",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			root, err := ioutil.TempDir("", "cargo-deps-test-")
+			if !assert.NoError(err) {
+				return
+			}
+			defer os.RemoveAll(root)
+			config, err := newTestDepsRepo(root, test.packages)
+			if !assert.NoError(err) {
+				return
+			}
+			appDir := filepath.Join(root, "app")
+			if !assert.NoError(writeTestDepPackage(appDir, testDepPackage{"app", "0.1.0", test.deps})) {
+				return
+			}
+			pkg, err := LoadPackage(appDir)
+			if !assert.NoError(err) {
+				return
+			}
+			lock, deps, err := config.Resolve(pkg, nil)
+			if len(test.err) > 0 {
+				if assert.Error(err) {
+					assert.Equal(test.err, err.Error())
+				}
+				return
+			} else if !assert.NoError(err) {
+				return
+			}
+			var locked []string
+			for _, p := range lock.Packages {
+				assert.Equal("local", p.Repo)
+				locked = append(locked, p.Name+"@"+p.Version)
+			}
+			assert.Equal(test.locked, locked)
+			var installed []string
+			for _, dep := range deps {
+				installed = append(installed, dep.Name())
+			}
+			assert.Equal(test.installed, installed)
+
+			// the lock is kept, as long as it satisfies dependencies
+			again, _, err := config.Resolve(pkg, lock)
+			if assert.NoError(err) {
+				assert.Equal(lock, again)
+			}
+		})
+	}
+}
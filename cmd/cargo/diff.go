@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jawher/mow.cli"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+func diffCmd(cmd *cli.Cmd) {
+	opts := addRunOptions(cmd)
+	contextLines := cmd.IntOpt("U unified", 3, "Number of context lines in unified diffs.")
+
+	srcDir := cmd.StringArg("SRC", "cargo/", "Specify source files dir for your site.")
+	dstDir := cmd.StringArg("DST", "build/", "Specify destination dir for your site publication.")
+
+	cmd.Spec = "[OPTIONS] SRC [DST]"
+	cmd.Action = func() {
+		renderer, err := opts.NewRenderer(*srcDir, *dstDir)
+		if err != nil {
+			fatalln(err)
+		}
+		outputs, err := renderer.RenderAll()
+		if err != nil {
+			fatalln(err)
+		}
+		if err := WriteOutputsDiff(os.Stdout, *dstDir, outputs, *contextLines); err != nil {
+			fatalln(err)
+		}
+	}
+}
+
+type DiffStatus string
+
+const (
+	DiffStatusNew       DiffStatus = "new"
+	DiffStatusChanged   DiffStatus = "changed"
+	DiffStatusUnchanged DiffStatus = "unchanged"
+)
+
+// OutputDiff describes how an output differs from the existing target.
+type OutputDiff struct {
+	Path   string
+	Status DiffStatus
+	Binary bool
+	// Unified is a unified diff between the existing target and the output,
+	// it is empty for unchanged and binary files.
+	Unified string
+}
+
+// DiffOutput compares the output with its target in the destination dir.
+func DiffOutput(dstDir string, output *Output, contextLines int) (*OutputDiff, error) {
+	contents := output.Contents
+	if output.IsCopy() {
+		data, err := ioutil.ReadFile(output.Source)
+		if err != nil {
+			return nil, err
+		}
+		contents = data
+	}
+	path, err := filepath.Rel(dstDir, output.Target)
+	if err != nil {
+		path = output.Target
+	}
+	diff := &OutputDiff{
+		Path:   filepath.ToSlash(path),
+		Status: DiffStatusChanged,
+		Binary: isBinary(contents),
+	}
+	fromFile := "a/" + diff.Path
+	current, err := ioutil.ReadFile(output.Target)
+	if os.IsNotExist(err) {
+		diff.Status = DiffStatusNew
+		fromFile = "/dev/null"
+		current = nil
+	} else if err != nil {
+		return nil, err
+	} else if bytes.Equal(current, contents) {
+		diff.Status = DiffStatusUnchanged
+		return diff, nil
+	} else if isBinary(current) {
+		diff.Binary = true
+	}
+	if diff.Binary {
+		return diff, nil
+	}
+	diff.Unified, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(current),
+		B:        splitLines(contents),
+		FromFile: fromFile,
+		ToFile:   "b/" + diff.Path,
+		Context:  contextLines,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// WriteOutputsDiff writes a status line for every output, followed by its unified diff
+// against the destination dir, if any. The summary of changes is written last.
+func WriteOutputsDiff(w io.Writer, dstDir string, outputs []*Output, contextLines int) error {
+	counts := make(map[DiffStatus]int, 3)
+	for _, output := range outputs {
+		diff, err := DiffOutput(dstDir, output, contextLines)
+		if err != nil {
+			return err
+		}
+		counts[diff.Status]++
+		status := string(diff.Status)
+		if diff.Binary {
+			status += ", binary"
+		}
+		fmt.Fprintf(w, "%s: %s\n", status, dstPath(dstDir, output.Target))
+		if len(diff.Unified) > 0 {
+			fmt.Fprint(w, diff.Unified)
+		}
+	}
+	fmt.Fprintf(w, "%d new, %d changed, %d unchanged\n",
+		counts[DiffStatusNew], counts[DiffStatusChanged], counts[DiffStatusUnchanged])
+	return nil
+}
+
+// splitLines splits contents into lines, each ending with a newline.
+// The last line is marked the way diff(1) does, if it has no newline.
+func splitLines(contents []byte) []string {
+	if len(contents) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(contents), "\n")
+	if last := lines[len(lines)-1]; len(last) == 0 {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] = last + "\n\\ No newline at end of file\n"
+	}
+	return lines
+}
+
+// isBinary tells binary contents from text using the same heuristics as git does:
+// text must be valid UTF-8 and have no NUL bytes in the first 8000 bytes.
+func isBinary(contents []byte) bool {
+	if len(contents) > 8000 {
+		contents = contents[:8000]
+		for i := 0; i < utf8.UTFMax && !utf8.Valid(contents); i++ {
+			// the cut might have been in the middle of a rune
+			contents = contents[:len(contents)-1]
+		}
+	}
+	return bytes.IndexByte(contents, 0) >= 0 || !utf8.Valid(contents)
+}
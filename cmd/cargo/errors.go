@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TemplateError is an error in a source template, located by line and column if known.
+type TemplateError struct {
+	Source string
+	// Line and Column are 1-based, zero if unknown.
+	Line   int
+	Column int
+	// Excerpt is the source line the error is located at.
+	Excerpt string
+	// Item is the collection item being rendered, if any.
+	Item *OutputItem
+	// Target is the target path being rendered, if any.
+	Target string
+	Err    string
+}
+
+// templateErrRx matches locations in errors of text/template, in formats
+// "template: name:line: msg" for parse errors and "template: name:line:col: msg" for
+// execution errors, where col is a 0-based byte offset.
+var templateErrRx = regexp.MustCompile(`^template: ([^:]*):(\d+)(?::(\d+))?: (.*)$`)
+
+// quotedTokenRx matches tokens quoted in parse errors, e.g. unexpected "}" in operand.
+var quotedTokenRx = regexp.MustCompile(`"([^"]+)"|<([^>]+)>`)
+
+// NewTemplateError locates the error of text/template in the source file.
+func NewTemplateError(source string, err error) *TemplateError {
+	e := &TemplateError{
+		Source: source,
+		Err:    err.Error(),
+	}
+	m := templateErrRx.FindStringSubmatch(strings.SplitN(e.Err, "\n", 2)[0])
+	if m == nil {
+		return e
+	}
+	e.Line, _ = strconv.Atoi(m[2])
+	e.Err = m[4]
+	e.Excerpt = sourceLine(source, e.Line)
+	if len(m[3]) > 0 {
+		col, _ := strconv.Atoi(m[3])
+		e.Column = col + 1
+		return e
+	}
+	// parse errors have no column, but usually quote the unexpected token
+	for _, token := range quotedTokenRx.FindAllStringSubmatch(e.Err, -1) {
+		if idx := strings.Index(e.Excerpt, token[1]+token[2]); idx >= 0 {
+			e.Column = idx + 1
+			break
+		}
+	}
+	return e
+}
+
+func (e *TemplateError) Error() string {
+	buf := new(strings.Builder)
+	buf.WriteString(displayPath(e.Source))
+	if e.Line > 0 {
+		fmt.Fprintf(buf, ":%d", e.Line)
+	}
+	if e.Column > 0 {
+		fmt.Fprintf(buf, ":%d", e.Column)
+	}
+	fmt.Fprintf(buf, ": %s", e.Err)
+	if e.Item != nil {
+		if e.Item.Index < 0 {
+			fmt.Fprintf(buf, "\n    while rendering collection %s", e.Item.Collection)
+		} else {
+			fmt.Fprintf(buf, "\n    while rendering item %s[%d]", e.Item.Collection, e.Item.Index)
+		}
+		if len(e.Target) > 0 {
+			fmt.Fprintf(buf, " into %s", e.Target)
+		}
+	}
+	if len(e.Excerpt) > 0 {
+		lineNo := strconv.Itoa(e.Line)
+		fmt.Fprintf(buf, "\n %s | %s", lineNo, e.Excerpt)
+		if e.Column > 0 && e.Column <= len(e.Excerpt)+1 {
+			// keep tabs, so the caret is aligned the same way as the excerpt
+			var pad strings.Builder
+			for _, r := range e.Excerpt[:e.Column-1] {
+				if r == '\t' {
+					pad.WriteRune('\t')
+				} else {
+					pad.WriteRune(' ')
+				}
+			}
+			fmt.Fprintf(buf, "\n %s | %s^", strings.Repeat(" ", len(lineNo)), pad.String())
+		}
+	}
+	return buf.String()
+}
+
+// ErrorList collects errors, so all of them are reported at once.
+type ErrorList []error
+
+// Add appends an error to the list, errors of other lists are flattened.
+func (l *ErrorList) Add(err error) {
+	switch err := err.(type) {
+	case nil:
+	case ErrorList:
+		*l = append(*l, err...)
+	default:
+		*l = append(*l, err)
+	}
+}
+
+// Err returns nil if the list is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+func (l ErrorList) Error() string {
+	messages := make([]string, 0, len(l))
+	for _, err := range l {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n\n")
+}
+
+// logError logs the error, template errors are written to stderr as is,
+// since their excerpts span multiple lines.
+func logError(err error) {
+	switch err := err.(type) {
+	case ErrorList:
+		fmt.Fprintln(os.Stderr, err)
+		log.Errorf("%d errors found", len(err))
+	case *TemplateError:
+		fmt.Fprintln(os.Stderr, err)
+	default:
+		log.Errorln(err)
+	}
+}
+
+// fatalln is like log.Fatalln, but keeps excerpts of template errors readable.
+func fatalln(err error) {
+	switch err := err.(type) {
+	case ErrorList:
+		fmt.Fprintln(os.Stderr, err)
+		log.Fatalf("%d errors found", len(err))
+	case *TemplateError:
+		fmt.Fprintln(os.Stderr, err)
+		log.Fatalln("template error found")
+	default:
+		log.Fatalln(err)
+	}
+}
+
+// sourceLine returns the line of the file without trailing newline, empty if there's no such line.
+func sourceLine(path string, line int) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for i := 1; scanner.Scan(); i++ {
+		if i == line {
+			return strings.TrimRight(scanner.Text(), "\r")
+		}
+	}
+	return ""
+}
+
+// displayPath returns the path relative to the working dir, if it's under it.
+func displayPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(wd, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return rel
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ContextFormat is the format of a context source.
+type ContextFormat string
+
+const (
+	ContextFormatJSON ContextFormat = "json"
+	ContextFormatYAML ContextFormat = "yaml"
+	ContextFormatTOML ContextFormat = "toml"
+	ContextFormatEnv  ContextFormat = "env"
+	ContextFormatCSV  ContextFormat = "csv"
+	ContextFormatXML  ContextFormat = "xml"
+)
+
+// contextFormats maps names of formats and file extensions to formats.
+var contextFormats = map[string]ContextFormat{
+	"json":   ContextFormatJSON,
+	"yaml":   ContextFormatYAML,
+	"yml":    ContextFormatYAML,
+	"toml":   ContextFormatTOML,
+	"env":    ContextFormatEnv,
+	"dotenv": ContextFormatEnv,
+	"csv":    ContextFormatCSV,
+	"xml":    ContextFormatXML,
+}
+
+// ParseContextFormat returns the format by its name, or by a file extension.
+func ParseContextFormat(name string) (ContextFormat, bool) {
+	format, ok := contextFormats[strings.ToLower(strings.TrimPrefix(name, "."))]
+	return format, ok
+}
+
+// contextFormatOf returns the format of the context source, as specified or by the file extension.
+// YAML is the default for the standard input, as it's a superset of JSON.
+func contextFormatOf(source ContextSource) (ContextFormat, error) {
+	if len(source.Format) > 0 {
+		return source.Format, nil
+	} else if source.Path == StdinPath {
+		return ContextFormatYAML, nil
+	}
+	ext := filepath.Ext(source.Path)
+	if format, ok := ParseContextFormat(ext); ok {
+		return format, nil
+	}
+	err := fmt.Errorf("unsupported Context source format: %s, specify it as Name=format:path", ext)
+	return "", err
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// dotenvKeyRx matches names of variables in .env files.
+var dotenvKeyRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// parseDotenv parses lines in format KEY=VALUE, optionally prefixed with export. Values may be
+// single quoted, kept as they are, or double quoted, with escapes and line breaks. Unquoted values
+// are trimmed, and comments after them are dropped. Variables are not expanded.
+func parseDotenv(data []byte) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	lines := strings.Split(string(bytes.TrimPrefix(data, utf8BOM)), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNum := i + 1
+		line := strings.TrimSpace(strings.TrimSuffix(lines[i], "\r"))
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		idx := strings.Index(line, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNum)
+		}
+		key := strings.TrimSpace(line[:idx])
+		if !dotenvKeyRx.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid name %s", lineNum, key)
+		}
+		value := strings.TrimSpace(line[idx+1:])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			// double quoted values may span many lines
+			value = value[1:]
+			for !hasClosingQuote(value) && i+1 < len(lines) {
+				i++
+				value += "\n" + strings.TrimSuffix(lines[i], "\r")
+			}
+			end := closingQuote(value)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: value of %s is not terminated", lineNum, key)
+			}
+			value = unescapeDotenv(value[:end])
+		case strings.HasPrefix(value, `'`):
+			end := strings.Index(value[1:], `'`)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: value of %s is not terminated", lineNum, key)
+			}
+			value = value[1 : end+1]
+		default:
+			if idx := strings.Index(value, " #"); idx >= 0 {
+				value = strings.TrimSpace(value[:idx])
+			}
+		}
+		vars[key] = value
+	}
+	return vars, nil
+}
+
+func hasClosingQuote(s string) bool {
+	return closingQuote(s) >= 0
+}
+
+// closingQuote returns the index of the first double quote that is not escaped.
+func closingQuote(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == '"' {
+			return i
+		}
+	}
+	return -1
+}
+
+var dotenvEscapes = strings.NewReplacer(`\n`, "\n", `\r`, "\r", `\t`, "\t", `\"`, `"`, `\\`, `\`)
+
+func unescapeDotenv(s string) string {
+	return dotenvEscapes.Replace(s)
+}
+
+// parseCSV parses rows into a collection of maps keyed by the header row, so each row
+// can be rendered by a collection template. All values are strings.
+func parseCSV(data []byte) ([]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, utf8BOM)))
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, errors.New("header row is missing")
+	} else if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("column %d has no name in the header row", i+1)
+		} else if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("column %s is in the header row twice", name)
+		}
+		seen[name] = struct{}{}
+		header[i] = name
+	}
+	rows := make([]interface{}, 0)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			row[name] = record[i]
+		}
+		rows = append(rows, row)
+	}
+}
+
+// xmlTextKey is the key of text of elements that have attributes or child elements.
+const xmlTextKey = "_text"
+
+// parseXML parses the root element into a map of its attributes and child elements. Elements with
+// only text become strings, repeated elements become lists, and text of elements with attributes
+// or child elements is under _text. Namespaces are dropped from names.
+func parseXML(data []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return nil, errors.New("root element is missing")
+		} else if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return parseXMLElement(d, start)
+		}
+	}
+}
+
+func parseXMLElement(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	fields := make(map[string]interface{})
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		fields[attr.Name.Local] = attr.Value
+	}
+	var text strings.Builder
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			child, err := parseXMLElement(d, token)
+			if err != nil {
+				return nil, err
+			}
+			name := token.Name.Local
+			switch prev := fields[name].(type) {
+			case nil:
+				fields[name] = child
+			case []interface{}:
+				fields[name] = append(prev, child)
+			default:
+				fields[name] = []interface{}{prev, child}
+			}
+		case xml.CharData:
+			text.Write(token)
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(fields) == 0 {
+				return s, nil
+			} else if len(s) > 0 {
+				fields[xmlTextKey] = s
+			}
+			return fields, nil
+		}
+	}
+}
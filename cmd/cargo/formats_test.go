@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTOML(t *testing.T) {
+	assert := assert.New(t)
+	doc, err := parseTOML([]byte(`
+# app settings
+title = "Cargo \u00e9"
+path = 'C:\temp'
+port = 8_080
+ratio = 0.5
+debug = true
+tags = [
+  "a", # first
+  "b",
+]
+created = 1979-05-27 07:32:00Z
+day = 1979-05-27
+point = { x = 1, y.z = 2 }
+notes = """
+one \
+  two"""
+
+[database]
+host = "localhost"
+
+[database.pool]
+size = 0x10
+
+[[servers]]
+name = "alpha"
+
+[[servers]]
+name = "beta"
+`))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("Cargo é", doc["title"])
+	assert.Equal(`C:\temp`, doc["path"])
+	assert.Equal(int64(8080), doc["port"])
+	assert.Equal(0.5, doc["ratio"])
+	assert.Equal(true, doc["debug"])
+	assert.Equal([]interface{}{"a", "b"}, doc["tags"])
+	assert.Equal(time.Date(1979, 5, 27, 7, 32, 0, 0, time.UTC), doc["created"])
+	assert.Equal("1979-05-27", doc["day"])
+	assert.Equal(map[string]interface{}{"x": int64(1), "y": map[string]interface{}{"z": int64(2)}}, doc["point"])
+	assert.Equal("one two", doc["notes"])
+	assert.Equal(map[string]interface{}{
+		"host": "localhost",
+		"pool": map[string]interface{}{"size": int64(16)},
+	}, doc["database"])
+	assert.Equal([]interface{}{
+		map[string]interface{}{"name": "alpha"},
+		map[string]interface{}{"name": "beta"},
+	}, doc["servers"])
+
+	_, err = parseTOML([]byte("a = 1\na = 2\n"))
+	assert.EqualError(err, "line 2: key a is defined twice")
+	_, err = parseTOML([]byte("a = \"open\n"))
+	assert.Error(err)
+}
+
+func TestParseDotenv(t *testing.T) {
+	assert := assert.New(t)
+	vars, err := parseDotenv([]byte("# comment\nexport A=1\nB = two words # comment\nC='$literal'\nD=\"multi\nline \\\"q\\\"\"\nE=\n"))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(map[string]interface{}{
+		"A": "1",
+		"B": "two words",
+		"C": "$literal",
+		"D": "multi\nline \"q\"",
+		"E": "",
+	}, vars)
+	_, err = parseDotenv([]byte("not a var\n"))
+	assert.EqualError(err, "line 1: expected KEY=VALUE")
+}
+
+func TestParseCSV(t *testing.T) {
+	assert := assert.New(t)
+	rows, err := parseCSV([]byte("\xef\xbb\xbfName,Age\nMaxim,26\n\"Ivan, Jr\",25\n"))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]interface{}{
+		map[string]interface{}{"Name": "Maxim", "Age": "26"},
+		map[string]interface{}{"Name": "Ivan, Jr", "Age": "25"},
+	}, rows)
+	_, err = parseCSV([]byte("Name,Name\n"))
+	assert.EqualError(err, "column Name is in the header row twice")
+}
+
+func TestParseXML(t *testing.T) {
+	assert := assert.New(t)
+	doc, err := parseXML([]byte(`<?xml version="1.0"?>
+<settings xmlns="urn:app" env="prod">
+  <db host="localhost">main</db>
+  <port>5432</port>
+  <feature>search</feature>
+  <feature>export</feature>
+</settings>`))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(map[string]interface{}{
+		"env":     "prod",
+		"db":      map[string]interface{}{"host": "localhost", "_text": "main"},
+		"port":    "5432",
+		"feature": []interface{}{"search", "export"},
+	}, doc)
+}
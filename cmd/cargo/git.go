@@ -0,0 +1,873 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitVars are variables of the git repository, available in templates under the Git root,
+// e.g. {{ .Git.ShortCommit }}. Branch is empty if HEAD is detached, Tag is the tag pointing
+// to HEAD, the greatest one by name if there are many. Dirty is set if tracked files are
+// modified, or changes are staged. Remote is the URL of the remote of the branch, or origin,
+// without credentials.
+type GitVars struct {
+	Commit      string
+	ShortCommit string
+	Branch      string
+	Tag         string
+	Tags        []string
+	Dirty       bool
+	Remote      string
+	// Author, AuthorEmail and CommitTime are of the last commit.
+	Author      string
+	AuthorEmail string
+	CommitTime  time.Time
+}
+
+// LoadGitVars fills context "Git" with variables of the git repository containing dir, read from
+// the .git dir, so git is not required. Context has no Git field if dir is not in a repository.
+func (c TemplateContext) LoadGitVars(dir string) error {
+	repo, err := openGitRepo(dir)
+	if err != nil || repo == nil {
+		return err
+	}
+	vars, err := repo.Vars()
+	if err != nil {
+		err = fmt.Errorf("error reading git repository %s: %v", repo.workDir, err)
+		return err
+	}
+	c["Git"] = vars
+	return nil
+}
+
+// gitRepo reads a git repository. HEAD and the index are in gitDir, objects, refs and
+// config are in commonDir, which is different from gitDir for linked worktrees.
+type gitRepo struct {
+	workDir   string
+	gitDir    string
+	commonDir string
+
+	packs []*gitPack
+}
+
+// openGitRepo finds the repository containing dir, it returns nil if there is none.
+func openGitRepo(dir string) (*gitRepo, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		info, err := os.Stat(dotGit)
+		if err == nil {
+			gitDir := dotGit
+			if !info.IsDir() {
+				// linked worktrees and submodules have .git file pointing to the git dir
+				data, err := ioutil.ReadFile(dotGit)
+				if err != nil {
+					return nil, err
+				}
+				line := strings.TrimSpace(string(data))
+				if !strings.HasPrefix(line, "gitdir:") {
+					return nil, fmt.Errorf("%s is not a valid .git file", dotGit)
+				}
+				gitDir = strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+				if !filepath.IsAbs(gitDir) {
+					gitDir = filepath.Join(dir, gitDir)
+				}
+			}
+			repo := &gitRepo{
+				workDir:   dir,
+				gitDir:    gitDir,
+				commonDir: gitDir,
+			}
+			if data, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+				repo.commonDir = strings.TrimSpace(string(data))
+				if !filepath.IsAbs(repo.commonDir) {
+					repo.commonDir = filepath.Join(gitDir, repo.commonDir)
+				}
+			}
+			return repo, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// Vars reads variables of the repository.
+func (r *gitRepo) Vars() (*GitVars, error) {
+	vars := &GitVars{}
+	head, err := ioutil.ReadFile(filepath.Join(r.gitDir, "HEAD"))
+	if err != nil {
+		return nil, err
+	}
+	ref := strings.TrimSpace(string(head))
+	if strings.HasPrefix(ref, "ref:") {
+		ref = strings.TrimSpace(strings.TrimPrefix(ref, "ref:"))
+		vars.Branch = strings.TrimPrefix(ref, "refs/heads/")
+		if vars.Commit, err = r.resolveRef(ref); err != nil {
+			return nil, err
+		}
+	} else {
+		vars.Commit = ref
+	}
+	config := r.readConfig()
+	vars.Remote = sanitizeRemoteURL(r.remoteURL(config, vars.Branch))
+	if len(vars.Commit) == 0 {
+		// no commits yet
+		return vars, nil
+	}
+	if len(vars.Commit) != 40 {
+		return nil, fmt.Errorf("HEAD %s is not a valid commit", vars.Commit)
+	}
+	vars.ShortCommit = vars.Commit[:7]
+	kind, data, err := r.readObject(vars.Commit)
+	if err != nil {
+		return nil, err
+	} else if kind != "commit" {
+		return nil, fmt.Errorf("HEAD %s is not a commit", vars.Commit)
+	}
+	commit := parseGitCommit(data)
+	vars.Author, vars.AuthorEmail = commit.author, commit.authorEmail
+	vars.CommitTime = commit.commitTime
+	if vars.Tags, err = r.tagsOf(vars.Commit); err != nil {
+		return nil, err
+	} else if len(vars.Tags) > 0 {
+		vars.Tag = vars.Tags[len(vars.Tags)-1]
+	}
+	if vars.Dirty, err = r.isDirty(commit.tree); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// resolveRef returns the commit of the ref, or an empty string if it doesn't exist yet.
+func (r *gitRepo) resolveRef(ref string) (string, error) {
+	for i := 0; i < 10; i++ {
+		data, err := ioutil.ReadFile(filepath.Join(r.commonDir, filepath.FromSlash(ref)))
+		if os.IsNotExist(err) {
+			refs, err := r.packedRefs()
+			if err != nil {
+				return "", err
+			}
+			return refs[ref].sha, nil
+		} else if err != nil {
+			return "", err
+		}
+		value := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(value, "ref:") {
+			return value, nil
+		}
+		ref = strings.TrimSpace(strings.TrimPrefix(value, "ref:"))
+	}
+	return "", fmt.Errorf("too many levels of symbolic refs: %s", ref)
+}
+
+// packedRef is a ref in packed-refs, peeled is the commit an annotated tag points to.
+type packedRef struct {
+	sha    string
+	peeled string
+}
+
+func (r *gitRepo) packedRefs() (map[string]packedRef, error) {
+	refs := make(map[string]packedRef)
+	data, err := ioutil.ReadFile(filepath.Join(r.commonDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return refs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var last string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case len(line) == 0 || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "^"):
+			if ref, ok := refs[last]; ok {
+				ref.peeled = line[1:]
+				refs[last] = ref
+			}
+		default:
+			fields := strings.Fields(line)
+			if len(fields) == 2 {
+				refs[fields[1]] = packedRef{sha: fields[0]}
+				last = fields[1]
+			}
+		}
+	}
+	return refs, nil
+}
+
+// tagsOf returns names of tags pointing to the commit, sorted.
+func (r *gitRepo) tagsOf(commit string) ([]string, error) {
+	refs, err := r.packedRefs()
+	if err != nil {
+		return nil, err
+	}
+	tagsDir := filepath.Join(r.commonDir, "refs", "tags")
+	err = filepath.Walk(tagsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		} else if info.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		relPath, _ := filepath.Rel(r.commonDir, path)
+		// loose refs take precedence over packed ones
+		refs[filepath.ToSlash(relPath)] = packedRef{sha: strings.TrimSpace(string(data))}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for name, ref := range refs {
+		if !strings.HasPrefix(name, "refs/tags/") {
+			continue
+		}
+		target := ref.peeled
+		if len(target) == 0 {
+			if target, err = r.peel(ref.sha); err != nil {
+				// objects of tags may be missing, e.g. in shallow clones
+				continue
+			}
+		}
+		if target == commit {
+			tags = append(tags, strings.TrimPrefix(name, "refs/tags/"))
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// peel returns the object annotated tags point to, other objects are returned as they are.
+func (r *gitRepo) peel(sha string) (string, error) {
+	for i := 0; i < 10; i++ {
+		kind, data, err := r.readObject(sha)
+		if err != nil {
+			return "", err
+		} else if kind != "tag" {
+			return sha, nil
+		}
+		line := strings.SplitN(string(data), "\n", 2)[0]
+		if !strings.HasPrefix(line, "object ") {
+			return "", fmt.Errorf("tag %s has no object", sha)
+		}
+		sha = strings.TrimPrefix(line, "object ")
+	}
+	return "", fmt.Errorf("too many levels of tags: %s", sha)
+}
+
+// gitConfig maps keys like remote.origin.url to values, section and key names are lowercase.
+type gitConfig map[string]string
+
+// readConfig reads the config of the repository, it's empty if there is none.
+func (r *gitRepo) readConfig() gitConfig {
+	config := make(gitConfig)
+	data, err := ioutil.ReadFile(filepath.Join(r.commonDir, "config"))
+	if err != nil {
+		return config
+	}
+	var section string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			// [remote "origin"] is section remote.origin, subsection names are case sensitive
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if idx := strings.Index(name, " "); idx > 0 {
+				section = strings.ToLower(name[:idx]) + "." + strings.Trim(strings.TrimSpace(name[idx+1:]), `"`)
+			} else {
+				section = strings.ToLower(name)
+			}
+			continue
+		}
+		key, value := line, "true"
+		if idx := strings.Index(line, "="); idx >= 0 {
+			key, value = strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+		}
+		config[section+"."+strings.ToLower(key)] = strings.Trim(value, `"`)
+	}
+	return config
+}
+
+// remoteURL returns the URL of the remote the branch tracks, or of origin, or of the first remote by name.
+func (r *gitRepo) remoteURL(config gitConfig, branch string) string {
+	if remote, ok := config["branch."+branch+".remote"]; ok && len(branch) > 0 {
+		if u, ok := config["remote."+remote+".url"]; ok {
+			return u
+		}
+	}
+	if u, ok := config["remote.origin.url"]; ok {
+		return u
+	}
+	var keys []string
+	for key := range config {
+		if strings.HasPrefix(key, "remote.") && strings.HasSuffix(key, ".url") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	return config[keys[0]]
+}
+
+// sanitizeRemoteURL drops passwords and tokens from remote URLs, so they don't end up in generated files.
+func sanitizeRemoteURL(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil || len(u.Scheme) == 0 {
+		return remote
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.User(u.User.Username())
+	} else if u.Scheme == "https" || u.Scheme == "http" {
+		// a token given as the user name
+		u.User = nil
+	}
+	return u.String()
+}
+
+// gitCommit has fields of a commit object used by cargo.
+type gitCommit struct {
+	tree        string
+	author      string
+	authorEmail string
+	commitTime  time.Time
+}
+
+func parseGitCommit(data []byte) *gitCommit {
+	commit := &gitCommit{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) == 0 {
+			// the message follows
+			break
+		}
+		switch {
+		case strings.HasPrefix(line, "tree "):
+			commit.tree = strings.TrimPrefix(line, "tree ")
+		case strings.HasPrefix(line, "author "):
+			commit.author, commit.authorEmail, _ = parseGitSignature(strings.TrimPrefix(line, "author "))
+		case strings.HasPrefix(line, "committer "):
+			_, _, commit.commitTime = parseGitSignature(strings.TrimPrefix(line, "committer "))
+		}
+	}
+	return commit
+}
+
+// parseGitSignature parses "Name <email> 1700000000 +0200".
+func parseGitSignature(s string) (name, email string, ts time.Time) {
+	start, end := strings.Index(s, "<"), strings.LastIndex(s, ">")
+	if start < 0 || end < start {
+		return strings.TrimSpace(s), "", ts
+	}
+	name = strings.TrimSpace(s[:start])
+	email = s[start+1 : end]
+	fields := strings.Fields(s[end+1:])
+	if len(fields) != 2 {
+		return name, email, ts
+	}
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return name, email, ts
+	}
+	ts = time.Unix(sec, 0)
+	if tz := fields[1]; len(tz) == 5 {
+		hours, _ := strconv.Atoi(tz[1:3])
+		minutes, _ := strconv.Atoi(tz[3:5])
+		offset := hours*3600 + minutes*60
+		if tz[0] == '-' {
+			offset = -offset
+		}
+		ts = ts.In(time.FixedZone(tz, offset))
+	}
+	return name, email, ts
+}
+
+// isDirty tells whether changes are staged, comparing the index with the tree of HEAD,
+// or tracked files are modified in the work tree. Untracked files are ignored.
+func (r *gitRepo) isDirty(tree string) (bool, error) {
+	entries, err := r.readIndex()
+	if err != nil {
+		return false, err
+	}
+	files := make(map[string]gitTreeEntry)
+	if err := r.readTree(tree, "", files); err != nil {
+		return false, err
+	}
+	if len(files) != len(entries) {
+		return true, nil
+	}
+	for _, entry := range entries {
+		file, ok := files[entry.path]
+		if !ok || entry.stage > 0 || file.sha != entry.sha || file.mode != entry.mode {
+			return true, nil
+		}
+		if entry.skipWorktree || entry.mode == gitModeSubmodule {
+			continue
+		}
+		modified, err := entry.isModified(r.workDir)
+		if err != nil || modified {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+const (
+	gitModeDir       = 040000
+	gitModeSymlink   = 0120000
+	gitModeSubmodule = 0160000
+)
+
+// gitTreeEntry is a file of a tree, with its mode and the object name.
+type gitTreeEntry struct {
+	mode uint32
+	sha  string
+}
+
+// readTree reads the tree recursively, adding files to the map by their paths.
+func (r *gitRepo) readTree(sha, prefix string, files map[string]gitTreeEntry) error {
+	kind, data, err := r.readObject(sha)
+	if err != nil {
+		return err
+	} else if kind != "tree" {
+		return fmt.Errorf("%s is not a tree", sha)
+	}
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if space < 0 || nul < space || len(data) < nul+21 {
+			return fmt.Errorf("tree %s is not valid", sha)
+		}
+		mode, err := strconv.ParseUint(string(data[:space]), 8, 32)
+		if err != nil {
+			return fmt.Errorf("tree %s is not valid", sha)
+		}
+		path := prefix + string(data[space+1:nul])
+		entry := gitTreeEntry{
+			mode: uint32(mode),
+			sha:  hex.EncodeToString(data[nul+1 : nul+21]),
+		}
+		data = data[nul+21:]
+		if entry.mode == gitModeDir {
+			if err := r.readTree(entry.sha, path+"/", files); err != nil {
+				return err
+			}
+			continue
+		}
+		files[path] = entry
+	}
+	return nil
+}
+
+// gitIndexEntry is a file of the index, with stat data of the file when it was staged.
+type gitIndexEntry struct {
+	path         string
+	mode         uint32
+	sha          string
+	size         uint32
+	mtimeSec     uint32
+	mtimeNsec    uint32
+	stage        int
+	skipWorktree bool
+}
+
+// readIndex reads entries of the index, versions 2, 3 and 4 are supported.
+func (r *gitRepo) readIndex() ([]*gitIndexEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.gitDir, "index"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[:4]) != "DIRC" {
+		return nil, errors.New("index is not valid")
+	}
+	version := binary.BigEndian.Uint32(data[4:8])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("index version %d is not supported", version)
+	}
+	count := int(binary.BigEndian.Uint32(data[8:12]))
+	entries := make([]*gitIndexEntry, 0, count)
+	pos := 12
+	var prevPath string
+	for i := 0; i < count; i++ {
+		if len(data) < pos+62 {
+			return nil, errors.New("index is truncated")
+		}
+		start := pos
+		entry := &gitIndexEntry{
+			mtimeSec:  binary.BigEndian.Uint32(data[pos+8:]),
+			mtimeNsec: binary.BigEndian.Uint32(data[pos+12:]),
+			mode:      binary.BigEndian.Uint32(data[pos+24:]),
+			size:      binary.BigEndian.Uint32(data[pos+36:]),
+			sha:       hex.EncodeToString(data[pos+40 : pos+60]),
+		}
+		flags := binary.BigEndian.Uint16(data[pos+60:])
+		entry.stage = int(flags>>12) & 3
+		pos += 62
+		if flags&0x4000 != 0 && version >= 3 {
+			if len(data) < pos+2 {
+				return nil, errors.New("index is truncated")
+			}
+			extended := binary.BigEndian.Uint16(data[pos:])
+			entry.skipWorktree = extended&0x4000 != 0
+			pos += 2
+		}
+		if version == 4 {
+			// the path is the previous one without N bytes, followed by the suffix
+			strip, n := gitVarint(data[pos:])
+			if n == 0 || int(strip) > len(prevPath) {
+				return nil, errors.New("index is not valid")
+			}
+			pos += n
+			nul := bytes.IndexByte(data[pos:], 0)
+			if nul < 0 {
+				return nil, errors.New("index is truncated")
+			}
+			entry.path = prevPath[:len(prevPath)-int(strip)] + string(data[pos:pos+nul])
+			pos += nul + 1
+		} else {
+			nul := bytes.IndexByte(data[pos:], 0)
+			if nul < 0 {
+				return nil, errors.New("index is truncated")
+			}
+			entry.path = string(data[pos : pos+nul])
+			// entries are padded with NULs to a multiple of 8 bytes
+			pos = start + (pos-start+nul+8)&^7
+		}
+		prevPath = entry.path
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// gitVarint decodes the offset encoding of git, used by index v4 and ofs-delta objects,
+// returning the value and the number of bytes read, which is zero if data is truncated.
+func gitVarint(data []byte) (uint64, int) {
+	var value uint64
+	for i, b := range data {
+		if i > 0 {
+			value++
+		}
+		value = value<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// isModified tells whether the file differs from the index entry. Files with the same size
+// and modification time are not modified, others are hashed.
+func (e *gitIndexEntry) isModified(workDir string) (bool, error) {
+	path := filepath.Join(workDir, filepath.FromSlash(e.path))
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if uint32(info.Size()) != e.size {
+		return true, nil
+	}
+	mtime := info.ModTime()
+	if uint32(mtime.Unix()) == e.mtimeSec && uint32(mtime.Nanosecond()) == e.mtimeNsec {
+		return false, nil
+	}
+	var contents []byte
+	if e.mode == gitModeSymlink {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return false, err
+		}
+		contents = []byte(filepath.ToSlash(target))
+	} else if contents, err = ioutil.ReadFile(path); err != nil {
+		return false, err
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(contents))
+	h.Write(contents)
+	return hex.EncodeToString(h.Sum(nil)) != e.sha, nil
+}
+
+// readObject reads an object by its name, loose or packed, returning its type and contents.
+func (r *gitRepo) readObject(sha string) (string, []byte, error) {
+	if len(sha) != 40 {
+		return "", nil, fmt.Errorf("object name %s is not valid", sha)
+	}
+	path := filepath.Join(r.commonDir, "objects", sha[:2], sha[2:])
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		return readLooseObject(f)
+	} else if !os.IsNotExist(err) {
+		return "", nil, err
+	}
+	if r.packs == nil {
+		if err := r.openPacks(); err != nil {
+			return "", nil, err
+		}
+	}
+	name, err := hex.DecodeString(sha)
+	if err != nil {
+		return "", nil, fmt.Errorf("object name %s is not valid", sha)
+	}
+	for _, pack := range r.packs {
+		if offset, ok := pack.find(name); ok {
+			return r.readPacked(pack, offset)
+		}
+	}
+	return "", nil, fmt.Errorf("object %s is not found", sha)
+}
+
+func readLooseObject(rd io.Reader) (string, []byte, error) {
+	z, err := zlib.NewReader(rd)
+	if err != nil {
+		return "", nil, err
+	}
+	defer z.Close()
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		return "", nil, err
+	}
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		return "", nil, errors.New("object header is not valid")
+	}
+	header := strings.Fields(string(data[:nul]))
+	if len(header) != 2 {
+		return "", nil, errors.New("object header is not valid")
+	}
+	return header[0], data[nul+1:], nil
+}
+
+// gitPack is a pack file, with names and offsets of objects from its version 2 index.
+type gitPack struct {
+	path    string
+	fanout  [256]uint32
+	names   []byte
+	offsets []byte
+	large   []byte
+}
+
+func (r *gitRepo) openPacks() error {
+	r.packs = make([]*gitPack, 0)
+	paths, err := filepath.Glob(filepath.Join(r.commonDir, "objects", "pack", "*.idx"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if len(data) < 8+256*4 || !bytes.Equal(data[:4], []byte("\377tOc")) || binary.BigEndian.Uint32(data[4:8]) != 2 {
+			return fmt.Errorf("pack index %s is not supported", path)
+		}
+		pack := &gitPack{
+			path: strings.TrimSuffix(path, ".idx") + ".pack",
+		}
+		for i := range pack.fanout {
+			pack.fanout[i] = binary.BigEndian.Uint32(data[8+i*4:])
+		}
+		count := int(pack.fanout[255])
+		pos := 8 + 256*4
+		if len(data) < pos+count*(20+4+4) {
+			return fmt.Errorf("pack index %s is truncated", path)
+		}
+		pack.names = data[pos : pos+count*20]
+		pos += count * 20
+		pos += count * 4 // CRCs
+		pack.offsets = data[pos : pos+count*4]
+		pack.large = data[pos+count*4:]
+		r.packs = append(r.packs, pack)
+	}
+	return nil
+}
+
+// find returns the offset of the object in the pack.
+func (p *gitPack) find(name []byte) (int64, bool) {
+	lo := 0
+	if name[0] > 0 {
+		lo = int(p.fanout[name[0]-1])
+	}
+	hi := int(p.fanout[name[0]])
+	idx := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.names[(lo+i)*20:(lo+i+1)*20], name) >= 0
+	})
+	if idx >= hi || !bytes.Equal(p.names[idx*20:(idx+1)*20], name) {
+		return 0, false
+	}
+	offset := binary.BigEndian.Uint32(p.offsets[idx*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset), true
+	}
+	largeIdx := int(offset &^ 0x80000000)
+	if len(p.large) < (largeIdx+1)*8 {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(p.large[largeIdx*8:])), true
+}
+
+const (
+	gitObjOfsDelta = 6
+	gitObjRefDelta = 7
+)
+
+var gitObjectTypes = map[byte]string{
+	1: "commit",
+	2: "tree",
+	3: "blob",
+	4: "tag",
+}
+
+// readPacked reads the object at the offset of the pack, applying deltas to their base objects.
+func (r *gitRepo) readPacked(pack *gitPack, offset int64) (string, []byte, error) {
+	f, err := os.Open(pack.path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	rd := bufio.NewReader(f)
+	b, err := rd.ReadByte()
+	if err != nil {
+		return "", nil, err
+	}
+	kind := (b >> 4) & 7
+	for b&0x80 != 0 {
+		// the size is not needed, zlib streams have their end
+		if b, err = rd.ReadByte(); err != nil {
+			return "", nil, err
+		}
+	}
+	var baseKind string
+	var base []byte
+	switch kind {
+	case gitObjOfsDelta:
+		header, err := rd.Peek(binary.MaxVarintLen64)
+		if err != nil && len(header) == 0 {
+			return "", nil, err
+		}
+		distance, n := gitVarint(header)
+		if n == 0 {
+			return "", nil, errors.New("delta offset is not valid")
+		}
+		rd.Discard(n)
+		if baseKind, base, err = r.readPacked(pack, offset-int64(distance)); err != nil {
+			return "", nil, err
+		}
+	case gitObjRefDelta:
+		name := make([]byte, 20)
+		if _, err := io.ReadFull(rd, name); err != nil {
+			return "", nil, err
+		}
+		if baseKind, base, err = r.readObject(hex.EncodeToString(name)); err != nil {
+			return "", nil, err
+		}
+	}
+	z, err := zlib.NewReader(rd)
+	if err != nil {
+		return "", nil, err
+	}
+	defer z.Close()
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		return "", nil, err
+	}
+	if base == nil {
+		name, ok := gitObjectTypes[kind]
+		if !ok {
+			return "", nil, fmt.Errorf("object type %d is not supported", kind)
+		}
+		return name, data, nil
+	}
+	data, err = applyGitDelta(base, data)
+	return baseKind, data, err
+}
+
+// applyGitDelta builds an object from its base and the delta, that has sizes of both, followed
+// by instructions to copy ranges of the base, or to insert data of the delta.
+func applyGitDelta(base, delta []byte) ([]byte, error) {
+	invalid := errors.New("delta is not valid")
+	_, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, invalid
+	}
+	delta = delta[n:]
+	size, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return nil, invalid
+	}
+	delta = delta[n:]
+	out := make([]byte, 0, size)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		if op&0x80 == 0 {
+			if op == 0 || int(op) > len(delta) {
+				return nil, invalid
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+			continue
+		}
+		var offset, length uint32
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			} else if len(delta) == 0 {
+				return nil, invalid
+			}
+			if i < 4 {
+				offset |= uint32(delta[0]) << (8 * i)
+			} else {
+				length |= uint32(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if length == 0 {
+			length = 0x10000
+		}
+		if uint64(offset)+uint64(length) > uint64(len(base)) {
+			return nil, invalid
+		}
+		out = append(out, base[offset:offset+length]...)
+	}
+	if uint64(len(out)) != size {
+		return nil, invalid
+	}
+	return out, nil
+}
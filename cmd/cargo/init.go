@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// initialVersion is the version of packages created by cargo init.
+const initialVersion = "0.1.0"
+
+// fixtureDir is the dir of the test fixture, relative to the package dir. It has context
+// sources of the package, and the outputs expected to be rendered with them in expected/.
+const fixtureDir = "tests"
+
+func initCmd(cmd *cli.Cmd) {
+	addLogLevelOption(cmd)
+	starterName := cmd.StringOpt("t template", DefaultStarter, fmt.Sprintf("Starter package to create the package from [%s].",
+		strings.Join(starterNames(), ", ")))
+	name := cmd.StringOpt("name", "", "Name of the package, defaults to the name of DIR.")
+	author := cmd.StringOpt("author", "", `Author of the package as "Name <email>", defaults to the current user.`)
+
+	dir := cmd.StringArg("DIR", "", "Specify the dir to create the package in, it must be empty if it exists.")
+
+	cmd.Spec = "[OPTIONS] DIR"
+	cmd.Action = func() {
+		starter := FindStarter(*starterName)
+		if starter == nil {
+			log.Fatalf("unknown starter package: %s, use one of %s", *starterName, strings.Join(starterNames(), ", "))
+		}
+		queue, err := NewScaffold(starter, *dir, *name, *author)
+		if err != nil {
+			fatalln(err)
+		}
+		ts := time.Now()
+		if !queue.Exec(*dir) {
+			log.Fatalf("failed in %v", time.Since(ts))
+		}
+		fmt.Printf("created %s package in %s, run make test in it to check the outputs in %s/expected\n",
+			starter.Name, *dir, fixtureDir)
+	}
+}
+
+func starterNames() []string {
+	names := make([]string, 0, len(starters))
+	for _, starter := range starters {
+		names = append(names, starter.Name)
+	}
+	return names
+}
+
+// NewScaffold returns the queue of actions that create a new package in dir from the starter:
+// cargo.yaml with the name, the initial version and the author of the package, the files of the
+// starter, and the test fixture with outputs of the package rendered into tests/expected.
+// The dir must be empty if it exists, name defaults to the name of the dir.
+func NewScaffold(starter *Starter, dir, name, author string) (Queue, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+		err := fmt.Errorf("%s is not empty", dir)
+		return nil, err
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(name) == 0 {
+		name = filepath.Base(dir)
+	}
+	if !packageNameRx.MatchString(name) {
+		err := fmt.Errorf("package name is not valid: %s, use --name", name)
+		return nil, err
+	}
+	if len(author) == 0 {
+		author = currentUserName()
+	}
+	files := make(map[string][]byte, len(starter.Files)+2)
+	for path, contents := range starter.Files {
+		files[path] = []byte(contents)
+	}
+	if files[PackageFile], err = starter.packageFile(name, author); err != nil {
+		return nil, err
+	}
+	files["Makefile"] = starter.makefile()
+	expected, err := starter.renderFixture(files)
+	if err != nil {
+		err = fmt.Errorf("starter %s: %v", starter.Name, err)
+		return nil, err
+	}
+	for path, contents := range expected {
+		files[path] = contents
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	queue := NewQueue(NewDirAction(dir, dir))
+	for _, path := range paths {
+		queue = append(queue, CreateNewFileAction(dir, filepath.Join(dir, filepath.FromSlash(path)), files[path]))
+	}
+	return queue, nil
+}
+
+// packageFile returns cargo.yaml of the new package, Cargo fields of the starter go after the generated ones.
+func (s *Starter) packageFile(name, author string) ([]byte, error) {
+	global := yamlv2.MapSlice{
+		{Key: "Name", Value: name},
+		{Key: "Version", Value: initialVersion},
+		{Key: "Description", Value: s.Description},
+		{Key: "Author", Value: parseAuthor(author)},
+	}
+	var doc yamlv2.MapSlice
+	if err := yamlv2.Unmarshal([]byte(s.Cargo), &doc); err != nil {
+		err = fmt.Errorf("starter %s: %v", s.Name, err)
+		return nil, err
+	}
+	var rest yamlv2.MapSlice
+	for _, item := range doc {
+		if fields, ok := item.Value.(yamlv2.MapSlice); ok && item.Key == "Cargo" {
+			global = append(global, fields...)
+			continue
+		}
+		rest = append(rest, item)
+	}
+	doc = append(yamlv2.MapSlice{{Key: "Cargo", Value: global}}, rest...)
+	return yamlv2.Marshal(doc)
+}
+
+// makefile returns the Makefile with the test target, that renders the package with the context
+// sources of the test fixture, and compares the outputs with the expected ones.
+func (s *Starter) makefile() []byte {
+	args := []string{"cargo run --prune"}
+	for _, name := range s.contextNames() {
+		args = append(args, fmt.Sprintf("-c %s=%s", name, s.Contexts[name]))
+	}
+	args = append(args, "cargo", fixtureDir+"/build")
+	return []byte(fmt.Sprintf(`.PHONY: test
+
+test:
+	%s
+	diff -r -x .cargo %s/build %s/expected
+`, strings.Join(args, " "), fixtureDir, fixtureDir))
+}
+
+func (s *Starter) contextNames() []string {
+	names := make([]string, 0, len(s.Contexts))
+	for name := range s.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderFixture renders the package files in a temporary dir, as the test target of the Makefile does,
+// and returns the outputs as files of tests/expected.
+func (s *Starter) renderFixture(files map[string][]byte) (map[string][]byte, error) {
+	tmpDir, err := ioutil.TempDir("", "cargo-init-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	for path, contents := range files {
+		path = filepath.Join(tmpDir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		} else if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			return nil, err
+		}
+	}
+	config := &PassConfig{
+		SrcDir: filepath.Join(tmpDir, "cargo"),
+		DstDir: filepath.Join(tmpDir, fixtureDir, "build"),
+		Sources: []ContextSource{{
+			Path: filepath.Join(tmpDir, PackageFile),
+		}},
+		Loader: TemplateLoaderOptions{
+			ModePrefix: "_",
+			LeftDelim:  "{{",
+			RightDelim: "}}",
+		},
+	}
+	for _, name := range s.contextNames() {
+		config.Sources = append(config.Sources, ContextSource{
+			Name: name,
+			Path: filepath.Join(tmpDir, filepath.FromSlash(s.Contexts[name])),
+		})
+	}
+	renderer, err := config.NewRenderer()
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := renderer.RenderAll()
+	if err != nil {
+		return nil, err
+	}
+	expected := make(map[string][]byte, len(outputs))
+	for _, output := range outputs {
+		relPath, err := filepath.Rel(config.DstDir, output.Target)
+		if err != nil {
+			return nil, err
+		}
+		contents, err := outputContents(output)
+		if err != nil {
+			return nil, err
+		}
+		expected[fixtureDir+"/expected/"+filepath.ToSlash(relPath)] = contents
+	}
+	return expected, nil
+}
+
+// authorRx matches authors in format "Name <email>", the email is optional.
+var authorRx = regexp.MustCompile(`^\s*(.*?)\s*(?:<([^>]*)>)?\s*$`)
+
+// parseAuthor returns Cargo.author with the name and the email of the author, if any.
+func parseAuthor(author string) yamlv2.MapSlice {
+	m := authorRx.FindStringSubmatch(author)
+	fields := yamlv2.MapSlice{
+		{Key: "Name", Value: m[1]},
+	}
+	if len(m[2]) > 0 {
+		fields = append(fields, yamlv2.MapItem{Key: "Email", Value: m[2]})
+	}
+	return fields
+}
+
+// currentUserName returns the full name of the current user, or the login name if it's unknown.
+func currentUserName() string {
+	u, err := user.Current()
+	if err != nil {
+		return os.Getenv("USER")
+	} else if len(u.Name) > 0 {
+		return u.Name
+	}
+	return u.Username
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScaffoldStarters(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "cargo-init-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	for _, starter := range starters {
+		dir := filepath.Join(root, starter.Name)
+		queue, err := NewScaffold(starter, dir, "", "Troven <cto@troven.co>")
+		if !assert.NoError(err, starter.Name) || !assert.True(queue.Exec(dir), starter.Name) {
+			return
+		}
+		pkg, err := LoadPackage(dir)
+		if !assert.NoError(err, starter.Name) {
+			return
+		}
+		assert.Equal(starter.Name, pkg.Name())
+		assert.Equal("Troven <cto@troven.co>", pkg.Author())
+		expected, err := ioutil.ReadDir(filepath.Join(dir, fixtureDir, "expected"))
+		assert.NoError(err, starter.Name)
+		assert.NotEmpty(expected, starter.Name)
+	}
+	_, err = NewScaffold(starters[0], filepath.Join(root, starters[0].Name), "", "")
+	assert.Error(err, "dir is not empty")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+)
+
+func installCmd(cmd *cli.Cmd) {
+	opts := addRunOptions(cmd)
+	dryRun := cmd.BoolOpt("d dry-run", false, "Do not modify filesystem, only print planned actions.")
+	showDiff := cmd.BoolOpt("diff", false, "Print unified diffs between planned outputs and files in DST, without writing them.")
+	onConflict := addConflictOption(cmd)
+	force := addForceOption(cmd)
+	prune := cmd.BoolOpt("prune", false, "Delete files installed from the package before, that are not generated anymore.")
+	only := cmd.StringsOpt("only", nil, "Install only the named manifest entries, even if they are ignored.")
+	update := cmd.BoolOpt("update", false, "Resolve dependencies to the latest versions allowed, ignoring "+LockFile+".")
+	trust := addTrustOptions(cmd)
+
+	pkgPath := cmd.StringArg("PACKAGE", "", "Specify the package dir, its cargo.yaml, its tarball, "+
+		"or the package in repositories as [REPO/]NAME[@CONSTRAINT].")
+	dstDir := cmd.StringArg("DST", ".", "Specify destination dir for the package.")
+
+	cmd.Spec = "[OPTIONS] PACKAGE [DST]"
+	cmd.Action = func() {
+		var pkg *Package
+		var installed *LockedPackage
+		var err error
+		// packages from tarballs and repositories are verified, while the local ones are trusted as they are
+		fromArchive := strings.HasSuffix(*pkgPath, ".tgz")
+		if fromArchive {
+			verifier, err := trust.Verifier()
+			if err != nil {
+				fatalln(err)
+			}
+			var cleanup func()
+			if pkg, cleanup, err = OpenArchive(*pkgPath, verifier); err != nil {
+				fatalln(err)
+			}
+			defer cleanup()
+		} else if _, statErr := os.Stat(*pkgPath); os.IsNotExist(statErr) && !filepath.IsAbs(*pkgPath) {
+			if installed, pkg, err = findRepoPackage(*pkgPath, trust); err != nil {
+				fatalln(err)
+			}
+		} else if pkg, err = LoadPackage(*pkgPath); err != nil {
+			fatalln(err)
+		}
+		entries, err := pkg.Select(*only)
+		if err != nil {
+			fatalln(err)
+		}
+		config, err := opts.PassConfig("", *dstDir)
+		if err != nil {
+			fatalln(err)
+		}
+		// the context specified overrides cargo.yaml of the package and its dependencies
+		if config.Sources, _, err = opts.specifiedSources(); err != nil {
+			fatalln(err)
+		}
+		config.OnConflict = *onConflict
+		config.Force = *force
+		config.Prune = *prune
+		// cached packages have no lock of their own, their dependencies are resolved every time
+		lock, deps, err := resolveDependencies(pkg, *update || installed != nil, trust)
+		if err != nil {
+			fatalln(err)
+		}
+		newPass := func(prompt func(target string) (bool, error)) (*Pass, error) {
+			pass, err := pkg.NewPass(config, deps, entries, prompt)
+			if err != nil {
+				return nil, err
+			}
+			// the package installed is recorded with parameters resolved, so it can be upgraded later
+			record := &InstallRecord{
+				Package: pkg.Name(),
+				Version: pkg.Version(),
+				Only:    *only,
+				Params:  config.Params,
+			}
+			if len(record.Package) == 0 || len(record.Version) == 0 {
+				return pass, nil
+			}
+			if installed != nil {
+				record.Repo = installed.Repo
+			}
+			if lock != nil {
+				record.Lock = lock.Packages
+			}
+			action, err := record.Action(*dstDir)
+			if err != nil {
+				return nil, err
+			}
+			pass.Queue = append(pass.Queue, action)
+			return pass, nil
+		}
+		if err := runPass(newPass, *dstDir, *dryRun, *showDiff); err != nil {
+			fatalln(err)
+		}
+		// the lock of a package from tarball or from the cache would be written into a dir not owned by user
+		if lock != nil && !*dryRun && !fromArchive && installed == nil {
+			if err := lock.Write(filepath.Join(pkg.Dir, LockFile)); err != nil {
+				fatalln(err)
+			}
+		}
+	}
+}
+
+// findRepoPackage finds the package given as [REPO/]NAME[@CONSTRAINT] in the cached repositories,
+// the latest version that satisfies the constraint is picked and its cached tarball is verified.
+func findRepoPackage(spec string, trust *trustOptions) (*LockedPackage, *Package, error) {
+	dep, err := ParseDependency(spec)
+	if err != nil {
+		err = fmt.Errorf("package %s is neither a local package nor a package in repositories: %v", spec, err)
+		return nil, nil, err
+	}
+	repos, err := LoadRepoConfig("")
+	if err != nil {
+		return nil, nil, err
+	}
+	verifier, err := trust.Verifier()
+	if err != nil {
+		return nil, nil, err
+	}
+	locked, pkg, err := repos.FindPackage(dep, "command line")
+	if err != nil {
+		return nil, nil, err
+	} else if err := repos.VerifyCached(locked, verifier); err != nil {
+		return nil, nil, err
+	}
+	log.WithFields(log.Fields{
+		"repo":    locked.Repo,
+		"version": locked.Version,
+	}).Infoln("installing", locked.Name)
+	return locked, pkg, nil
+}
+
+// resolveDependencies resolves dependencies of the package against the repositories added,
+// keeping the versions locked in cargo.lock of the package, unless they are updated.
+// The cached tarballs of dependencies are verified before they are installed.
+func resolveDependencies(pkg *Package, update bool, trust *trustOptions) (*Lock, []*Package, error) {
+	if len(pkg.Dependencies) == 0 {
+		return nil, nil, nil
+	}
+	verifier, err := trust.Verifier()
+	if err != nil {
+		return nil, nil, err
+	}
+	repos, err := LoadRepoConfig("")
+	if err != nil {
+		return nil, nil, err
+	}
+	var lock *Lock
+	if !update {
+		lock, err = ReadLock(filepath.Join(pkg.Dir, LockFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+	return repos.resolveVerified(pkg, lock, verifier)
+}
+
+// resolveVerified resolves dependencies of the package, keeping the versions locked if possible,
+// and verifies the cached tarballs of the dependencies resolved.
+func (c *RepoConfig) resolveVerified(pkg *Package, lock *Lock, verifier *Verifier) (*Lock, []*Package, error) {
+	lock, deps, err := c.Resolve(pkg, lock)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dep := range lock.Packages {
+		if err := c.VerifyCached(dep, verifier); err != nil {
+			return nil, nil, err
+		}
+		log.WithFields(log.Fields{
+			"repo":    dep.Repo,
+			"version": dep.Version,
+		}).Infoln("installing dependency", dep.Name)
+	}
+	return lock, deps, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+)
+
+// layoutFileName is the name of layout files, without mode prefix and extension, that
+// apply to all templates in their dir and subdirs, e.g. _layout.html.
+const layoutFileName = "layout"
+
+// layoutNone declared as layout disables layouts for the template.
+const layoutNone = "none"
+
+// layoutDirectiveRx matches the layout directive, e.g. {{/* layout: base.html */}}
+var layoutDirectiveRx = regexp.MustCompile(`\{\{-?\s*/\*\s*layout:\s*(\S+?)\s*\*/\s*-?\}\}`)
+
+// layoutTemplate is a parsed layout file, with the path of its own layout, if any.
+type layoutTemplate struct {
+	tpl    *template.Template
+	parent string
+}
+
+// wrappedTemplate tells how to wrap contents of a source template into layouts.
+type wrappedTemplate struct {
+	// layouts are paths of layouts, from the outermost one, which are also
+	// names of their main templates in the template set.
+	layouts []string
+	// content is returned by the content function, while a layout is executed.
+	content *string
+	// hasBlocks is set if the template defines blocks of layouts.
+	hasBlocks bool
+}
+
+// parseLayoutDecl returns the template text, with front matter replaced by a comment of
+// the same number of lines, so line numbers in errors are kept. The declared layout is
+// read from the layout field of front matter, or from the layout directive. Only front
+// matter closed with --- and declaring a layout is stripped, other text is kept as it is,
+// e.g. YAML documents starting with ---.
+func parseLayoutDecl(data []byte) (string, string) {
+	text := string(data)
+	if matter, end, ok := splitFrontMatter(text); ok {
+		var fields map[string]interface{}
+		if err := yaml.Unmarshal([]byte(matter), &fields); err == nil && fields["layout"] != nil {
+			lines := strings.Count(text[:end], "\n")
+			text = "{{- /*" + strings.Repeat("\n", lines) + "*/ -}}" + text[end:]
+			return text, fmt.Sprintf("%v", fields["layout"])
+		}
+	}
+	if m := layoutDirectiveRx.FindStringSubmatch(text); m != nil {
+		return text, m[1]
+	}
+	return text, ""
+}
+
+// splitFrontMatter returns front matter between the opening --- line and the closing one,
+// and the offset of text after the closing line.
+func splitFrontMatter(text string) (string, int, bool) {
+	if !strings.HasPrefix(text, "---\n") && !strings.HasPrefix(text, "---\r\n") {
+		return "", 0, false
+	}
+	start := strings.Index(text, "\n") + 1
+	for pos := start; pos <= len(text); {
+		lineEnd := strings.Index(text[pos:], "\n")
+		next := len(text)
+		if lineEnd >= 0 {
+			lineEnd += pos
+			next = lineEnd + 1
+		} else {
+			lineEnd = len(text)
+		}
+		if strings.TrimSuffix(text[pos:lineEnd], "\r") == "---" {
+			return text[start:pos], next, true
+		}
+		if next == len(text) {
+			break
+		}
+		pos = next
+	}
+	return "", 0, false
+}
+
+// isLayoutFile reports whether the file is a layout for its dir and subdirs.
+func (l *TemplateLoader) isLayoutFile(path string) bool {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	return name == l.opts.ModePrefix+layoutFileName
+}
+
+// IsLayout reports whether the file is a layout used by templates, or a layout file of a dir.
+func (l *TemplateLoader) IsLayout(path string) bool {
+	if _, ok := l.layouts[path]; ok {
+		return true
+	}
+	return l.autoLayouts[filepath.Dir(path)] == path
+}
+
+// Layouts returns sorted paths of layouts parsed for templates.
+func (l *TemplateLoader) Layouts() []string {
+	paths := make([]string, 0, len(l.layouts))
+	for path := range l.layouts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// AddLayout adds a layout file of a dir. Templates must be parsed again
+// with ReloadTemplates to use it.
+func (l *TemplateLoader) AddLayout(path string) {
+	l.autoLayouts[filepath.Dir(path)] = path
+}
+
+// RemoveLayout forgets a layout file of a dir.
+func (l *TemplateLoader) RemoveLayout(path string) {
+	if l.autoLayouts[filepath.Dir(path)] == path {
+		delete(l.autoLayouts, filepath.Dir(path))
+	}
+	delete(l.layouts, path)
+}
+
+// rootOf returns the source root the path is under.
+func (l *TemplateLoader) rootOf(path string) string {
+	for _, root := range l.roots {
+		if strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return root
+		}
+	}
+	return filepath.Dir(path)
+}
+
+// autoLayout returns the nearest layout file of dir or its parent dirs, up to the source root.
+func (l *TemplateLoader) autoLayout(dir string) string {
+	root := l.rootOf(dir + string(filepath.Separator))
+	for {
+		if path, ok := l.autoLayouts[dir]; ok {
+			return path
+		} else if dir == root || len(dir) <= len(root) {
+			return ""
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// resolveLayout finds the declared layout relative to the dir of the file
+// declaring it, or relative to the source root.
+func (l *TemplateLoader) resolveLayout(from, declared string) (string, error) {
+	if filepath.IsAbs(declared) {
+		return declared, nil
+	}
+	candidates := []string{
+		filepath.Join(filepath.Dir(from), declared),
+		filepath.Join(l.rootOf(from), declared),
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	err := fmt.Errorf("layout %s is not found", declared)
+	return "", err
+}
+
+// layout parses the layout file, unless it has been parsed already. The layout can be
+// wrapped into another one, declared the same way as in templates. Layout files of dirs
+// are wrapped into layout files of parent dirs.
+func (l *TemplateLoader) layout(path string) (*layoutTemplate, error) {
+	if layout, ok := l.layouts[path]; ok {
+		return layout, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	text, declared := parseLayoutDecl(data)
+	tpl := template.New(path)
+	tpl, err = tpl.Funcs(l.funcMap(tpl, nil)).Parse(text)
+	if err != nil {
+		return nil, NewTemplateError(path, err)
+	}
+	layout := &layoutTemplate{
+		tpl: tpl,
+	}
+	switch {
+	case declared == layoutNone:
+	case len(declared) > 0:
+		if layout.parent, err = l.resolveLayout(path, declared); err != nil {
+			return nil, &TemplateError{Source: path, Err: err.Error()}
+		}
+	case l.isLayoutFile(path):
+		if dir := filepath.Dir(path); dir != l.rootOf(path) {
+			layout.parent = l.autoLayout(filepath.Dir(dir))
+		}
+	}
+	l.layouts[path] = layout
+	return layout, nil
+}
+
+// layoutChain returns the layouts wrapping the source, from the outermost one.
+func (l *TemplateLoader) layoutChain(source, declared string) ([]*layoutTemplate, []string, error) {
+	var next string
+	switch {
+	case declared == layoutNone:
+		return nil, nil, nil
+	case len(declared) > 0:
+		path, err := l.resolveLayout(source, declared)
+		if err != nil {
+			return nil, nil, err
+		}
+		next = path
+	default:
+		next = l.autoLayout(filepath.Dir(source))
+	}
+	var chain []*layoutTemplate
+	var paths []string
+	seen := make(map[string]struct{})
+	for len(next) > 0 {
+		if _, ok := seen[next]; ok {
+			err := fmt.Errorf("layout %s wraps itself", next)
+			return nil, nil, err
+		}
+		seen[next] = struct{}{}
+		layout, err := l.layout(next)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append([]*layoutTemplate{layout}, chain...)
+		paths = append([]string{next}, paths...)
+		next = layout.parent
+	}
+	return chain, paths, nil
+}
+
+// wrapInLayouts adds templates of layouts to the template set of the source, from the
+// outermost one, so blocks of inner layouts override the outer ones. Templates defined
+// by the source itself override blocks of all layouts.
+func (l *TemplateLoader) wrapInLayouts(source string, tpl *template.Template,
+	chain []*layoutTemplate, paths []string, content *string) (*wrappedTemplate, error) {
+
+	name := filepath.Base(source)
+	var own []*template.Template
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil && t.Name() != name {
+			own = append(own, t)
+		}
+	}
+	for _, layout := range chain {
+		for _, t := range layout.tpl.Templates() {
+			if t.Tree == nil {
+				continue
+			}
+			if _, err := tpl.AddParseTree(t.Name(), t.Tree); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, t := range own {
+		if _, err := tpl.AddParseTree(t.Name(), t.Tree); err != nil {
+			return nil, err
+		}
+	}
+	w := &wrappedTemplate{
+		layouts:   paths,
+		content:   content,
+		hasBlocks: len(own) > 0,
+	}
+	return w, nil
+}
+
+// Execute renders the template of the source against the context, and wraps the contents
+// into layouts, from the innermost one. A template with empty contents is not wrapped,
+// unless it defines blocks for layouts.
+func (l *TemplateLoader) Execute(mode TemplateMode, source string, context TemplateContext) ([]byte, error) {
+	tpl := l.Template(mode, source)
+	data, err := renderTemplate(tpl, source, context)
+	if err != nil {
+		return nil, err
+	}
+	w, ok := l.wrapped[source]
+	if !ok {
+		return data, nil
+	} else if isEmptyOrWhitespace(data) && !w.hasBlocks {
+		return data, nil
+	}
+	for i := len(w.layouts) - 1; i >= 0; i-- {
+		*w.content = string(data)
+		buf := new(bytes.Buffer)
+		if err := tpl.ExecuteTemplate(buf, w.layouts[i], context); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	*w.content = ""
+	return data, nil
+}
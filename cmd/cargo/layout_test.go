@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLayoutDecl(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		name     string
+		data     string
+		text     string
+		declared string
+	}{
+		{"front matter", "---\nlayout: base.html\n---\nbody\n", "{{- /*\n\n\n*/ -}}body\n", "base.html"},
+		{"crlf front matter", "---\r\nlayout: base.html\r\n---\r\nbody\r\n", "{{- /*\n\n\n*/ -}}body\r\n", "base.html"},
+		{"directive", "{{/* layout: base.html */}}body\n", "{{/* layout: base.html */}}body\n", "base.html"},
+		{"single yaml document", "---\nname: app\nreplicas: 2\n", "---\nname: app\nreplicas: 2\n", ""},
+		{"multiple yaml documents", "---\nname: app\n---\nname: db\n", "---\nname: app\n---\nname: db\n", ""},
+		{"not closed", "---\nlayout: base.html\nbody\n", "---\nlayout: base.html\nbody\n", ""},
+		{"closing line with text", "---\nlayout: base.html\n--- #\nbody\n", "---\nlayout: base.html\n--- #\nbody\n", ""},
+	}
+	for _, test := range tests {
+		text, declared := parseLayoutDecl([]byte(test.data))
+		assert.Equal(test.text, text, test.name)
+		assert.Equal(test.declared, declared, test.name)
+	}
+}
+
+func TestPassYAMLDocuments(t *testing.T) {
+	assert := assert.New(t)
+	single := "---\nname: {{ .Cargo.Name }}\nreplicas: 2\n"
+	multi := "---\nname: {{ .Cargo.Name }}\n---\nname: db\n"
+	config, cleanup := newTestPassConfig(t, map[string]string{
+		"cargo.yaml":         "Cargo:\n  Name: app\n",
+		"src/_single.yaml":   single,
+		"src/_multi.yaml":    multi,
+		"src/_layout.yaml":   "# generated\n{{ content }}",
+		"src/_own.yaml":      "---\nlayout: none\n---\nname: {{ .Cargo.Name }}\n",
+		"src/_directive.txt": "{{/* layout: none */}}text\n",
+	})
+	defer cleanup()
+	if !assert.NoError(runTestPass(config)) {
+		return
+	}
+	for name, expected := range map[string]string{
+		"single.yaml":   "# generated\n---\nname: app\nreplicas: 2\n",
+		"multi.yaml":    "# generated\n---\nname: app\n---\nname: db\n",
+		"own.yaml":      "name: app\n",
+		"directive.txt": "text\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(config.DstDir, name))
+		if assert.NoError(err, name) {
+			assert.Equal(expected, string(data), name)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -10,7 +11,6 @@ import (
 	"strings"
 	"text/template"
 
-	"github.com/Masterminds/sprig"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,6 +19,19 @@ type TemplateLoader struct {
 	sources   map[TemplateMode][]string
 	templates map[TemplateMode]map[string]*template.Template
 
+	// partials are shared by all templates, partialTrees are their parsed templates
+	// added to each template set, partialPaths map partial names to files.
+	partials     []Partial
+	partialTrees []*template.Template
+	partialPaths map[string]string
+
+	// roots are source dirs, autoLayouts map dirs to their layout files, layouts
+	// are parsed layout files and wrapped are templates wrapped into layouts.
+	roots       []string
+	autoLayouts map[string]string
+	layouts     map[string]*layoutTemplate
+	wrapped     map[string]*wrappedTemplate
+
 	// filepathTplRx contains a precompiled Rx for replacing template tags
 	// in file paths, token delims must be quoted before compiling such Rx.
 	filepathTplRx *regexp.Regexp
@@ -36,6 +49,8 @@ type TemplateLoaderOptions struct {
 	LeftDelim  string
 	RightDelim string
 	ModePrefix string
+	// Strict makes missing keys in templates and unresolved fields in file paths errors.
+	Strict bool `json:",omitempty"`
 }
 
 func checkTemplateLoaderOptions(opts *TemplateLoaderOptions) *TemplateLoaderOptions {
@@ -61,6 +76,10 @@ func NewTemplateLoader(paths []string, opts *TemplateLoaderOptions) (*TemplateLo
 		opts:      checkTemplateLoaderOptions(opts),
 		sources:   make(map[TemplateMode][]string, 3),
 		templates: make(map[TemplateMode]map[string]*template.Template, 2),
+
+		autoLayouts: make(map[string]string),
+		layouts:     make(map[string]*layoutTemplate),
+		wrapped:     make(map[string]*wrappedTemplate),
 	}
 	loader.filepathTplRx = regexp.MustCompile(
 		regexp.QuoteMeta(loader.opts.LeftDelim) +
@@ -94,6 +113,7 @@ func NewTemplateLoader(paths []string, opts *TemplateLoaderOptions) (*TemplateLo
 			loader.addFileSource(fullPath)
 			continue
 		}
+		loader.roots = append(loader.roots, fullPath)
 		if err := filepath.Walk(fullPath, func(name string, info os.FileInfo, err error) error {
 			if info.IsDir() {
 				return nil
@@ -116,55 +136,163 @@ func NewTemplateLoader(paths []string, opts *TemplateLoaderOptions) (*TemplateLo
 	sort.Strings(loader.sources[TemplateModeVerbatim])
 	sort.Strings(loader.sources[TemplateModeCollection])
 
-	singleSources := loader.sources[TemplateModeSingle]
-	for _, source := range singleSources {
-		set := loader.templates[TemplateModeSingle]
-		if set == nil {
-			set = make(map[string]*template.Template, len(singleSources))
-			loader.templates[TemplateModeSingle] = set
+	if err := loader.parseTemplates(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// parseTemplates parses all single and collection templates. Files used as layouts
+// are not rendered on their own, so they are removed from sources.
+func (l *TemplateLoader) parseTemplates() error {
+	var errs ErrorList
+	for _, mode := range []TemplateMode{TemplateModeSingle, TemplateModeCollection} {
+		for _, source := range l.sources[mode] {
+			errs.Add(l.parseSource(mode, source))
 		}
+	}
+	for path := range l.layouts {
+		l.RemoveSource(path)
+	}
+	return errs.Err()
+}
+
+// ReloadTemplates parses all templates and layouts again, so changes in layouts are picked up.
+func (l *TemplateLoader) ReloadTemplates() error {
+	l.layouts = make(map[string]*layoutTemplate)
+	l.wrapped = make(map[string]*wrappedTemplate)
+	return l.parseTemplates()
+}
+
+func (l *TemplateLoader) addFileSource(path string) TemplateMode {
+	if l.isLayoutFile(path) {
+		l.AddLayout(path)
+		return ""
+	}
+	mode := l.sourceModeOf(path)
+	l.sources[mode] = append(l.sources[mode], path)
+	return mode
+}
 
-		tpl, err := template.New(source).Funcs(sprig.TxtFuncMap()).ParseFiles(source)
+func (l *TemplateLoader) sourceModeOf(path string) TemplateMode {
+	if l.filepathTplRx.MatchString(path) {
+		return TemplateModeCollection
+	} else if strings.HasPrefix(filepath.Base(path), l.opts.ModePrefix) {
+		return TemplateModeSingle
+	}
+	return TemplateModeVerbatim
+}
+
+// parseSource parses the source file as a template and puts it into the set of the
+// corresponding mode. Collection sources that are not text are kept with nil template.
+func (l *TemplateLoader) parseSource(mode TemplateMode, source string) error {
+	set := l.templates[mode]
+	if set == nil {
+		set = make(map[string]*template.Template, len(l.sources[mode]))
+		l.templates[mode] = set
+	}
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	text, declared := parseLayoutDecl(data)
+	content := new(string)
+	tpl := template.New(source)
+	if l.opts.Strict {
+		tpl = tpl.Option("missingkey=error")
+	}
+	_, err = tpl.Funcs(l.funcMap(tpl, content)).New(filepath.Base(source)).Parse(text)
+	if mode == TemplateModeCollection && isBinaryContent(err) {
+		set[source] = nil
+		return nil
+	} else if err != nil {
+		return NewTemplateError(source, err)
+	}
+	own := make(map[string]struct{})
+	for _, t := range tpl.Templates() {
+		own[t.Name()] = struct{}{}
+	}
+	delete(l.wrapped, source)
+	chain, paths, err := l.layoutChain(source, declared)
+	if err != nil {
+		if _, ok := err.(*TemplateError); ok {
+			return err
+		}
+		return &TemplateError{Source: source, Err: err.Error()}
+	} else if len(chain) > 0 {
+		w, err := l.wrapInLayouts(source, tpl, chain, paths, content)
 		if err != nil {
-			err = fmt.Errorf("template parse error: %v", err)
-			return nil, err
+			return NewTemplateError(source, err)
 		}
-		set[source] = tpl
+		l.wrapped[source] = w
 	}
+	if err := l.addPartialTrees(tpl, own); err != nil {
+		return NewTemplateError(source, err)
+	}
+	set[source] = tpl
+	return nil
+}
 
-	collectionSources := loader.sources[TemplateModeCollection]
-	for _, source := range collectionSources {
-		set := loader.templates[TemplateModeCollection]
-		if set == nil {
-			set = make(map[string]*template.Template, len(collectionSources))
-			loader.templates[TemplateModeCollection] = set
+// SourceMode returns the rendering mode of a known source file.
+func (l *TemplateLoader) SourceMode(path string) (TemplateMode, bool) {
+	for mode, sources := range l.sources {
+		idx := sort.SearchStrings(sources, path)
+		if idx < len(sources) && sources[idx] == path {
+			return mode, true
 		}
+	}
+	return "", false
+}
 
-		tpl, err := template.New(source).Funcs(sprig.TxtFuncMap()).ParseFiles(source)
-		if isBinaryContent(err) {
-			set[source] = nil
-			continue
-		} else if err != nil {
-			err = fmt.Errorf("template parse error: %v", err)
-			return nil, err
-		}
-		set[source] = tpl
+// AddSource categorizes a new source file and parses it, unless it's verbatim.
+// Adding a known source is the same as reloading it.
+func (l *TemplateLoader) AddSource(path string) (TemplateMode, error) {
+	if mode, ok := l.SourceMode(path); ok {
+		return mode, l.ReloadSource(path)
+	}
+	mode := l.sourceModeOf(path)
+	sources := l.sources[mode]
+	idx := sort.SearchStrings(sources, path)
+	sources = append(sources, "")
+	copy(sources[idx+1:], sources[idx:])
+	sources[idx] = path
+	l.sources[mode] = sources
+	if mode == TemplateModeVerbatim {
+		return mode, nil
 	}
+	return mode, l.parseSource(mode, path)
+}
 
-	return loader, nil
+// ReloadSource parses a known source template again, so changes in its contents
+// are picked up without walking the whole tree.
+func (l *TemplateLoader) ReloadSource(path string) error {
+	mode, ok := l.SourceMode(path)
+	if !ok {
+		return fmt.Errorf("unknown source: %s", path)
+	} else if mode == TemplateModeVerbatim {
+		return nil
+	}
+	return l.parseSource(mode, path)
 }
 
-func (l *TemplateLoader) addFileSource(path string) {
-	name := filepath.Base(path)
-	dir := filepath.Dir(path)
-	mode := TemplateModeVerbatim
-	if l.filepathTplRx.MatchString(path) {
-		mode = TemplateModeCollection
-	} else if strings.HasPrefix(name, l.opts.ModePrefix) {
-		path = filepath.Join(dir, name)
-		mode = TemplateModeSingle
+// RemoveSource forgets a source file, returns false if it wasn't known.
+func (l *TemplateLoader) RemoveSource(path string) (TemplateMode, bool) {
+	mode, ok := l.SourceMode(path)
+	if !ok {
+		return "", false
 	}
-	l.sources[mode] = append(l.sources[mode], path)
+	sources := l.sources[mode]
+	idx := sort.SearchStrings(sources, path)
+	l.sources[mode] = append(sources[:idx], sources[idx+1:]...)
+	delete(l.templates[mode], path)
+	delete(l.wrapped, path)
+	return mode, true
+}
+
+// Template returns the parsed template of a source, it is nil for verbatim
+// sources and for collection sources that are not text.
+func (l *TemplateLoader) Template(mode TemplateMode, source string) *template.Template {
+	return l.templates[mode][source]
 }
 
 // findCollectionPrefix finds the shortest prefix of a collection referenced in selector.
@@ -215,6 +343,32 @@ type collectionCache struct {
 // ("Bob" => TemplateContext), where TemplateContext.Current is TemplateContext.Friends[1].
 func (l *TemplateLoader) RenderFilepath(
 	rootContext TemplateContext, pathTemplate string) (map[string]TemplateContext, error) {
+	items, err := l.RenderFilepathItems(rootContext, pathTemplate)
+	if err != nil {
+		return nil, err
+	}
+	resultMap := make(map[string]TemplateContext, len(items))
+	for _, item := range items {
+		resultMap[item.Path] = item.Context
+	}
+	return resultMap, nil
+}
+
+// FilepathItem is a file path rendered from a path template, with the context for its contents.
+type FilepathItem struct {
+	Path    string
+	Context TemplateContext
+	// Collection is the selector of a collection referenced by path template,
+	// Index is the index of collection item the path has been rendered for.
+	Collection string
+	Index      int
+}
+
+// RenderFilepathItems is like RenderFilepath, but yields items in order of the collection,
+// telling which collection item each path has been rendered for. Paths rendered
+// for the same item twice are yielded once.
+func (l *TemplateLoader) RenderFilepathItems(
+	rootContext TemplateContext, pathTemplate string) ([]*FilepathItem, error) {
 
 	var err error
 	var collectionSelector string
@@ -231,6 +385,17 @@ func (l *TemplateLoader) RenderFilepath(
 	replaceWithCurrent := func(idx int) (string, TemplateContext, error) {
 		var currentContext TemplateContext
 		var currentError error
+		// unresolved fields are replaced with empty strings, unless in strict mode
+		unresolved := func(field string) string {
+			if l.opts.Strict {
+				if currentError == nil {
+					currentError = fmt.Errorf("field %s is not resolved", field)
+				}
+				return ""
+			}
+			log.WithField("field", field).Warningln("filename template field is not resolved")
+			return ""
+		}
 		path := l.filepathTplRx.ReplaceAllStringFunc(pathTemplate, func(field string) string {
 			field = strings.TrimPrefix(field, l.opts.LeftDelim)
 			field = strings.TrimSuffix(field, l.opts.RightDelim)
@@ -241,6 +406,8 @@ func (l *TemplateLoader) RenderFilepath(
 				currentContext = rootContext.CurrentAt(cached.CollectionSelector, idx)
 				if item, found := currentContext.CurrentItem(cached.ItemFieldSelector); found {
 					return fmt.Sprintf("%v", item)
+				} else if l.opts.Strict {
+					return unresolved(field)
 				}
 				return ""
 			}
@@ -273,14 +440,12 @@ func (l *TemplateLoader) RenderFilepath(
 					currentError = ErrIterStop
 					return fmt.Sprintf("%s", collection)
 				}
-				log.WithField("field", field).Warningln("filename template field is not resolved")
-				return ""
+				return unresolved(field)
 			}
 			if item, ok := rootContext.Item(selector); ok {
 				return fmt.Sprintf("%v", item)
 			}
-			log.WithField("field", field).Warningln("filename template field is not resolved")
-			return ""
+			return unresolved(field)
 		})
 		if currentContext == nil {
 			return path, rootContext, currentError
@@ -289,16 +454,29 @@ func (l *TemplateLoader) RenderFilepath(
 	}
 	path, currentContext, err := replaceWithCurrent(0)
 	if err == ErrIterStop {
-		resultMap := map[string]TemplateContext{
-			path: currentContext,
+		item := &FilepathItem{
+			Path:       path,
+			Context:    currentContext,
+			Collection: collectionSelector,
+			Index:      -1,
 		}
-		return resultMap, nil
+		return []*FilepathItem{item}, nil
 	} else if err != nil {
 		return nil, err
 	}
 
-	resultMap := map[string]TemplateContext{
-		path: currentContext,
+	index := 0
+	if len(collectionSelector) == 0 {
+		index = -1
+	}
+	items := []*FilepathItem{{
+		Path:       path,
+		Context:    currentContext,
+		Collection: collectionSelector,
+		Index:      index,
+	}}
+	seen := map[string]int{
+		path: 0,
 	}
 	if collectionLength > 1 {
 		// we have more items to traverse in collection
@@ -307,10 +485,22 @@ func (l *TemplateLoader) RenderFilepath(
 			if err != nil {
 				return nil, err
 			}
-			resultMap[path] = currentContext
+			item := &FilepathItem{
+				Path:       path,
+				Context:    currentContext,
+				Collection: collectionSelector,
+				Index:      idx,
+			}
+			if i, ok := seen[path]; ok {
+				// the last item wins, as it would in a map
+				items[i] = item
+				continue
+			}
+			seen[path] = len(items)
+			items = append(items, item)
 		}
 	}
-	return resultMap, nil
+	return items, nil
 }
 
 var ErrIterStop = errors.New("stop iterating")
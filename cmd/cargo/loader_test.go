@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderFilepathItemsStrict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cargo-loader-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := NewTemplateContext()
+	ctx["Site"] = map[string]interface{}{"name": "demo"}
+	ctx["Friends"] = []interface{}{
+		map[string]interface{}{"Name": "Maxim"},
+		map[string]interface{}{"Name": "Ivan"},
+	}
+	tests := []struct {
+		name   string
+		path   string
+		strict bool
+		paths  []string
+		err    string
+	}{{
+		name:  "resolved",
+		path:  "{{.Site.name}}_{{.Friends.Name}}.txt",
+		paths: []string{"demo_Maxim.txt", "demo_Ivan.txt"},
+	}, {
+		name:  "missing key",
+		path:  "{{.Site.title}}_{{.Site.name}}.txt",
+		paths: []string{"_demo.txt"},
+	}, {
+		name:  "missing item field",
+		path:  "{{.Friends.Name}}_{{.Friends.Age}}.txt",
+		paths: []string{"Maxim_.txt", "Ivan_.txt"},
+	}, {
+		name:   "strict resolved",
+		path:   "{{.Site.name}}_{{.Friends.Name}}.txt",
+		strict: true,
+		paths:  []string{"demo_Maxim.txt", "demo_Ivan.txt"},
+	}, {
+		name:   "strict missing key",
+		path:   "{{.Site.title}}_{{.Site.name}}.txt",
+		strict: true,
+		err:    "field .Site.title is not resolved",
+	}, {
+		name:   "strict missing item field",
+		path:   "{{.Friends.Name}}_{{.Friends.Age}}.txt",
+		strict: true,
+		err:    "field .Friends.Age is not resolved",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			loader, err := NewTemplateLoader([]string{dir}, &TemplateLoaderOptions{
+				ModePrefix: "_",
+				LeftDelim:  "{{",
+				RightDelim: "}}",
+				Strict:     test.strict,
+			})
+			if !assert.NoError(err) {
+				return
+			}
+			items, err := loader.RenderFilepathItems(ctx, test.path)
+			if len(test.err) > 0 {
+				if assert.Error(err) {
+					assert.Equal(test.err, err.Error())
+				}
+				return
+			} else if !assert.NoError(err) {
+				return
+			}
+			var paths []string
+			for _, item := range items {
+				paths = append(paths, item.Path)
+			}
+			assert.Equal(test.paths, paths)
+		})
+	}
+}
+
+func TestRenderMissingKeyStrict(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+		output string
+	}{
+		{name: "missing key", output: "demo: <no value>"},
+		{name: "strict missing key", strict: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			config, cleanup := newTestPassConfig(t, map[string]string{
+				"cargo.yaml":     "Cargo:\n  Name: demo\n",
+				"src/_title.txt": "{{ .Cargo.Name }}: {{ .Cargo.title }}",
+				"src/_name.txt":  "{{ .Cargo.Name }}",
+			})
+			defer cleanup()
+			config.Loader.Strict = test.strict
+			err := runTestPass(config)
+			if !test.strict {
+				if assert.NoError(err) {
+					data, _ := ioutil.ReadFile(filepath.Join(config.DstDir, "title.txt"))
+					assert.Equal(test.output, string(data))
+				}
+				return
+			}
+			if assert.Error(err) {
+				assert.Contains(err.Error(), filepath.Join(config.SrcDir, "_title.txt"))
+				assert.Contains(err.Error(), `map has no entry for key "title"`)
+			}
+			_, err = os.Stat(filepath.Join(config.DstDir, "name.txt"))
+			assert.True(os.IsNotExist(err), "nothing must be written in strict mode")
+		})
+	}
+}
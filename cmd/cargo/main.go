@@ -4,12 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"text/template"
-	"time"
 
 	"github.com/jawher/mow.cli"
 	log "github.com/sirupsen/logrus"
@@ -21,6 +19,30 @@ var app = cli.App("cargo", "Cargo builds things.")
 func main() {
 	app.Command("run", "The Cargo run operation moves source files to the destination folder, "+
 		"processing the template files it encounters.", runCmd)
+	app.Command("watch", "The Cargo watch operation runs continuously, re-rendering sources "+
+		"to the destination folder as they or context sources change.", watchCmd)
+	app.Command("serve", "The Cargo serve operation renders source files into a temporary folder "+
+		"and serves it over HTTP, reloading open pages as sources change.", serveCmd)
+	app.Command("diff", "The Cargo diff operation renders source files in memory and prints "+
+		"unified diffs against the files in the destination folder.", diffCmd)
+	app.Command("status", "The Cargo status operation reports generated files in the destination folder "+
+		"that have been edited or deleted since the last run.", statusCmd)
+	app.Command("init", "The Cargo init operation creates a new package from one of the starter packages "+
+		"built into cargo, with example templates and a test fixture.", initCmd)
+	app.Command("install", "The Cargo install operation renders folders listed in the package manifest "+
+		"to the destination folder.", installCmd)
+	app.Command("upgrade", "The Cargo upgrade operation merges changes between the version of the package installed "+
+		"and a newer one into the destination folder, marking conflicts with files edited since.", upgradeCmd)
+	app.Command("package", "The Cargo package operation archives the package into a reproducible tarball "+
+		"named after Cargo.name and Cargo.version, with its SHA-256 checksum.", packageCmd)
+	app.Command("repo", "The Cargo repo operations add, refresh, list and index repositories "+
+		"of packages, served over HTTP or from local folders.", repoCmd)
+	app.Command("list", "Lists packages in all repositories added.", listCmd)
+	app.Command("search", "Finds packages in all repositories added, by name, description and author.", searchCmd)
+	app.Command("plan", "The Cargo plan operation renders source files in memory and writes "+
+		"the planned actions as JSON, to be reviewed and applied later.", planCmd)
+	app.Command("apply", "The Cargo apply operation executes a plan created by cargo plan, "+
+		"refusing if sources, context or the destination folder have changed since.", applyCmd)
 	app.Command("version", "Prints the version", versionCmd)
 	if err := app.Run(os.Args); err != nil {
 		log.Fatalln(err)
@@ -28,196 +50,285 @@ func main() {
 }
 
 func runCmd(cmd *cli.Cmd) {
-	logLevel := cmd.IntOpt("l log-level", 3, "Sets the log level [0 = no log, 5 = debug].")
+	opts := addRunOptions(cmd)
 	dryRun := cmd.BoolOpt("d dry-run", false, "Do not modify filesystem, only print planned actions.")
-	delimiters := cmd.StringOpt("delimiters", "{{,}}", "Comma-seprated delimiters to scan in templates, left and right.")
-	modePrefix := cmd.StringOpt("prefix", "_", "Prefix in filenames to specify singular templates.")
-	contextSources := cmd.StringsOpt("c context", nil,
-		"Specify multiple context sources in format Name=<yaml/json file> (e.g. Values=helm-chart-values.yaml)")
+	showDiff := cmd.BoolOpt("diff", false, "Print unified diffs between planned outputs and files in DST, without writing them.")
+	onConflict := addConflictOption(cmd)
+	force := addForceOption(cmd)
+	prune := cmd.BoolOpt("prune", false, "Delete files generated by previous runs of the package, that are not generated anymore.")
+	output := cmd.StringOpt("o output", "text", "Format of planned actions printed by --dry-run [text, json], json requires --dry-run.")
 
 	srcDir := cmd.StringArg("SRC", "cargo/", "Specify source files dir for your site.")
 	dstDir := cmd.StringArg("DST", "build/", "Specify destination dir for your site publication.")
 
 	cmd.Spec = "[OPTIONS] SRC [DST]"
-	cmd.Before = func() {
-		if isDebug(logLevel) {
-			log.SetReportCaller(true)
-		}
-		log.SetLevel(log.Level(*logLevel))
-	}
 	cmd.Action = func() {
-		delimsParsed := strings.Split(*delimiters, ",")
-		if len(delimsParsed) != 2 {
-			log.Fatalln("incorrect delimiters specification:", *delimiters)
-		}
-		srcAbsPath, err := filepath.Abs(*srcDir)
-		if err != nil {
-			log.Fatalln("cannot get absolute path for:", *srcDir)
-		} else if !strings.HasSuffix(srcAbsPath, "/") {
-			srcAbsPath += "/"
-		}
-		loader, err := NewTemplateLoader(
-			[]string{*srcDir},
-			&TemplateLoaderOptions{
-				ModePrefix: *modePrefix,
-				LeftDelim:  delimsParsed[0],
-				RightDelim: delimsParsed[1],
-			})
+		config, err := opts.PassConfig(*srcDir, *dstDir)
 		if err != nil {
-			log.Fatalln(err)
+			fatalln(err)
 		}
-		rootContext := NewTemplateContext()
-		var hasGlobal bool
-		for _, source := range *contextSources {
-			parts := strings.Split(source, "=")
-			if len(parts) != 2 {
-				data, err := ioutil.ReadFile(parts[0])
-				if err == nil {
-					if err == rootContext.LoadGlobalFromYAML(data) {
-						hasGlobal = true
-						continue
-					}
-				}
-				err = fmt.Errorf("incorrect context source specification: %s", source)
-				log.Fatalln(err)
-			}
-			name := strings.TrimSpace(parts[0])
-			path := strings.TrimSpace(parts[1])
-			data, err := ioutil.ReadFile(path)
+		config.OnConflict = *onConflict
+		config.Force = *force
+		config.Prune = *prune
+		if *output != "text" && *output != "json" {
+			log.Fatalln("unknown output format:", *output)
+		} else if *output == "json" && !*dryRun {
+			log.Fatalln("--output json prints planned actions, it requires --dry-run")
+		} else if *output == "json" {
+			plan, err := NewPlan(config, nil)
 			if err != nil {
-				log.Fatalln(err)
+				fatalln(err)
 			}
-			sourceExt := filepath.Ext(path)
-			if sourceExt == ".json" {
-				if err := rootContext.LoadFromJSON(name, data); err != nil {
-					err = fmt.Errorf("error loading %s: %v", path, err)
-					log.Fatalln(err)
-				}
-			} else if sourceExt == ".yaml" || sourceExt == ".yml" {
-				if err := rootContext.LoadFromYAML(name, data); err != nil {
-					err = fmt.Errorf("error loading %s: %v", path, err)
-					log.Fatalln(err)
-				}
-			} else {
-				err := fmt.Errorf("unsupported Context source format: %s", sourceExt)
-				log.Fatalln(err)
-			}
-		}
-		if !hasGlobal {
-			data, err := ioutil.ReadFile("cargo.yaml")
-			if err == nil {
-				if err == rootContext.LoadGlobalFromYAML(data) {
-					hasGlobal = true
-				}
+			if err := plan.Write(os.Stdout); err != nil {
+				fatalln(err)
 			}
+			return
 		}
-		if isDebug(logLevel) {
-			v, _ := json.MarshalIndent(rootContext, "", "\t")
-			log.Debugln("Context:", string(v))
+		if err := runPass(config.NewPass, *dstDir, *dryRun, *showDiff); err != nil {
+			fatalln(err)
 		}
-		if err := rootContext.LoadEnvVars(); err != nil {
-			log.Fatalln(err)
+	}
+}
+
+// runPass plans a pass and executes it, or prints planned actions on dry-run. Diffs are a preview
+// as well, nothing is written. Existing targets are prompted for on the terminal, unless it's a preview.
+func runPass(newPass func(prompt func(target string) (bool, error)) (*Pass, error),
+	dstDir string, dryRun, showDiff bool) error {
+
+	var prompt func(target string) (bool, error)
+	if !dryRun && !showDiff {
+		prompt = NewOverwritePrompt(os.Stdin, os.Stderr)
+	}
+	pass, err := newPass(prompt)
+	if err != nil {
+		return err
+	}
+	if showDiff {
+		return WriteOutputsDiff(os.Stdout, dstDir, pass.Outputs(), 3)
+	} else if dryRun {
+		fmt.Println(pass.Description())
+		return nil
+	}
+	return pass.Exec()
+}
+
+// runOptions are shared by all commands that render sources into a destination.
+type runOptions struct {
+	LogLevel       *int
+	Delimiters     *string
+	ModePrefix     *string
+	Strict         *bool
+	ContextSources *[]string
+	MergeRules     *[]string
+	Params         *[]string
+	SetStrings     *[]string
+	SetFiles       *[]string
+	Answers        *string
+}
+
+func addRunOptions(cmd *cli.Cmd) *runOptions {
+	opts := &runOptions{
+		LogLevel:   addLogLevelOption(cmd),
+		Delimiters: cmd.StringOpt("delimiters", "{{,}}", "Comma-seprated delimiters to scan in templates, left and right."),
+		ModePrefix: cmd.StringOpt("prefix", "_", "Prefix in filenames to specify singular templates."),
+		Strict:     cmd.BoolOpt("strict", false, "Fail on missing keys in templates and unresolved fields in file paths."),
+		ContextSources: cmd.StringsOpt("c context", nil,
+			"Specify multiple context sources in format Name=[format:]<file> (e.g. Values=helm-chart-values.yaml), "+
+				"the format is json, yaml, toml, env, csv or xml, chosen by the file extension by default, - reads the standard input"),
+		MergeRules: cmd.StringsOpt("merge", nil,
+			"Specify how arrays of context sources loaded into the same root are merged, in format PATH=STRATEGY "+
+				"(e.g. Values.servers=key:name), the strategy is replace, append or key:FIELD, replace by default"),
+		Params: cmd.StringsOpt("set", nil, "Set values of package parameters in format NAME=VALUE, or values in the context "+
+			"in format PATH=VALUE (e.g. Values.image.tag=1.25), once all context sources are loaded. Many values are set as PATH=VALUE[,PATH=VALUE...], unknown parameters are errors."),
+		SetStrings: cmd.StringsOpt("set-string", nil, "Set string values in format PATH=VALUE, like --set does, values are not converted to other types."),
+		SetFiles:   cmd.StringsOpt("set-file", nil, "Set values to contents of files in format PATH=<file>, like --set does."),
+		Answers:    cmd.StringOpt("answers", "", "YAML or JSON file with values of package parameters, overridden by --set."),
+	}
+	return opts
+}
+
+func addLogLevelOption(cmd *cli.Cmd) *int {
+	logLevel := cmd.IntOpt("l log-level", 3, "Sets the log level [0 = no log, 5 = debug].")
+	debug := cmd.BoolOpt("debug", false, "Sets the log level to debug, context sources each context key comes from are reported.")
+	cmd.Before = func() {
+		if *debug {
+			*logLevel = 5
 		}
-		if err := rootContext.LoadOsVars(); err != nil {
-			log.Fatalln(err)
+		if isDebug(logLevel) {
+			log.SetReportCaller(true)
 		}
+		log.SetLevel(log.Level(*logLevel))
+	}
+	return logLevel
+}
 
-		var verbatimActions Queue
-		if err := loader.ForEachSource(TemplateModeVerbatim, func(source string) error {
-			relativePath := strings.TrimPrefix(source, srcAbsPath)
-			target := filepath.Join(*dstDir, relativePath)
-			verbatimActions = append(verbatimActions, CopyFileAction(*dstDir, target, source))
-			return nil
-		}); err != nil {
-			log.Fatalln(err)
-		}
-		if *dryRun {
-			fmt.Println(verbatimActions.Description("Verbatim Files"))
+func addConflictOption(cmd *cli.Cmd) *string {
+	return cmd.StringOpt("on-conflict", string(ConflictOverwrite),
+		"Policy for files existing in DST [overwrite, skip, fail, prompt], can be overridden per glob in Cargo.onConflict.")
+}
+
+func addForceOption(cmd *cli.Cmd) *bool {
+	return cmd.BoolOpt("f force", false, "Overwrite or prune generated files, even if they have been edited since generated.")
+}
+
+func (o *runOptions) LoaderOptions() (*TemplateLoaderOptions, error) {
+	delimsParsed := strings.Split(*o.Delimiters, ",")
+	if len(delimsParsed) != 2 {
+		err := fmt.Errorf("incorrect delimiters specification: %s", *o.Delimiters)
+		return nil, err
+	}
+	opts := &TemplateLoaderOptions{
+		ModePrefix: *o.ModePrefix,
+		LeftDelim:  delimsParsed[0],
+		RightDelim: delimsParsed[1],
+		Strict:     *o.Strict,
+	}
+	return opts, nil
+}
+
+// Sources returns all context sources specified, if no global context has been specified,
+// cargo.yaml from the working dir is used as an optional one.
+func (o *runOptions) Sources() ([]ContextSource, error) {
+	sources, hasGlobal, err := o.specifiedSources()
+	if err != nil {
+		return nil, err
+	}
+	if !hasGlobal {
+		if _, err := os.Stat("cargo.yaml"); err == nil {
+			sources = append(sources, ContextSource{
+				Path:     "cargo.yaml",
+				Optional: true,
+			})
 		}
+	}
+	return sources, nil
+}
 
-		var singularActions Queue
-		if err := loader.RenderEachTemplate(TemplateModeSingle, func(tpl *template.Template, source string) error {
-			relativePath := strings.TrimPrefix(source, srcAbsPath)
-			contents, err := renderTemplate(tpl, source, rootContext)
-			if err != nil {
-				err = fmt.Errorf("template rendering failed for %s: %v", relativePath, err)
-				log.Fatalln(err)
-			} else if isEmptyOrWhitespace(contents) {
-				return nil
-			}
-			target := filepath.Join(*dstDir, relativePath)
-			target = removeModePrefix(target, *modePrefix)
-			if info, err := os.Stat(target); os.IsNotExist(err) {
-				singularActions = append(singularActions, CreateNewFileAction(*dstDir, target, contents))
-			} else if info.IsDir() {
-				log.Fatalln("target is a directory:", target)
-			} else {
-				singularActions = append(singularActions, OverwriteFileAction(*dstDir, target, contents))
-			}
-			return nil
-		}); err != nil {
-			err = fmt.Errorf("tempate validation failed: %v", err)
-			log.Fatalln(err)
+// specifiedSources returns context sources specified with options, telling whether
+// there is a global context among them.
+func (o *runOptions) specifiedSources() ([]ContextSource, bool, error) {
+	var sources []ContextSource
+	var hasGlobal, hasStdin bool
+	for _, spec := range *o.ContextSources {
+		source, err := ParseContextSource(spec)
+		if err != nil {
+			return nil, false, err
+		} else if len(source.Name) == 0 {
+			hasGlobal = true
 		}
-		if *dryRun {
-			fmt.Println(singularActions.Description("Single Templates"))
+		if source.Path == StdinPath && hasStdin {
+			err := fmt.Errorf("only one context source can be read from the standard input: %s", spec)
+			return nil, false, err
+		} else if source.Path == StdinPath {
+			hasStdin = true
 		}
+		sources = append(sources, source)
+	}
+	return sources, hasGlobal, nil
+}
 
-		var collectionActions Queue
-		if err := loader.RenderEachTemplate(TemplateModeCollection,
-			func(tpl *template.Template, source string) error {
-				outputs, err := loader.RenderFilepath(rootContext, source)
-				if err != nil {
-					return err
-				}
-				for output, currentContext := range outputs {
-					relativePath := strings.TrimPrefix(source, srcAbsPath)
-					relativeOutput := strings.TrimPrefix(output, srcAbsPath)
-					target := filepath.Join(*dstDir, relativeOutput)
-					target = removeModePrefix(target, *modePrefix)
-					if tpl == nil {
-						collectionActions = append(collectionActions, CopyFileAction(*dstDir, target, source))
-						continue
-					}
-					contents, err := renderTemplate(tpl, source, currentContext)
-					if err != nil {
-						err = fmt.Errorf("template rendering failed for %s: %v", relativePath, err)
-						log.Fatalln(err)
-					} else if isEmptyOrWhitespace(contents) {
-						continue
-					}
-					if info, err := os.Stat(target); os.IsNotExist(err) {
-						collectionActions = append(collectionActions, CreateNewFileAction(*dstDir, target, contents))
-					} else if info.IsDir() {
-						log.Fatalln("target is a directory:", target)
-					} else {
-						collectionActions = append(collectionActions, OverwriteFileAction(*dstDir, target, contents))
-					}
-				}
-				return nil
-			}); err != nil {
-			err = fmt.Errorf("tempate validation failed: %v", err)
-			log.Fatalln(err)
+// Overrides returns values given with --set, --set-string and --set-file, in this order. Values
+// of package parameters are among them, they are told apart once parameters are known.
+func (o *runOptions) Overrides() ([]*ContextOverride, error) {
+	var overrides []*ContextOverride
+	kinds := []SetKind{SetTyped, SetString, SetFile}
+	for i, specs := range [][]string{*o.Params, *o.SetStrings, *o.SetFiles} {
+		parsed, err := ParseSetValues(specs, kinds[i])
+		if err != nil {
+			return nil, err
 		}
-		if *dryRun {
-			fmt.Println(collectionActions.Description("Collection Templates"))
+		overrides = append(overrides, parsed...)
+	}
+	return overrides, nil
+}
+
+// MergeRulesSpecified returns merge rules specified with options.
+func (o *runOptions) MergeRulesSpecified() (MergeRules, error) {
+	var rules MergeRules
+	for _, spec := range *o.MergeRules {
+		rule, err := ParseMergeRule(spec)
+		if err != nil {
+			return nil, err
 		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
 
-		if *dryRun {
-			return
+// PassConfig returns the config of a pass from SRC into DST with all rendering options specified.
+func (o *runOptions) PassConfig(srcDir, dstDir string) (*PassConfig, error) {
+	loaderOpts, err := o.LoaderOptions()
+	if err != nil {
+		return nil, err
+	}
+	sources, err := o.Sources()
+	if err != nil {
+		return nil, err
+	}
+	params := make(map[string]interface{})
+	if len(*o.Answers) > 0 {
+		if params, err = ReadAnswers(*o.Answers); err != nil {
+			return nil, err
 		}
-		actionQueue := NewQueue(
-			NewDirAction(*dstDir, *dstDir),
-		)
-		actionQueue = append(actionQueue, verbatimActions...)
-		actionQueue = append(actionQueue, singularActions...)
-		actionQueue = append(actionQueue, collectionActions...)
-		ts := time.Now()
-		if !actionQueue.Exec() {
-			log.Fatalln("failed in", time.Since(ts))
+	}
+	overrides, err := o.Overrides()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := o.MergeRulesSpecified()
+	if err != nil {
+		return nil, err
+	}
+	config := &PassConfig{
+		SrcDir:      srcDir,
+		DstDir:      dstDir,
+		Sources:     sources,
+		Merge:       rules,
+		Overrides:   overrides,
+		Loader:      *loaderOpts,
+		OnConflict:  string(ConflictOverwrite),
+		Params:      params,
+		ParamPrompt: NewParamPrompt(os.Stdin, os.Stderr),
+	}
+	return config, nil
+}
+
+func (o *runOptions) NewRenderer(srcDir, dstDir string) (*Renderer, error) {
+	config, err := o.PassConfig(srcDir, dstDir)
+	if err != nil {
+		return nil, err
+	}
+	return config.NewRenderer()
+}
+
+// LoadContext builds the root context from all context sources, merged with the rules, Env and OS vars,
+// and Git vars of the repository containing srcDir, or the working dir.
+func LoadContext(sources []ContextSource, rules MergeRules, srcDir string) (TemplateContext, error) {
+	rootContext := NewTemplateContext()
+	if err := rootContext.LoadSources(sources, rules); err != nil {
+		return nil, err
+	}
+	if log.IsLevelEnabled(log.DebugLevel) {
+		v, _ := json.MarshalIndent(rootContext, "", "\t")
+		log.Debugln("Context:", string(v))
+	}
+	if err := rootContext.LoadEnvVars(); err != nil {
+		return nil, err
+	}
+	if err := rootContext.LoadOsVars(); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{srcDir, "."} {
+		if len(dir) == 0 {
+			continue
+		} else if err := rootContext.LoadGitVars(dir); err != nil {
+			log.Warningln(err)
+			break
+		} else if rootContext["Git"] != nil {
+			break
 		}
-		log.Infoln("done in", time.Since(ts))
 	}
+	return rootContext, nil
 }
 
 func removeModePrefix(path, modePrefix string) string {
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/troven/cargo/version"
+)
+
+// ManifestPath is the path of the generated files manifest, relative to the destination dir.
+const ManifestPath = ".cargo/manifest.json"
+
+// Manifest records files generated into the destination dir by cargo runs,
+// so files that cargo has not created are never touched when pruning, and
+// files edited by hand since the last run can be detected by their hashes.
+type Manifest struct {
+	GeneratorVersion string
+	Files            []*ManifestFile
+}
+
+// ManifestFile is a file generated by a package.
+type ManifestFile struct {
+	// Path is a slash-separated path relative to the destination dir.
+	Path    string
+	Package string `json:",omitempty"`
+	// Source is a slash-separated path of the source, relative to the source dir.
+	Source string
+	Mode   TemplateMode
+	// Item is the collection item the file has been rendered for.
+	Item *OutputItem `json:",omitempty"`
+	// Hash is the hash of file contents, as it has been generated.
+	Hash string
+}
+
+// FileStatus tells how a generated file differs from the one recorded in the manifest.
+type FileStatus string
+
+const (
+	FileStatusUnchanged FileStatus = "unchanged"
+	FileStatusModified  FileStatus = "modified"
+	FileStatusDeleted   FileStatus = "deleted"
+)
+
+// Status compares the file in the destination dir with its record. Files recorded
+// without hash are considered unchanged, as there is nothing to compare them with.
+func (f *ManifestFile) Status(dstDir string) (FileStatus, error) {
+	hash, err := fileHash(filepath.Join(dstDir, filepath.FromSlash(f.Path)))
+	if os.IsNotExist(err) {
+		return FileStatusDeleted, nil
+	} else if err != nil {
+		return "", err
+	} else if len(f.Hash) > 0 && hash != f.Hash {
+		return FileStatusModified, nil
+	}
+	return FileStatusUnchanged, nil
+}
+
+// ReadManifest reads the manifest from the destination dir,
+// the manifest is empty if the dir has no manifest yet.
+func ReadManifest(dstDir string) (*Manifest, error) {
+	m := new(Manifest)
+	data, err := ioutil.ReadFile(filepath.Join(dstDir, ManifestPath))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		err = fmt.Errorf("error loading %s: %v", ManifestPath, err)
+		return nil, err
+	}
+	return m, nil
+}
+
+// Find returns the record of a file by its path relative to the destination dir.
+func (m *Manifest) Find(path string) (*ManifestFile, bool) {
+	path = filepath.ToSlash(path)
+	idx := sort.Search(len(m.Files), func(i int) bool {
+		return m.Files[i].Path >= path
+	})
+	if idx < len(m.Files) && m.Files[idx].Path == path {
+		return m.Files[idx], true
+	}
+	return nil, false
+}
+
+// IsEdited reports whether the file in the destination dir has been generated
+// by cargo and edited since.
+func (m *Manifest) IsEdited(dstDir, target string) bool {
+	if m == nil {
+		return false
+	}
+	path, err := filepath.Rel(dstDir, target)
+	if err != nil {
+		return false
+	}
+	f, ok := m.Find(path)
+	if !ok {
+		return false
+	}
+	status, err := f.Status(dstDir)
+	return err == nil && status == FileStatusModified
+}
+
+// Update adds files to the manifest, replacing records with the same path.
+func (m *Manifest) Update(files []*ManifestFile) {
+	idx := make(map[string]int, len(m.Files))
+	for i, f := range m.Files {
+		idx[f.Path] = i
+	}
+	for _, f := range files {
+		if i, ok := idx[f.Path]; ok {
+			m.Files[i] = f
+			continue
+		}
+		idx[f.Path] = len(m.Files)
+		m.Files = append(m.Files, f)
+	}
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Path < m.Files[j].Path
+	})
+}
+
+// Remove removes records of files from the manifest.
+func (m *Manifest) Remove(files []*ManifestFile) {
+	removed := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		removed[f.Path] = struct{}{}
+	}
+	kept := m.Files[:0]
+	for _, f := range m.Files {
+		if _, ok := removed[f.Path]; !ok {
+			kept = append(kept, f)
+		}
+	}
+	m.Files = kept
+}
+
+// Stale returns files of the package recorded in the manifest, that are not among paths generated now.
+func (m *Manifest) Stale(pkg string, generated map[string]struct{}) []*ManifestFile {
+	var stale []*ManifestFile
+	for _, f := range m.Files {
+		if f.Package != pkg {
+			continue
+		}
+		if _, ok := generated[f.Path]; !ok {
+			stale = append(stale, f)
+		}
+	}
+	return stale
+}
+
+// Action returns a queue action that writes the manifest into the destination dir.
+func (m *Manifest) Action(dstDir string) (QueueAction, error) {
+	m.GeneratorVersion = version.Version
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dstDir, ManifestPath)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return CreateNewFileAction(dstDir, path, data), nil
+	}
+	return OverwriteFileAction(dstDir, path, data), nil
+}
+
+// PackageName returns the name of the package being rendered, from the global Cargo context.
+func (r *Renderer) PackageName() string {
+	if name, ok := r.Context.Global().Lookup("Name"); ok {
+		return fmt.Sprintf("%v", name)
+	}
+	return ""
+}
+
+// ManifestFiles returns the manifest records for outputs published by actions.
+// Outputs with skipped targets are not recorded, as cargo didn't write them.
+func (r *Renderer) ManifestFiles(outputs []*Output, actions Queue) ([]*ManifestFile, error) {
+	pkg := r.PackageName()
+	files := make([]*ManifestFile, 0, len(outputs))
+	for i, output := range outputs {
+		if i < len(actions) && isSkipAction(actions[i]) {
+			continue
+		}
+		path, err := filepath.Rel(r.dstDir, output.Target)
+		if err != nil {
+			continue
+		}
+		source, err := filepath.Rel(r.srcDir, output.Source)
+		if err != nil {
+			source = output.Source
+		}
+		hash, err := output.Hash()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &ManifestFile{
+			Path:    filepath.ToSlash(path),
+			Package: pkg,
+			Source:  filepath.ToSlash(source),
+			Mode:    output.Mode,
+			Item:    output.Item,
+			Hash:    hash,
+		})
+	}
+	return files, nil
+}
+
+// PruneActions returns actions that delete stale files of the package, which still exist.
+// Files edited since they have been generated are kept, unless force is set,
+// the returned list contains files that have been actually pruned.
+func PruneActions(dstDir string, stale []*ManifestFile, force bool) (Queue, []*ManifestFile) {
+	var actions Queue
+	var pruned []*ManifestFile
+	for _, f := range stale {
+		target := filepath.Join(dstDir, filepath.FromSlash(f.Path))
+		if info, err := os.Lstat(target); err != nil || info.IsDir() {
+			pruned = append(pruned, f)
+			continue
+		}
+		if status, _ := f.Status(dstDir); status == FileStatusModified && !force {
+			log.WithField("target", target).Warningln("stale file has been edited since generated, keeping it")
+			continue
+		}
+		actions = append(actions, DeleteFileAction(dstDir, target))
+		pruned = append(pruned, f)
+	}
+	return actions, pruned
+}
+
+// contentHash returns the SHA-256 hash of contents, prefixed with the algorithm name.
+func contentHash(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestFileStatus(t *testing.T) {
+	dstDir, err := ioutil.TempDir("", "cargo-manifest-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+	ioutil.WriteFile(filepath.Join(dstDir, "unchanged.txt"), []byte("generated"), 0644)
+	ioutil.WriteFile(filepath.Join(dstDir, "edited.txt"), []byte("edited"), 0644)
+
+	tests := []struct {
+		path   string
+		hash   string
+		status FileStatus
+	}{
+		{path: "unchanged.txt", hash: contentHash([]byte("generated")), status: FileStatusUnchanged},
+		{path: "edited.txt", hash: contentHash([]byte("generated")), status: FileStatusModified},
+		{path: "edited.txt", status: FileStatusUnchanged},
+		{path: "missing.txt", hash: contentHash([]byte("generated")), status: FileStatusDeleted},
+	}
+	for _, test := range tests {
+		f := &ManifestFile{Path: test.path, Hash: test.hash}
+		status, err := f.Status(dstDir)
+		if assert.NoError(t, err, test.path) {
+			assert.Equal(t, test.status, status, test.path)
+		}
+	}
+}
+
+func TestManifestUpdateRemoveStale(t *testing.T) {
+	assert := assert.New(t)
+	m := &Manifest{}
+	m.Update([]*ManifestFile{
+		{Path: "b.txt", Package: "demo", Hash: "b1"},
+		{Path: "a.txt", Package: "demo", Hash: "a1"},
+		{Path: "lib.txt", Package: "lib", Hash: "lib1"},
+	})
+	m.Update([]*ManifestFile{
+		{Path: "c.txt", Package: "demo", Hash: "c1"},
+		{Path: "a.txt", Package: "demo", Hash: "a2"},
+	})
+	paths := func(files []*ManifestFile) []string {
+		var paths []string
+		for _, f := range files {
+			paths = append(paths, f.Path+"@"+f.Hash)
+		}
+		return paths
+	}
+	assert.Equal([]string{"a.txt@a2", "b.txt@b1", "c.txt@c1", "lib.txt@lib1"}, paths(m.Files))
+	if f, ok := m.Find("c.txt"); assert.True(ok) {
+		assert.Equal("c1", f.Hash)
+	}
+
+	stale := m.Stale("demo", map[string]struct{}{"a.txt": {}, "lib.txt": {}})
+	assert.Equal([]string{"b.txt@b1", "c.txt@c1"}, paths(stale))
+	assert.Empty(m.Stale("lib", map[string]struct{}{"lib.txt": {}}))
+	m.Remove(stale)
+	assert.Equal([]string{"a.txt@a2", "lib.txt@lib1"}, paths(m.Files))
+	_, ok := m.Find("b.txt")
+	assert.False(ok)
+}
+
+func TestStatusReportsDrift(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(dstDir string)
+		drifted bool
+		output  string
+	}{{
+		name:   "unchanged",
+		output: "2 generated files, 0 modified, 0 deleted\n",
+	}, {
+		name: "edited",
+		edit: func(dstDir string) {
+			ioutil.WriteFile(filepath.Join(dstDir, "a.txt"), []byte("edited"), 0644)
+		},
+		drifted: true,
+		output:  "modified: a.txt (from _a.txt)\n2 generated files, 1 modified, 0 deleted\n",
+	}, {
+		name: "missing",
+		edit: func(dstDir string) {
+			os.Remove(filepath.Join(dstDir, "b.txt"))
+		},
+		drifted: true,
+		output:  "deleted: b.txt (from b.txt)\n2 generated files, 0 modified, 1 deleted\n",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			config, cleanup := newTestPassConfig(t, map[string]string{
+				"cargo.yaml": "Cargo:\n  Name: demo\n",
+				"src/_a.txt": "{{ .Cargo.Name }}",
+				"src/b.txt":  "b",
+			})
+			defer cleanup()
+			if !assert.NoError(runTestPass(config)) {
+				return
+			}
+			if test.edit != nil {
+				test.edit(config.DstDir)
+			}
+			var out bytes.Buffer
+			drifted, err := printStatus(&out, config.DstDir)
+			if assert.NoError(err) {
+				assert.Equal(test.drifted, drifted)
+				assert.Equal(test.output, out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Conflict markers written into files changed both by hand and upstream, as git writes them.
+const (
+	conflictMarkerOurs   = "<<<<<<<"
+	conflictMarkerSep    = "======="
+	conflictMarkerTheirs = ">>>>>>>"
+)
+
+// mergeHunk is a change of base lines [i1, i2) into lines, made by one side of the merge.
+type mergeHunk struct {
+	i1, i2 int
+	lines  []string
+	theirs bool
+}
+
+// Merge3 merges changes made to base in ours and in theirs, line by line. Changes of both sides
+// that overlap or touch each other are conflicts, unless they are the same, conflicts are written
+// between markers labeled with oursLabel and theirsLabel. It returns the merged contents with the
+// number of conflicts.
+func Merge3(base, ours, theirs []byte, oursLabel, theirsLabel string) ([]byte, int) {
+	baseLines := mergeLines(base)
+	hunks := append(
+		diffHunks(baseLines, mergeLines(ours), false),
+		diffHunks(baseLines, mergeLines(theirs), true)...,
+	)
+	sort.SliceStable(hunks, func(i, j int) bool {
+		return hunks[i].i1 < hunks[j].i1
+	})
+	var merged bytes.Buffer
+	conflicts := 0
+	pos := 0
+	for len(hunks) > 0 {
+		// a cluster takes the hunks that overlap or touch the base lines changed before
+		lo, hi := hunks[0].i1, hunks[0].i2
+		n := 1
+		for ; n < len(hunks) && hunks[n].i1 <= hi; n++ {
+			if hunks[n].i2 > hi {
+				hi = hunks[n].i2
+			}
+		}
+		cluster := hunks[:n]
+		hunks = hunks[n:]
+		writeLines(&merged, baseLines[pos:lo])
+		pos = hi
+
+		oursLines := applyHunks(baseLines, lo, hi, cluster, false)
+		theirsLines := applyHunks(baseLines, lo, hi, cluster, true)
+		switch {
+		case !clusterHas(cluster, true):
+			writeLines(&merged, oursLines)
+		case !clusterHas(cluster, false):
+			writeLines(&merged, theirsLines)
+		case strings.Join(oursLines, "") == strings.Join(theirsLines, ""):
+			writeLines(&merged, oursLines)
+		default:
+			conflicts++
+			writeMarker(&merged, conflictMarkerOurs, oursLabel)
+			writeLines(&merged, oursLines)
+			writeMarker(&merged, conflictMarkerSep, "")
+			writeLines(&merged, theirsLines)
+			writeMarker(&merged, conflictMarkerTheirs, theirsLabel)
+		}
+	}
+	writeLines(&merged, baseLines[pos:])
+	return merged.Bytes(), conflicts
+}
+
+// HasConflictMarkers reports whether the contents have a line starting with a conflict marker.
+func HasConflictMarkers(contents []byte) bool {
+	for _, line := range mergeLines(contents) {
+		if strings.HasPrefix(line, conflictMarkerOurs+" ") || strings.HasPrefix(line, conflictMarkerTheirs+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeLines splits the contents into lines, each line keeps its line break as it is.
+func mergeLines(contents []byte) []string {
+	if len(contents) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(contents), "\n")
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func diffHunks(base, lines []string, theirs bool) []mergeHunk {
+	var hunks []mergeHunk
+	matcher := difflib.NewMatcherWithJunk(base, lines, false, nil)
+	for _, op := range matcher.GetOpCodes() {
+		if op.Tag == 'e' {
+			continue
+		}
+		hunks = append(hunks, mergeHunk{
+			i1:     op.I1,
+			i2:     op.I2,
+			lines:  lines[op.J1:op.J2],
+			theirs: theirs,
+		})
+	}
+	return hunks
+}
+
+// applyHunks returns base lines [lo, hi) with changes of one side of the cluster applied.
+func applyHunks(base []string, lo, hi int, cluster []mergeHunk, theirs bool) []string {
+	var lines []string
+	pos := lo
+	for _, hunk := range cluster {
+		if hunk.theirs != theirs {
+			continue
+		}
+		lines = append(lines, base[pos:hunk.i1]...)
+		lines = append(lines, hunk.lines...)
+		pos = hunk.i2
+	}
+	return append(lines, base[pos:hi]...)
+}
+
+func clusterHas(cluster []mergeHunk, theirs bool) bool {
+	for _, hunk := range cluster {
+		if hunk.theirs == theirs {
+			return true
+		}
+	}
+	return false
+}
+
+func writeLines(buf *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+}
+
+// writeMarker writes a conflict marker on its own line, even if the last line has no line break.
+func writeMarker(buf *bytes.Buffer, marker, label string) {
+	if buf.Len() > 0 && buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(marker)
+	if len(label) > 0 {
+		buf.WriteString(" " + label)
+	}
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge3(t *testing.T) {
+	assert := assert.New(t)
+	base := []byte("a\nb\nc\nd\ne\n")
+
+	// changes of both sides apart are merged
+	merged, conflicts := Merge3(base, []byte("A\nb\nc\nd\ne\n"), []byte("a\nb\nc\nd\nE\nf\n"), "DST", "demo 2.0.0")
+	assert.Equal(0, conflicts)
+	assert.Equal("A\nb\nc\nd\nE\nf\n", string(merged))
+
+	// the same change made by both sides is not a conflict
+	merged, conflicts = Merge3(base, []byte("a\nB\nc\nd\ne\n"), []byte("a\nB\nc\nd\ne\n"), "DST", "demo 2.0.0")
+	assert.Equal(0, conflicts)
+	assert.Equal("a\nB\nc\nd\ne\n", string(merged))
+
+	// overlapping changes are marked
+	merged, conflicts = Merge3(base, []byte("a\nours\nc\nd\ne"), []byte("a\ntheirs\nc\nd\ne\n"), "DST", "demo 2.0.0")
+	assert.Equal(1, conflicts)
+	assert.Equal("a\n<<<<<<< DST\nours\n=======\ntheirs\n>>>>>>> demo 2.0.0\nc\nd\ne", string(merged))
+	assert.True(HasConflictMarkers(merged))
+
+	// a file added on both sides conflicts as a whole, unless it's the same
+	merged, conflicts = Merge3(nil, []byte("x\n"), []byte("y"), "DST", "demo 2.0.0")
+	assert.Equal(1, conflicts)
+	assert.Equal("<<<<<<< DST\nx\n=======\ny\n>>>>>>> demo 2.0.0\n", string(merged))
+	assert.False(HasConflictMarkers([]byte("a\n<<<<<<<<\n")))
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetKind tells how values given with --set, --set-string and --set-file are taken.
+type SetKind string
+
+const (
+	// SetTyped values are converted to bools, integers and null, others are strings.
+	SetTyped SetKind = "--set"
+	// SetString values are always strings.
+	SetString SetKind = "--set-string"
+	// SetFile values are paths of files, the contents of the files are set as strings.
+	SetFile SetKind = "--set-file"
+)
+
+// ContextOverride sets a value at a path of the context, once all context sources are loaded.
+// The path is a root name followed by map keys and list indexes, e.g. Values.image.tag or Friends[1].Age.
+type ContextOverride struct {
+	Path  string
+	Value interface{}
+}
+
+// ParseSetValues parses specs given with --set, --set-string or --set-file, Helm style:
+// PATH=VALUE[,PATH=VALUE...], with commas in values escaped as \, and lists given as {a,b,c}.
+// A plain name, like NAME=VALUE, sets the value of a package parameter, or a root of the context
+// if no parameter is declared with the name, see SetParams.
+func ParseSetValues(specs []string, kind SetKind) ([]*ContextOverride, error) {
+	var overrides []*ContextOverride
+	for _, spec := range specs {
+		for _, assignment := range splitUnescaped(spec, ',', true) {
+			idx := strings.Index(assignment, "=")
+			if idx <= 0 {
+				err := fmt.Errorf("incorrect %s specification: %s, use NAME=VALUE or PATH=VALUE", kind, assignment)
+				return nil, err
+			}
+			path := strings.TrimSpace(assignment[:idx])
+			if _, err := parseOverridePath(path); err != nil {
+				return nil, err
+			}
+			value, err := setValue(kind, assignment[idx+1:])
+			if err != nil {
+				return nil, err
+			}
+			overrides = append(overrides, &ContextOverride{
+				Path:  path,
+				Value: value,
+			})
+		}
+	}
+	return overrides, nil
+}
+
+// setValue returns the value of the kind.
+func setValue(kind SetKind, s string) (interface{}, error) {
+	if kind == SetFile {
+		data, err := ioutil.ReadFile(s)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	} else if kind == SetString {
+		return unescapeSetValue(s), nil
+	}
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		items := make([]interface{}, 0)
+		if inner := s[1 : len(s)-1]; len(inner) > 0 {
+			for _, item := range splitUnescaped(inner, ',', false) {
+				items = append(items, typedSetValue(unescapeSetValue(item)))
+			}
+		}
+		return items, nil
+	}
+	return typedSetValue(unescapeSetValue(s)), nil
+}
+
+// typedSetValue converts booleans, null and integers without leading zeros, like Helm does.
+// Other values, floats included, are strings.
+func typedSetValue(s string) interface{} {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if len(s) > 1 && (strings.HasPrefix(s, "0") || strings.HasPrefix(s, "-0")) {
+		return s
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	return s
+}
+
+// splitUnescaped splits s by sep, skipping separators escaped with a backslash, and inside
+// braces if braces is set. Escapes are kept, so parts can be split again.
+func splitUnescaped(s string, sep byte, braces bool) []string {
+	var parts []string
+	var depth, start int
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case braces && s[i] == '{':
+			depth++
+		case braces && s[i] == '}' && depth > 0:
+			depth--
+		case s[i] == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var setValueEscapes = strings.NewReplacer(`\,`, ",", `\.`, ".", `\\`, `\`)
+
+func unescapeSetValue(s string) string {
+	return setValueEscapes.Replace(s)
+}
+
+// pathSegment is a map key, or a list index if IsIndex is set.
+type pathSegment struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+// parseOverridePath parses a path like Values.image.tag or Friends[1].Age, dots in keys are escaped as \.
+func parseOverridePath(path string) ([]pathSegment, error) {
+	var segments []pathSegment
+	var key strings.Builder
+	flush := func() error {
+		if key.Len() == 0 {
+			return fmt.Errorf("incorrect path: %s, a key is empty", path)
+		}
+		segments = append(segments, pathSegment{Key: key.String()})
+		key.Reset()
+		return nil
+	}
+	// afterIndex is set right after ], where . or [ may follow without a key
+	afterIndex := false
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' && i+1 < len(path):
+			i++
+			key.WriteByte(path[i])
+		case c == '.' && afterIndex:
+		case c == '.':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case c == '[':
+			if !afterIndex {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("incorrect path: %s, ] is missing", path)
+			}
+			idx, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("incorrect path: %s, list index %s is not valid", path, path[i+1:i+end])
+			}
+			segments = append(segments, pathSegment{Index: idx, IsIndex: true})
+			i += end
+			if i+1 < len(path) && path[i+1] != '.' && path[i+1] != '[' {
+				return nil, fmt.Errorf("incorrect path: %s, expected . or [ after ]", path)
+			}
+			afterIndex = true
+			continue
+		default:
+			key.WriteByte(c)
+		}
+		afterIndex = false
+	}
+	if !afterIndex {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// Override sets values at paths of the context, in order. Maps and lists missing on the path are
+// created, lists are padded with nulls up to the index.
+func (c TemplateContext) Override(overrides []*ContextOverride) error {
+	for _, o := range overrides {
+		segments, err := parseOverridePath(o.Path)
+		if err != nil {
+			return err
+		}
+		if _, err := setPath(map[string]interface{}(c), segments, o.Value, o.Path); err != nil {
+			return err
+		}
+		log.WithField("source", "--set").Debugln("context key", o.Path)
+	}
+	return nil
+}
+
+// setPath sets the value at the path in the container, returning the container, or a new one
+// if it was nil or had to be converted.
+func setPath(container interface{}, segments []pathSegment, value interface{}, path string) (interface{}, error) {
+	if len(segments) == 0 {
+		return value, nil
+	}
+	seg := segments[0]
+	if seg.IsIndex {
+		var items []interface{}
+		switch v := container.(type) {
+		case nil:
+		case []interface{}:
+			items = v
+		default:
+			err := fmt.Errorf("cannot set %s: list expected at [%d], found %T", path, seg.Index, container)
+			return nil, err
+		}
+		for len(items) <= seg.Index {
+			items = append(items, nil)
+		}
+		item, err := setPath(items[seg.Index], segments[1:], value, path)
+		if err != nil {
+			return nil, err
+		}
+		items[seg.Index] = item
+		return items, nil
+	}
+	var fields map[string]interface{}
+	switch v := container.(type) {
+	case nil:
+		fields = make(map[string]interface{})
+		container = fields
+	case map[string]interface{}:
+		fields = v
+	case Cargo:
+		fields = v
+	case map[string]string:
+		// Env and OS vars are string maps, they are converted to hold values of any type
+		fields = make(map[string]interface{}, len(v)+1)
+		for k, s := range v {
+			fields[k] = s
+		}
+		container = fields
+	default:
+		err := fmt.Errorf("cannot set %s: map expected at %s, found %T", path, seg.Key, container)
+		return nil, err
+	}
+	field, err := setPath(fields[seg.Key], segments[1:], value, path)
+	if err != nil {
+		return nil, err
+	}
+	fields[seg.Key] = field
+	return container, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSetValues(t *testing.T) {
+	assert := assert.New(t)
+	overrides, err := ParseSetValues([]string{
+		"port=8080",
+		`Values.image.tag=1.25,Values.replicas=3,Values.debug=false,Values.note=a\,b`,
+		"Values.hosts={a.example.com,b.example.com},Values.zip=01234",
+		"Friends[1].Age=30",
+		"name=api,Values.name=web",
+	}, SetTyped)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]*ContextOverride{
+		{Path: "port", Value: int64(8080)},
+		{Path: "Values.image.tag", Value: "1.25"},
+		{Path: "Values.replicas", Value: int64(3)},
+		{Path: "Values.debug", Value: false},
+		{Path: "Values.note", Value: "a,b"},
+		{Path: "Values.hosts", Value: []interface{}{"a.example.com", "b.example.com"}},
+		{Path: "Values.zip", Value: "01234"},
+		{Path: "Friends[1].Age", Value: int64(30)},
+		{Path: "name", Value: "api"},
+		{Path: "Values.name", Value: "web"},
+	}, overrides)
+
+	overrides, err = ParseSetValues([]string{"Values.replicas=3"}, SetString)
+	if assert.NoError(err) {
+		assert.Equal([]*ContextOverride{{Path: "Values.replicas", Value: "3"}}, overrides)
+	}
+
+	dir, err := ioutil.TempDir("", "cargo-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "motd.txt")
+	assert.NoError(ioutil.WriteFile(path, []byte("Hello\n"), 0644))
+	overrides, err = ParseSetValues([]string{"Values.motd=" + path}, SetFile)
+	if assert.NoError(err) {
+		assert.Equal([]*ContextOverride{{Path: "Values.motd", Value: "Hello\n"}}, overrides)
+	}
+
+	for _, spec := range []string{"Values.a", "Values..a=1", "Values[x]=1", "[0]=1", "Values[0]a=1", "Values[0].=1", "a=1,b"} {
+		_, err := ParseSetValues([]string{spec}, SetTyped)
+		assert.Error(err, spec)
+	}
+}
+
+func TestTemplateContextOverride(t *testing.T) {
+	assert := assert.New(t)
+	ctx := NewTemplateContext()
+	ctx["Friends"] = []interface{}{
+		map[string]interface{}{"Name": "Ann", "Age": 20},
+	}
+	ctx["Env"] = map[string]string{"HOME": "/root"}
+	err := ctx.Override([]*ContextOverride{
+		{Path: "Cargo.Name", Value: "foo"},
+		{Path: "Friends[1].Age", Value: int64(30)},
+		{Path: "Friends[0].Age", Value: int64(21)},
+		{Path: `Values.labels.app\.kubernetes\.io/name`, Value: "web"},
+		{Path: "Env.DEBUG", Value: true},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("foo", ctx.Global()["Name"])
+	assert.Equal([]interface{}{
+		map[string]interface{}{"Name": "Ann", "Age": int64(21)},
+		map[string]interface{}{"Age": int64(30)},
+	}, ctx["Friends"])
+	assert.Equal(map[string]interface{}{
+		"labels": map[string]interface{}{"app.kubernetes.io/name": "web"},
+	}, ctx["Values"])
+	assert.Equal(map[string]interface{}{"HOME": "/root", "DEBUG": true}, ctx["Env"])
+
+	err = ctx.Override([]*ContextOverride{{Path: "Friends.Name", Value: "Bob"}})
+	assert.Error(err)
+}
+
+func TestPassConfigSetValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		specs  []string
+		params string
+		output string
+		err    string
+	}{{
+		name:   "parameter",
+		specs:  []string{"port=9090"},
+		params: "  parameters:\n    port:\n      type: int\n      default: 8080\n",
+		output: "demo 9090 map[title:Demo]",
+	}, {
+		name:   "root of the context",
+		specs:  []string{"Site=override"},
+		output: "demo <no value> override",
+	}, {
+		name:   "parameter and context in a list",
+		specs:  []string{"port=9090,Cargo.Name=other,Site=override"},
+		params: "  parameters:\n    port:\n      type: int\n",
+		output: "other 9090 override",
+	}, {
+		name:   "unknown parameter",
+		specs:  []string{"port=9090,host=localhost"},
+		params: "  parameters:\n    port:\n      type: int\n",
+		err:    "unknown parameter host, it's not declared in Cargo.parameters",
+	}, {
+		name:  "no parameters declared",
+		specs: []string{"port=9090"},
+		err:   "unknown parameter port, it's not declared in Cargo.parameters",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			config, cleanup := newTestPassConfig(t, map[string]string{
+				"cargo.yaml":   "Cargo:\n  Name: demo\n" + test.params,
+				"site.yaml":    "title: Demo\n",
+				"src/_out.txt": "{{ .Cargo.Name }} {{ .Params.port }} {{ .Site }}",
+			})
+			defer cleanup()
+			config.Sources = append(config.Sources, ContextSource{
+				Name: "Site",
+				Path: filepath.Join(filepath.Dir(config.SrcDir), "site.yaml"),
+			})
+			var err error
+			if config.Overrides, err = ParseSetValues(test.specs, SetTyped); !assert.NoError(err) {
+				return
+			}
+			err = runTestPass(config)
+			if len(test.err) > 0 {
+				if assert.Error(err) {
+					assert.Equal(test.err, err.Error())
+				}
+				return
+			} else if !assert.NoError(err) {
+				return
+			}
+			data, err := ioutil.ReadFile(filepath.Join(config.DstDir, "out.txt"))
+			if assert.NoError(err) {
+				assert.Equal(test.output, string(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PackageFile describes a package, it is at the root of the package dir.
+const PackageFile = "cargo.yaml"
+
+// Package is a set of templates with cargo.yaml that describes it.
+type Package struct {
+	// Dir is the absolute path of the package dir, File is the absolute path of its cargo.yaml.
+	Dir  string
+	File string
+	// Cargo is the global context of the package, from cargo.yaml.
+	Cargo Cargo
+	// Entries map folders of the package to folders at the destination, in order of Cargo.manifest.
+	Entries []*PackageEntry
+	// Dependencies are packages from repositories, installed before this one.
+	Dependencies []*PackageDependency
+}
+
+// PackageEntry is an entry of Cargo.manifest.
+type PackageEntry struct {
+	Name string
+	// From is a path relative to the package dir.
+	From string
+	// To is a path relative to the destination dir, it defaults to the entry name.
+	To string
+	// Ignore excludes the entry from install, unless it's asked for explicitly.
+	Ignore bool
+}
+
+// defaultPackageEntry is used if the package has no Cargo.manifest.
+var defaultPackageEntry = PackageEntry{
+	Name: "default",
+	From: "./cargo",
+	To:   ".",
+}
+
+// LoadPackage loads the package from its dir or cargo.yaml.
+func LoadPackage(path string) (*Package, error) {
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		path = filepath.Join(path, PackageFile)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+	return parsePackage(absPath, data)
+}
+
+// parsePackage parses cargo.yaml of the package, path is its absolute path.
+func parsePackage(path string, data []byte) (*Package, error) {
+	ctx := NewTemplateContext()
+	if err := ctx.LoadGlobalFromYAML(data); err != nil {
+		err = fmt.Errorf("error loading %s: %v", path, err)
+		return nil, err
+	}
+	// the manifest is read again preserving order of entries, which matters on overlapping destinations
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		err = fmt.Errorf("error loading %s: %v", path, err)
+		return nil, err
+	}
+	entries, err := parsePackageEntries(doc)
+	if err != nil {
+		err = fmt.Errorf("error loading %s: %v", path, err)
+		return nil, err
+	}
+	deps, err := parsePackageDependencies(doc)
+	if err != nil {
+		err = fmt.Errorf("error loading %s: %v", path, err)
+		return nil, err
+	}
+	pkg := &Package{
+		Dir:          filepath.Dir(path),
+		File:         path,
+		Cargo:        ctx.Global(),
+		Entries:      entries,
+		Dependencies: deps,
+	}
+	return pkg, nil
+}
+
+func parsePackageEntries(doc yaml.MapSlice) ([]*PackageEntry, error) {
+	global, _ := lookupMapSlice(doc, "Cargo").(yaml.MapSlice)
+	v := lookupMapSlice(global, "manifest")
+	if v == nil {
+		entry := defaultPackageEntry
+		return []*PackageEntry{&entry}, nil
+	}
+	manifest, ok := v.(yaml.MapSlice)
+	if !ok {
+		err := errors.New("Cargo.manifest must map names to folders")
+		return nil, err
+	}
+	entries := make([]*PackageEntry, 0, len(manifest))
+	for _, item := range manifest {
+		name := fmt.Sprintf("%v", item.Key)
+		fields, ok := item.Value.(yaml.MapSlice)
+		if !ok {
+			err := fmt.Errorf("Cargo.manifest.%s must specify from and to folders", name)
+			return nil, err
+		}
+		entry := &PackageEntry{
+			Name: name,
+			To:   name,
+		}
+		if from, ok := lookupMapSlice(fields, "from").(string); ok {
+			entry.From = strings.TrimSpace(from)
+		}
+		if to, ok := lookupMapSlice(fields, "to").(string); ok {
+			entry.To = strings.TrimSpace(to)
+		}
+		if ignore, ok := lookupMapSlice(fields, "ignore").(bool); ok {
+			entry.Ignore = ignore
+		}
+		if len(entry.From) == 0 {
+			err := fmt.Errorf("Cargo.manifest.%s must specify from folder", name)
+			return nil, err
+		} else if err := checkRelativePath(entry.From); err != nil {
+			err = fmt.Errorf("Cargo.manifest.%s.from: %v", name, err)
+			return nil, err
+		} else if err := checkRelativePath(entry.To); err != nil {
+			err = fmt.Errorf("Cargo.manifest.%s.to: %v", name, err)
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Select returns entries to be installed. If names are given, only entries with
+// these names are selected, including the ignored ones, otherwise all entries that
+// are not ignored are selected.
+func (p *Package) Select(names []string) ([]*PackageEntry, error) {
+	if len(names) == 0 {
+		var entries []*PackageEntry
+		for _, entry := range p.Entries {
+			if !entry.Ignore {
+				entries = append(entries, entry)
+			}
+		}
+		return entries, nil
+	}
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		selected[name] = false
+	}
+	var entries []*PackageEntry
+	for _, entry := range p.Entries {
+		if _, ok := selected[entry.Name]; ok {
+			selected[entry.Name] = true
+			entries = append(entries, entry)
+		}
+	}
+	for _, name := range names {
+		if !selected[name] {
+			err := fmt.Errorf("package has no manifest entry %s", name)
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Name returns the package name from Cargo.name.
+func (p *Package) Name() string {
+	if name, ok := p.Cargo.Lookup("Name"); ok {
+		return fmt.Sprintf("%v", name)
+	}
+	return ""
+}
+
+// Version returns the package version from Cargo.version.
+func (p *Package) Version() string {
+	if version, ok := p.Cargo.Lookup("Version"); ok {
+		return fmt.Sprintf("%v", version)
+	}
+	return ""
+}
+
+// Description returns the package description from Cargo.description.
+func (p *Package) Description() string {
+	if description, ok := p.Cargo.Lookup("Description"); ok {
+		return strings.TrimSpace(fmt.Sprintf("%v", description))
+	}
+	return ""
+}
+
+// Author returns the package author from Cargo.author, that is either a string,
+// or has name and email fields, formatted as "name <email>".
+func (p *Package) Author() string {
+	v, ok := p.Cargo.Lookup("Author")
+	if !ok || v == nil {
+		return ""
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Sprintf("%v", v)
+	}
+	var parts []string
+	if name, ok := Cargo(fields).Lookup("Name"); ok {
+		parts = append(parts, fmt.Sprintf("%v", name))
+	}
+	if email, ok := Cargo(fields).Lookup("Email"); ok {
+		parts = append(parts, fmt.Sprintf("<%v>", email))
+	}
+	return strings.Join(parts, " ")
+}
+
+// NewPass renders the dependencies resolved first, in order, then the entries of the package,
+// one renderer per entry. The later entries take precedence on overlapping targets, so the package
+// overrides its dependencies. SrcDir and the global context of the config are ignored.
+func (p *Package) NewPass(config *PassConfig, deps []*Package, entries []*PackageEntry,
+	prompt func(target string) (bool, error)) (*Pass, error) {
+
+	var renderers []*Renderer
+	var errs ErrorList
+	for _, dep := range deps {
+		depEntries, _ := dep.Select(nil)
+		depRenderers, err := dep.NewRenderers(config, depEntries)
+		if err != nil {
+			errs.Add(fmt.Errorf("dependency %s %s: %v", dep.Name(), dep.Version(), err))
+			continue
+		}
+		renderers = append(renderers, depRenderers...)
+	}
+	own, err := p.NewRenderers(config, entries)
+	if err != nil {
+		errs.Add(err)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	} else if len(own) == 0 {
+		err := errors.New("no manifest entries to install")
+		return nil, err
+	}
+	renderers = append(renderers, own...)
+	rules, err := NewConflictRules(config.OnConflict, own[0].Context.Global())
+	if err != nil {
+		return nil, err
+	}
+	rules.Prompt = prompt
+	rules.Force = config.Force
+	return NewPass(renderers, rules, config.Prune)
+}
+
+// NewRenderers returns a renderer per entry, with cargo.yaml of the package
+// as the global context, followed by the context sources of the config.
+func (p *Package) NewRenderers(config *PassConfig, entries []*PackageEntry) ([]*Renderer, error) {
+	var renderers []*Renderer
+	var errs ErrorList
+	for _, entry := range entries {
+		entryConfig := *config
+		entryConfig.SrcDir = filepath.Join(p.Dir, filepath.FromSlash(entry.From))
+		entryConfig.Sources = append([]ContextSource{{Path: p.File}}, config.Sources...)
+		if info, err := os.Stat(entryConfig.SrcDir); err != nil || !info.IsDir() {
+			errs.Add(fmt.Errorf("Cargo.manifest.%s: folder %s is not found", entry.Name, entry.From))
+			continue
+		}
+		renderer, err := entryConfig.NewRenderer()
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+		renderer.Prefix = filepath.FromSlash(entry.To)
+		renderers = append(renderers, renderer)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return renderers, nil
+}
+
+// lookupMapSlice returns the value of a key, ignoring its case.
+func lookupMapSlice(ms yaml.MapSlice, key string) interface{} {
+	for _, item := range ms {
+		if k, ok := item.Key.(string); ok && strings.EqualFold(k, key) {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// checkRelativePath refuses paths that are absolute or lead outside of their base dir.
+func checkRelativePath(path string) error {
+	if filepath.IsAbs(path) {
+		return fmt.Errorf("path must be relative: %s", path)
+	}
+	cleaned := filepath.Clean(filepath.FromSlash(path))
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("path must not lead outside: %s", path)
+	}
+	return nil
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig"
+	"github.com/ghodss/yaml"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// ParamType is the type of parameter values.
+type ParamType string
+
+const (
+	ParamString ParamType = "string"
+	ParamInt    ParamType = "int"
+	ParamNumber ParamType = "number"
+	ParamBool   ParamType = "bool"
+	// ParamList values are lists of strings, given as {a,b} or comma-separated values on command line.
+	ParamList ParamType = "list"
+)
+
+// Parameter is a value the package asks for, declared in Cargo.parameters. Values of
+// parameters are available in templates under the Params root, e.g. {{ .Params.port }}.
+//
+//	parameters:
+//	    port:
+//	        type: int
+//	        default: 8080
+//	        description: Port the service listens on
+//	    database:
+//	        enum: [postgres, mysql]
+//	    schema:
+//	        pattern: "^[a-z_]+$"
+//	        when: eq .Params.database "postgres"
+type Parameter struct {
+	Name        string
+	Type        ParamType
+	Default     interface{}
+	Description string
+	// Enum lists the allowed values, any value is allowed if it's empty.
+	Enum []interface{}
+	// Pattern must match the whole value, or every item of list values.
+	Pattern *regexp.Regexp
+	// When is a template condition, the parameter is skipped if it's false.
+	When string
+	when *template.Template
+}
+
+// ParamPrompt asks for the value of the parameter, invalid is the error
+// in the previous answer, if any.
+type ParamPrompt func(p *Parameter, invalid error) (string, error)
+
+// ParseParameters reads the parameters field of global Cargo context, in order of names
+// given, the parameters that are not ordered go after them, by name.
+func ParseParameters(global Cargo, order []string) ([]*Parameter, error) {
+	v, ok := global.Lookup("parameters")
+	if !ok || v == nil {
+		return nil, nil
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		err := errors.New("Cargo.parameters must map parameter names to their specs")
+		return nil, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	rank := make(map[string]int, len(order))
+	for i, name := range order {
+		rank[name] = i + 1
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ri, rj := rank[names[i]], rank[names[j]]
+		if ri != rj {
+			return rj == 0 || (ri != 0 && ri < rj)
+		}
+		return names[i] < names[j]
+	})
+	var errs ErrorList
+	params := make([]*Parameter, 0, len(names))
+	for _, name := range names {
+		p, err := parseParameter(name, fields[name])
+		if err != nil {
+			errs.Add(fmt.Errorf("Cargo.parameters.%s: %v", name, err))
+			continue
+		}
+		params = append(params, p)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func parseParameter(name string, v interface{}) (*Parameter, error) {
+	p := &Parameter{
+		Name: name,
+		Type: ParamString,
+	}
+	spec, ok := v.(map[string]interface{})
+	if v == nil {
+		return p, nil
+	} else if !ok {
+		// a shorthand for a parameter with the default value
+		p.Default = v
+		return p, nil
+	}
+	fields := Cargo(spec)
+	if t, ok := fields.Lookup("type"); ok {
+		p.Type = ParamType(fmt.Sprintf("%v", t))
+		switch p.Type {
+		case ParamString, ParamInt, ParamNumber, ParamBool, ParamList:
+		default:
+			err := fmt.Errorf("type %s is not supported, use string, int, number, bool or list", p.Type)
+			return nil, err
+		}
+	}
+	if description, ok := fields.Lookup("description"); ok {
+		p.Description = fmt.Sprintf("%v", description)
+	}
+	if enum, ok := fields.Lookup("enum"); ok {
+		if p.Enum, ok = enum.([]interface{}); !ok {
+			err := errors.New("enum must list the allowed values")
+			return nil, err
+		}
+	}
+	if pattern, ok := fields.Lookup("pattern"); ok {
+		rx, err := regexp.Compile("^(?:" + fmt.Sprintf("%v", pattern) + ")$")
+		if err != nil {
+			return nil, err
+		}
+		p.Pattern = rx
+	}
+	if when, ok := fields.Lookup("when"); ok {
+		p.When = strings.TrimSpace(fmt.Sprintf("%v", when))
+		text := p.When
+		if !strings.Contains(text, "{{") {
+			text = "{{ " + text + " }}"
+		}
+		tpl, err := template.New("when").Funcs(sprig.TxtFuncMap()).Parse(text)
+		if err != nil {
+			err = fmt.Errorf("when: %v", err)
+			return nil, err
+		}
+		p.when = tpl
+	}
+	if def, ok := fields.Lookup("default"); ok && def != nil {
+		if _, err := p.Convert(def); err != nil {
+			err = fmt.Errorf("default: %v", err)
+			return nil, err
+		}
+		p.Default = def
+	}
+	return p, nil
+}
+
+// Convert converts the value to the parameter type, and validates it. Strings
+// are parsed, so values from command line and prompts can be converted too.
+func (p *Parameter) Convert(v interface{}) (interface{}, error) {
+	var value interface{}
+	switch p.Type {
+	case ParamInt:
+		switch v := v.(type) {
+		case int:
+			value = v
+		case int64:
+			value = int(v)
+		case float64:
+			if v != math.Trunc(v) {
+				return nil, fmt.Errorf("%v is not an integer", v)
+			}
+			value = int(v)
+		case string:
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("%s is not an integer", v)
+			}
+			value = n
+		default:
+			return nil, fmt.Errorf("%v is not an integer", v)
+		}
+	case ParamNumber:
+		switch v := v.(type) {
+		case int:
+			value = float64(v)
+		case int64:
+			value = float64(v)
+		case float64:
+			value = v
+		case string:
+			n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not a number", v)
+			}
+			value = n
+		default:
+			return nil, fmt.Errorf("%v is not a number", v)
+		}
+	case ParamBool:
+		switch v := v.(type) {
+		case bool:
+			value = v
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true", "yes", "y", "1":
+				value = true
+			case "false", "no", "n", "0":
+				value = false
+			default:
+				return nil, fmt.Errorf("%s is not a boolean", v)
+			}
+		default:
+			return nil, fmt.Errorf("%v is not a boolean", v)
+		}
+	case ParamList:
+		var items []interface{}
+		switch v := v.(type) {
+		case []interface{}:
+			for _, item := range v {
+				items = append(items, fmt.Sprintf("%v", item))
+			}
+		case []string:
+			for _, item := range v {
+				items = append(items, item)
+			}
+		case string:
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); len(item) > 0 {
+					items = append(items, item)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("%v is not a list", v)
+		}
+		for _, item := range items {
+			if err := p.check(item); err != nil {
+				return nil, err
+			}
+		}
+		if items == nil {
+			items = []interface{}{}
+		}
+		return items, nil
+	default:
+		switch v := v.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("%v is not a string", v)
+		}
+		value = fmt.Sprintf("%v", v)
+	}
+	if err := p.check(value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// check validates the value against enum and pattern.
+func (p *Parameter) check(value interface{}) error {
+	text := fmt.Sprintf("%v", value)
+	if len(p.Enum) > 0 {
+		allowed := false
+		choices := make([]string, 0, len(p.Enum))
+		for _, item := range p.Enum {
+			choice := fmt.Sprintf("%v", item)
+			choices = append(choices, choice)
+			if choice == text {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%s is not one of %s", text, strings.Join(choices, ", "))
+		}
+	}
+	if p.Pattern != nil && !p.Pattern.MatchString(text) {
+		return fmt.Errorf("%s does not match %s", text, strings.TrimSuffix(strings.TrimPrefix(p.Pattern.String(), "^(?:"), ")$"))
+	}
+	return nil
+}
+
+// enabled evaluates the when condition against the context.
+func (p *Parameter) enabled(ctx TemplateContext) (bool, error) {
+	if p.when == nil {
+		return true, nil
+	}
+	buf := new(bytes.Buffer)
+	if err := p.when.Execute(buf, ctx); err != nil {
+		return false, fmt.Errorf("when: %v", err)
+	}
+	switch strings.TrimSpace(buf.String()) {
+	case "", "false", "0", "<no value>":
+		return false, nil
+	}
+	return true, nil
+}
+
+// ResolveParams returns the values of parameters given, prompted for, or defaulted, in this
+// order. Parameters without default are prompted for, or they are required if prompt is nil.
+// Values prompted for are added to the given ones. Conditions of parameters are evaluated
+// against the context, with values of the previous parameters in its Params root.
+func ResolveParams(params []*Parameter, given map[string]interface{},
+	prompt ParamPrompt, ctx TemplateContext) (map[string]interface{}, error) {
+
+	values := make(map[string]interface{}, len(params))
+	ctx["Params"] = values
+	var errs ErrorList
+	for _, p := range params {
+		if ok, err := p.enabled(ctx); err != nil {
+			errs.Add(fmt.Errorf("parameter %s: %v", p.Name, err))
+			continue
+		} else if !ok {
+			continue
+		}
+		if v, ok := given[p.Name]; ok {
+			value, err := p.Convert(v)
+			if err != nil {
+				errs.Add(fmt.Errorf("parameter %s: %v", p.Name, err))
+				continue
+			}
+			values[p.Name] = value
+		} else if p.Default == nil && prompt != nil {
+			value, err := p.ask(prompt)
+			if err != nil {
+				return nil, err
+			}
+			values[p.Name] = value
+			given[p.Name] = value
+		} else if p.Default != nil {
+			values[p.Name], _ = p.Convert(p.Default)
+		} else {
+			errs.Add(fmt.Errorf("parameter %s is required, set it with --set %s=VALUE", p.Name, p.Name))
+		}
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// SetParams takes values of overrides with plain names of declared parameters into values, returning
+// the other overrides. Plain names that are neither parameters nor roots of the context are reported
+// as unknown parameters, so values given with --set are never dropped silently.
+func SetParams(overrides []*ContextOverride, params []*Parameter,
+	values map[string]interface{}, ctx TemplateContext) ([]*ContextOverride, error) {
+
+	declared := make(map[string]struct{}, len(params))
+	for _, p := range params {
+		declared[p.Name] = struct{}{}
+	}
+	var rest []*ContextOverride
+	var errs ErrorList
+	for _, o := range overrides {
+		if segments, err := parseOverridePath(o.Path); err != nil || len(segments) > 1 || segments[0].IsIndex {
+			rest = append(rest, o)
+		} else if _, ok := declared[segments[0].Key]; ok {
+			values[segments[0].Key] = o.Value
+		} else if _, ok := ctx[segments[0].Key]; ok {
+			rest = append(rest, o)
+		} else {
+			errs.Add(fmt.Errorf("unknown parameter %s, it's not declared in Cargo.parameters", o.Path))
+		}
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return rest, nil
+}
+
+func (p *Parameter) ask(prompt ParamPrompt) (interface{}, error) {
+	var invalid error
+	for {
+		answer, err := prompt(p, invalid)
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.Convert(answer)
+		if err == nil {
+			return value, nil
+		}
+		invalid = err
+	}
+}
+
+// NewParamPrompt returns a prompt that asks for values of parameters on the terminal,
+// it's nil if in is not a terminal.
+func NewParamPrompt(in io.Reader, out io.Writer) ParamPrompt {
+	if f, ok := in.(*os.File); ok && !isTerminal(f) {
+		return nil
+	}
+	r := bufio.NewReader(in)
+	return func(p *Parameter, invalid error) (string, error) {
+		if invalid != nil {
+			fmt.Fprintln(out, "invalid value:", invalid)
+		} else if len(p.Description) > 0 {
+			fmt.Fprintln(out, p.Description)
+		}
+		fmt.Fprint(out, p.Name)
+		if len(p.Enum) > 0 {
+			choices := make([]string, 0, len(p.Enum))
+			for _, item := range p.Enum {
+				choices = append(choices, fmt.Sprintf("%v", item))
+			}
+			fmt.Fprintf(out, " [%s]", strings.Join(choices, ", "))
+		} else if p.Type != ParamString {
+			fmt.Fprintf(out, " (%s)", p.Type)
+		}
+		fmt.Fprint(out, ": ")
+		answer, err := r.ReadString('\n')
+		if err == io.EOF && len(answer) == 0 {
+			fmt.Fprintln(out)
+			return "", fmt.Errorf("parameter %s is required, no value entered", p.Name)
+		} else if err != nil && len(answer) == 0 {
+			return "", err
+		}
+		return strings.TrimSpace(answer), nil
+	}
+}
+
+// isTerminal reports whether the file is a terminal, rather than a pipe, a file or the null device.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(info, null) {
+		return false
+	}
+	return true
+}
+
+// ReadAnswers reads values of parameters from a YAML or JSON file. Keys prefixed with "_" are
+// not parameters, they record the package installed in answers.yaml, and are skipped.
+func ReadAnswers(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	answers := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &answers); err != nil {
+		err = fmt.Errorf("error loading %s: %v", path, err)
+		return nil, err
+	}
+	for name := range answers {
+		if strings.HasPrefix(name, "_") {
+			delete(answers, name)
+		}
+	}
+	return answers, nil
+}
+
+// parameterOrder returns names of parameters in order they are declared in global context
+// sources, since the order is lost in the context.
+func parameterOrder(sources []ContextSource) []string {
+	var order []string
+	seen := make(map[string]struct{})
+	for _, source := range sources {
+		if len(source.Name) > 0 {
+			continue
+		}
+		data, err := readContextSource(source.Path)
+		if err != nil {
+			continue
+		}
+		var doc yamlv2.MapSlice
+		if err := yamlv2.Unmarshal(data, &doc); err != nil {
+			continue
+		}
+		global, _ := lookupMapSlice(doc, "Cargo").(yamlv2.MapSlice)
+		params, _ := lookupMapSlice(global, "parameters").(yamlv2.MapSlice)
+		for _, item := range params {
+			name := fmt.Sprintf("%v", item.Key)
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				order = append(order, name)
+			}
+		}
+	}
+	return order
+}
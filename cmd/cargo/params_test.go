@@ -0,0 +1,210 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseTestParameters(spec string) ([]*Parameter, error) {
+	var global Cargo
+	if err := yaml.Unmarshal([]byte(spec), &global); err != nil {
+		return nil, err
+	}
+	return ParseParameters(global, nil)
+}
+
+func TestParseParameters(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		err  string
+	}{
+		{"shorthand", "parameters:\n  port: 8080\n", ""},
+		{"unknown type", "parameters:\n  port:\n    type: integer\n",
+			"Cargo.parameters.port: type integer is not supported, use string, int, number, bool or list"},
+		{"enum not listed", "parameters:\n  db:\n    enum: postgres\n",
+			"Cargo.parameters.db: enum must list the allowed values"},
+		{"bad pattern", "parameters:\n  schema:\n    pattern: \"[a-z\"\n",
+			"Cargo.parameters.schema: error parsing regexp: missing closing ]: `[a-z)$`"},
+		{"when", "parameters:\n  schema:\n    when: eq .Params.db \"postgres\"\n    default: public\n  db: postgres\n", ""},
+		{"unparsable when", "parameters:\n  schema:\n    when: \"{{ eq \"\n",
+			"Cargo.parameters.schema: when: template: when:1: unclosed action"},
+		{"default of wrong type", "parameters:\n  port:\n    type: int\n    default: http\n",
+			"Cargo.parameters.port: default: http is not an integer"},
+		{"default not in enum", "parameters:\n  db:\n    enum: [postgres, mysql]\n    default: sqlite\n",
+			"Cargo.parameters.db: default: sqlite is not one of postgres, mysql"},
+		{"all errors", "parameters:\n  a:\n    type: float\n  b:\n    enum: x\n",
+			"Cargo.parameters.a: type float is not supported, use string, int, number, bool or list\n\n" +
+				"Cargo.parameters.b: enum must list the allowed values"},
+	}
+	for _, test := range tests {
+		_, err := parseTestParameters(test.spec)
+		if len(test.err) == 0 {
+			assert.NoError(t, err, test.name)
+		} else if assert.Error(t, err, test.name) {
+			assert.Equal(t, test.err, err.Error(), test.name)
+		}
+	}
+}
+
+func TestResolveParams(t *testing.T) {
+	spec := `parameters:
+  name:
+    pattern: "[a-z][a-z0-9-]*"
+  port:
+    type: int
+    default: 8080
+  ratio:
+    type: number
+    default: 0.5
+  debug:
+    type: bool
+    default: false
+  db:
+    enum: [postgres, mysql]
+  schema:
+    default: public
+    when: eq .Params.db "postgres"
+  regions:
+    type: list
+    enum: [eu, us]
+    default: [eu]
+`
+	tests := []struct {
+		name   string
+		given  map[string]interface{}
+		values map[string]interface{}
+		err    string
+	}{{
+		name:  "defaults",
+		given: map[string]interface{}{"name": "api", "db": "mysql"},
+		values: map[string]interface{}{
+			"name": "api", "port": 8080, "ratio": 0.5, "debug": false, "db": "mysql",
+			"regions": []interface{}{"eu"},
+		},
+	}, {
+		name: "given as strings",
+		given: map[string]interface{}{
+			"name": "api", "port": "9090", "ratio": "1.5", "debug": "yes", "db": "postgres", "regions": "eu, us",
+		},
+		values: map[string]interface{}{
+			"name": "api", "port": 9090, "ratio": 1.5, "debug": true, "db": "postgres", "schema": "public",
+			"regions": []interface{}{"eu", "us"},
+		},
+	}, {
+		name:  "required",
+		given: map[string]interface{}{"db": "mysql"},
+		err:   "parameter name is required, set it with --set name=VALUE",
+	}, {
+		name:  "int",
+		given: map[string]interface{}{"name": "api", "db": "mysql", "port": "http"},
+		err:   "parameter port: http is not an integer",
+	}, {
+		name:  "fractional int",
+		given: map[string]interface{}{"name": "api", "db": "mysql", "port": 80.5},
+		err:   "parameter port: 80.5 is not an integer",
+	}, {
+		name:  "number",
+		given: map[string]interface{}{"name": "api", "db": "mysql", "ratio": "half"},
+		err:   "parameter ratio: half is not a number",
+	}, {
+		name:  "bool",
+		given: map[string]interface{}{"name": "api", "db": "mysql", "debug": "maybe"},
+		err:   "parameter debug: maybe is not a boolean",
+	}, {
+		name:  "string",
+		given: map[string]interface{}{"name": []interface{}{"api"}, "db": "mysql"},
+		err:   "parameter name: [api] is not a string",
+	}, {
+		name:  "pattern",
+		given: map[string]interface{}{"name": "API", "db": "mysql"},
+		err:   "parameter name: API does not match [a-z][a-z0-9-]*",
+	}, {
+		name:  "enum",
+		given: map[string]interface{}{"name": "api", "db": "sqlite"},
+		err:   "parameter db: sqlite is not one of postgres, mysql",
+	}, {
+		name:  "list enum",
+		given: map[string]interface{}{"name": "api", "db": "mysql", "regions": "eu,asia"},
+		err:   "parameter regions: asia is not one of eu, us",
+	}, {
+		name:  "all errors",
+		given: map[string]interface{}{"port": "http", "db": "sqlite"},
+		err: "parameter name is required, set it with --set name=VALUE\n\n" +
+			"parameter port: http is not an integer\n\n" +
+			"parameter db: sqlite is not one of postgres, mysql",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			var global Cargo
+			if !assert.NoError(yaml.Unmarshal([]byte(spec), &global)) {
+				return
+			}
+			// parameters are resolved in order they are declared
+			params, err := ParseParameters(global, []string{"name", "port", "ratio", "debug", "db", "schema", "regions"})
+			if !assert.NoError(err) {
+				return
+			}
+			values, err := ResolveParams(params, test.given, nil, NewTemplateContext())
+			if len(test.err) > 0 {
+				if assert.Error(err) {
+					assert.Equal(test.err, err.Error())
+				}
+				return
+			} else if assert.NoError(err) {
+				assert.Equal(test.values, values)
+			}
+		})
+	}
+}
+
+func TestSetParams(t *testing.T) {
+	params, err := parseTestParameters("parameters:\n  port:\n    type: int\n  name: api\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		overrides []*ContextOverride
+		values    map[string]interface{}
+		rest      []*ContextOverride
+		err       string
+	}{{
+		name:      "parameters",
+		overrides: []*ContextOverride{{Path: "port", Value: int64(9090)}, {Path: "name", Value: "web"}},
+		values:    map[string]interface{}{"port": int64(9090), "name": "web"},
+	}, {
+		name:      "context",
+		overrides: []*ContextOverride{{Path: "Values.port", Value: int64(9090)}, {Path: "Values", Value: "none"}, {Path: "Friends[0]", Value: "Ann"}},
+		values:    map[string]interface{}{},
+		rest:      []*ContextOverride{{Path: "Values.port", Value: int64(9090)}, {Path: "Values", Value: "none"}, {Path: "Friends[0]", Value: "Ann"}},
+	}, {
+		name:      "unknown",
+		overrides: []*ContextOverride{{Path: "port", Value: int64(9090)}, {Path: "host", Value: "localhost"}},
+		err:       "unknown parameter host, it's not declared in Cargo.parameters",
+	}, {
+		name:      "all unknown",
+		overrides: []*ContextOverride{{Path: "host", Value: "localhost"}, {Path: "Port", Value: int64(80)}},
+		err: "unknown parameter host, it's not declared in Cargo.parameters\n\n" +
+			"unknown parameter Port, it's not declared in Cargo.parameters",
+	}}
+	for _, test := range tests {
+		ctx := NewTemplateContext()
+		ctx["Values"] = map[string]interface{}{}
+		values := make(map[string]interface{})
+		rest, err := SetParams(test.overrides, params, values, ctx)
+		if len(test.err) > 0 {
+			if assert.Error(t, err, test.name) {
+				assert.Equal(t, test.err, err.Error(), test.name)
+			}
+			continue
+		} else if !assert.NoError(t, err, test.name) {
+			continue
+		}
+		assert.Equal(t, test.values, values, test.name)
+		assert.Equal(t, test.rest, rest, test.name)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+
+	"github.com/Masterminds/sprig"
+)
+
+// Partial is a named template shared by all templates of the package.
+type Partial struct {
+	Name string
+	Path string
+}
+
+// ParsePartials reads the partials field of global Cargo context, that maps names
+// to files. Paths are relative to baseDir, which is the dir of the package.
+//
+//	partials:
+//	    page:
+//	        path: ./src/templates/page.html
+func ParsePartials(global Cargo, baseDir string) ([]Partial, error) {
+	v, ok := global.Lookup("partials")
+	if !ok || v == nil {
+		return nil, nil
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		err := errors.New("Cargo.partials must map partial names to files")
+		return nil, err
+	}
+	partials := make([]Partial, 0, len(fields))
+	for name, v := range fields {
+		var path string
+		switch v := v.(type) {
+		case string:
+			path = v
+		case map[string]interface{}:
+			p, _ := Cargo(v).Lookup("path")
+			path, _ = p.(string)
+		}
+		if len(path) == 0 {
+			err := fmt.Errorf("Cargo.partials.%s must specify the path of partial", name)
+			return nil, err
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		partials = append(partials, Partial{
+			Name: name,
+			Path: absPath,
+		})
+	}
+	sort.Slice(partials, func(i, j int) bool {
+		return partials[i].Name < partials[j].Name
+	})
+	return partials, nil
+}
+
+// LoadPartials parses partial files and adds them to all templates, so they can be used
+// via {{ template "name" . }} or {{ include "name" . }}. Partial files found among sources
+// are not rendered on their own. Templates defined in partial files are shared as well,
+// unless a template defines a template of the same name itself.
+func (l *TemplateLoader) LoadPartials(partials []Partial) error {
+	var errs ErrorList
+	var trees []*template.Template
+	paths := make(map[string]string, len(partials))
+	for _, partial := range partials {
+		l.RemoveSource(partial.Path)
+		paths[partial.Name] = partial.Path
+		data, err := ioutil.ReadFile(partial.Path)
+		if err != nil {
+			errs.Add(fmt.Errorf("partial %s: %v", partial.Name, err))
+			continue
+		}
+		tpl := template.New(partial.Name)
+		if l.opts.Strict {
+			tpl = tpl.Option("missingkey=error")
+		}
+		tpl, err = tpl.Funcs(l.funcMap(tpl, nil)).Parse(string(data))
+		if err != nil {
+			errs.Add(NewTemplateError(partial.Path, err))
+			continue
+		}
+		trees = append(trees, tpl.Templates()...)
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	l.partials = partials
+	l.partialPaths = paths
+	l.partialTrees = trees
+	// templates are parsed again, as partials must not replace templates they define themselves
+	return l.ReloadTemplates()
+}
+
+// IsPartial reports whether the file is a partial.
+func (l *TemplateLoader) IsPartial(path string) bool {
+	for _, partial := range l.partials {
+		if partial.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Partials returns all partials loaded.
+func (l *TemplateLoader) Partials() []Partial {
+	return l.partials
+}
+
+// addPartialTrees adds templates of partials to the template set, except those
+// the source defines itself, so its own definitions win.
+func (l *TemplateLoader) addPartialTrees(tpl *template.Template, own map[string]struct{}) error {
+	for _, partial := range l.partialTrees {
+		if partial.Tree == nil {
+			continue
+		} else if _, ok := own[partial.Name()]; ok {
+			continue
+		}
+		if _, err := tpl.AddParseTree(partial.Name(), partial.Tree); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// funcMap returns Sprig functions, with include that executes a named template
+// of the set tpl belongs to, and content that returns contents wrapped by layout.
+func (l *TemplateLoader) funcMap(tpl *template.Template, content *string) template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	funcs["content"] = func() string {
+		if content == nil {
+			return ""
+		}
+		return *content
+	}
+	funcs["include"] = func(name string, data interface{}) (string, error) {
+		buf := new(bytes.Buffer)
+		if err := tpl.ExecuteTemplate(buf, name, data); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+	return funcs
+}
+
+// TemplateError locates the error of text/template in the source, or in the partial
+// or layout the error has occurred in.
+func (l *TemplateLoader) TemplateError(source string, err error) *TemplateError {
+	if m := templateErrRx.FindStringSubmatch(err.Error()); m != nil {
+		if path, ok := l.partialPaths[m[1]]; ok {
+			source = path
+		} else if _, ok := l.layouts[m[1]]; ok {
+			// layouts are named by their paths
+			source = m[1]
+		}
+	}
+	return NewTemplateError(source, err)
+}
+
+// packageDir returns the dir of the global context source, partials
+// and other files referenced by the package are relative to it.
+func packageDir(sources []ContextSource) string {
+	dir := "."
+	for _, source := range sources {
+		if len(source.Name) > 0 {
+			continue
+		} else if _, err := os.Stat(source.Path); err == nil {
+			dir = filepath.Dir(source.Path)
+		}
+	}
+	return dir
+}
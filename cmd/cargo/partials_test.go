@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartialsOwnDefinitionsWin(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := newTestPassConfig(t, map[string]string{
+		"cargo.yaml": `Cargo:
+  Name: demo
+  partials:
+    footer: ./partials/footer.txt
+    macros: ./partials/macros.txt
+`,
+		"partials/footer.txt": "partial footer",
+		"partials/macros.txt": `{{ define "title" }}partial title{{ end }}`,
+		"src/_own.txt":        `{{ define "footer" }}own footer{{ end }}{{ define "title" }}own title{{ end }}{{ template "title" }}, {{ template "footer" }}`,
+		"src/_shared.txt":     `{{ template "title" }}, {{ include "footer" . }}`,
+	})
+	defer cleanup()
+	if !assert.NoError(runTestPass(config)) {
+		return
+	}
+	for name, expected := range map[string]string{
+		"own.txt":    "own title, own footer",
+		"shared.txt": "partial title, partial footer",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(config.DstDir, name))
+		if assert.NoError(err, name) {
+			assert.Equal(expected, string(data), name)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Pass is a single rendering pass of sources into the destination dir, planned as
+// a queue of actions that can be described, diffed against the destination, or executed.
+// A pass may have multiple renderers with the same destination dir, outputs of the later
+// renderers take precedence over the earlier ones with the same targets.
+type Pass struct {
+	Renderers []*Renderer
+	Manifest  *Manifest
+	Rules     *ConflictRules
+	Prune     bool
+
+	Steps []*PassStep
+	// Stale contains actions that prune stale files, if Prune is set.
+	Stale Queue
+	// Queue contains all actions of the pass, in order of execution.
+	Queue Queue
+}
+
+// PassConfig has everything a pass needs to render sources into the destination dir.
+type PassConfig struct {
+	SrcDir  string
+	DstDir  string
+	Sources []ContextSource
+	// Merge has rules of merging arrays of context sources loaded into the same root field.
+	Merge      MergeRules `json:",omitempty"`
+	Loader     TemplateLoaderOptions
+	OnConflict string
+	Force      bool
+	Prune      bool
+	// Params are values of package parameters given, the values prompted for are added to them.
+	Params map[string]interface{} `json:",omitempty"`
+	// Overrides set values in the context, once context sources are loaded and parameters resolved,
+	// those with plain names of parameters set values of the parameters.
+	Overrides []*ContextOverride `json:",omitempty"`
+	// ParamPrompt asks for values of parameters without defaults, they are required if it's nil.
+	ParamPrompt ParamPrompt `json:"-"`
+}
+
+// Abs returns a copy of the config with absolute paths of dirs and context sources.
+func (c *PassConfig) Abs() (*PassConfig, error) {
+	abs := *c
+	var err error
+	if abs.SrcDir, err = filepath.Abs(c.SrcDir); err != nil {
+		return nil, err
+	}
+	if abs.DstDir, err = filepath.Abs(c.DstDir); err != nil {
+		return nil, err
+	}
+	abs.Sources = make([]ContextSource, 0, len(c.Sources))
+	for _, source := range c.Sources {
+		if source.Path == StdinPath {
+			abs.Sources = append(abs.Sources, source)
+			continue
+		} else if source.Path, err = filepath.Abs(source.Path); err != nil {
+			return nil, err
+		}
+		abs.Sources = append(abs.Sources, source)
+	}
+	return &abs, nil
+}
+
+// NewRenderer loads templates from the source dir and the context from context sources,
+// with partials declared in the context.
+func (c *PassConfig) NewRenderer() (*Renderer, error) {
+	loaderOpts := c.Loader
+	loader, err := NewTemplateLoader([]string{c.SrcDir}, &loaderOpts)
+	if err != nil {
+		return nil, err
+	}
+	rootContext, err := c.LoadContext()
+	if err != nil {
+		return nil, err
+	}
+	partials, err := ParsePartials(rootContext.Global(), packageDir(c.Sources))
+	if err != nil {
+		return nil, err
+	} else if err := loader.LoadPartials(partials); err != nil {
+		return nil, err
+	}
+	return NewRenderer(loader, rootContext, c.SrcDir, c.DstDir)
+}
+
+// LoadContext builds the root context from context sources, with values of parameters
+// declared in the global context under the Params root, and overrides set. Context roots
+// are validated against the schemas declared in the global context.
+func (c *PassConfig) LoadContext() (TemplateContext, error) {
+	rootContext, err := LoadContext(c.Sources, c.Merge, c.SrcDir)
+	if err != nil {
+		return nil, err
+	}
+	params, err := ParseParameters(rootContext.Global(), parameterOrder(c.Sources))
+	if err != nil {
+		return nil, err
+	}
+	if c.Params == nil {
+		c.Params = make(map[string]interface{})
+	}
+	overrides, err := SetParams(c.Overrides, params, c.Params, rootContext)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) == 0 {
+		// values given are passed as they are, if the package declares no parameters
+		if len(c.Params) > 0 {
+			values := make(map[string]interface{}, len(c.Params))
+			for k, v := range c.Params {
+				values[k] = v
+			}
+			rootContext["Params"] = values
+		}
+	} else if _, err := ResolveParams(params, c.Params, c.ParamPrompt, rootContext); err != nil {
+		return nil, err
+	}
+	if err := rootContext.Override(overrides); err != nil {
+		return nil, err
+	}
+	schemas, err := ParseSchemas(rootContext.Global(), packageDir(c.Sources))
+	if err != nil {
+		return nil, err
+	} else if err := rootContext.Validate(schemas); err != nil {
+		return nil, err
+	}
+	return rootContext, nil
+}
+
+// NewPass renders sources and plans the pass, prompt is used
+// to resolve existing targets with the prompt policy.
+func (c *PassConfig) NewPass(prompt func(target string) (bool, error)) (*Pass, error) {
+	renderer, err := c.NewRenderer()
+	if err != nil {
+		return nil, err
+	}
+	rules, err := NewConflictRules(c.OnConflict, renderer.Context.Global())
+	if err != nil {
+		return nil, err
+	}
+	rules.Prompt = prompt
+	rules.Force = c.Force
+	return NewPass([]*Renderer{renderer}, rules, c.Prune)
+}
+
+// PassStep contains outputs of a rendering mode, with actions that publish them.
+type PassStep struct {
+	Mode    TemplateMode
+	Title   string
+	Outputs []*Output
+	Actions Queue
+}
+
+// NewPass renders all sources and plans actions to publish them into the destination dir,
+// existing targets are handled according to rules. The generated files manifest is updated
+// as the last action.
+func NewPass(renderers []*Renderer, rules *ConflictRules, prune bool) (*Pass, error) {
+	if len(renderers) == 0 {
+		err := errors.New("nothing to render")
+		return nil, err
+	}
+	manifest, err := ReadManifest(renderers[0].dstDir)
+	if err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		rules = &ConflictRules{
+			Default: ConflictOverwrite,
+		}
+	}
+	rules.Manifest = manifest
+	p := &Pass{
+		Renderers: renderers,
+		Manifest:  manifest,
+		Rules:     rules,
+		Prune:     prune,
+	}
+	if err := p.plan(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Pass) plan() error {
+	dstDir := p.Renderers[0].dstDir
+	p.Queue = NewQueue(
+		NewDirAction(dstDir, dstDir),
+	)
+	// all steps are rendered before planning actions, so errors of all templates are reported at once
+	var errs ErrorList
+	owners := make(map[*Output]*Renderer)
+	for _, step := range renderSteps {
+		var outputs []*Output
+		for _, renderer := range p.Renderers {
+			rendered, err := renderer.Render(step.Mode)
+			errs.Add(err)
+			for _, output := range rendered {
+				owners[output] = renderer
+			}
+			outputs = append(outputs, rendered...)
+		}
+		p.Steps = append(p.Steps, &PassStep{
+			Mode:    step.Mode,
+			Title:   step.Title,
+			Outputs: outputs,
+		})
+	}
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	p.dropOverridden(owners)
+	var files []*ManifestFile
+	// targets skipped on conflicts are not recorded again, but they are still generated, so they are not stale
+	generated := make(map[string]struct{})
+	for _, step := range p.Steps {
+		for _, output := range step.Outputs {
+			if path, err := filepath.Rel(dstDir, output.Target); err == nil {
+				generated[filepath.ToSlash(path)] = struct{}{}
+			}
+		}
+		actions, err := OutputActions(dstDir, step.Outputs, p.Rules)
+		if err != nil {
+			return err
+		}
+		step.Actions = actions
+		p.Queue = append(p.Queue, actions...)
+		for _, renderer := range p.Renderers {
+			var outputs []*Output
+			var outputActions Queue
+			for i, output := range step.Outputs {
+				if owners[output] == renderer {
+					outputs = append(outputs, output)
+					outputActions = append(outputActions, actions[i])
+				}
+			}
+			stepFiles, err := renderer.ManifestFiles(outputs, outputActions)
+			if err != nil {
+				return err
+			}
+			files = append(files, stepFiles...)
+		}
+	}
+	if p.Prune {
+		// every package of the pass prunes its own stale files, dependencies included
+		var stale []*ManifestFile
+		seen := make(map[string]struct{}, len(p.Renderers))
+		for _, renderer := range p.Renderers {
+			pkg := renderer.PackageName()
+			if _, ok := seen[pkg]; ok {
+				continue
+			}
+			seen[pkg] = struct{}{}
+			stale = append(stale, p.Manifest.Stale(pkg, generated)...)
+		}
+		pruneActions, pruned := PruneActions(dstDir, stale, p.Rules.Force)
+		p.Stale = pruneActions
+		p.Queue = append(p.Queue, pruneActions...)
+		p.Manifest.Remove(pruned)
+	}
+	p.Manifest.Update(files)
+	manifestAction, err := p.Manifest.Action(dstDir)
+	if err != nil {
+		return err
+	}
+	p.Queue = append(p.Queue, manifestAction)
+	return nil
+}
+
+// dropOverridden removes outputs whose targets are also outputs of later renderers,
+// or later steps of the same renderer, so each target is written once.
+func (p *Pass) dropOverridden(owners map[*Output]*Renderer) {
+	rank := make(map[*Renderer]int, len(p.Renderers))
+	for i, renderer := range p.Renderers {
+		rank[renderer] = i
+	}
+	last := make(map[string]*Output)
+	for _, step := range p.Steps {
+		for _, output := range step.Outputs {
+			if prev, ok := last[output.Target]; ok && rank[owners[prev]] > rank[owners[output]] {
+				continue
+			}
+			last[output.Target] = output
+		}
+	}
+	for _, step := range p.Steps {
+		outputs := step.Outputs[:0]
+		for _, output := range step.Outputs {
+			if last[output.Target] == output {
+				outputs = append(outputs, output)
+			}
+		}
+		step.Outputs = outputs
+	}
+}
+
+// Outputs returns outputs of all steps.
+func (p *Pass) Outputs() []*Output {
+	var outputs []*Output
+	for _, step := range p.Steps {
+		outputs = append(outputs, step.Outputs...)
+	}
+	return outputs
+}
+
+// Description returns a tree of planned actions for each step.
+func (p *Pass) Description() string {
+	var descriptions []string
+	for _, step := range p.Steps {
+		descriptions = append(descriptions, step.Actions.Description(step.Title))
+	}
+	if p.Prune {
+		descriptions = append(descriptions, p.Stale.Description("Stale Files"))
+	}
+	return strings.Join(descriptions, "\n")
+}
+
+// Exec executes all planned actions in a transaction.
+func (p *Pass) Exec() error {
+	ts := time.Now()
+	if !p.Queue.Exec(p.Renderers[0].dstDir) {
+		err := fmt.Errorf("failed in %v", time.Since(ts))
+		return err
+	}
+	log.Infoln("done in", time.Since(ts))
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestPassConfig writes files into a temporary dir, returning the config of a pass rendering
+// its src dir into its dst dir, with cargo.yaml in the dir as the global context.
+func newTestPassConfig(t *testing.T, files map[string]string) (*PassConfig, func()) {
+	dir, err := ioutil.TempDir("", "cargo-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, contents := range files {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := &PassConfig{
+		SrcDir: filepath.Join(dir, "src"),
+		DstDir: filepath.Join(dir, "dst"),
+		Sources: []ContextSource{{
+			Path: filepath.Join(dir, "cargo.yaml"),
+		}},
+		Loader: TemplateLoaderOptions{
+			ModePrefix: "_",
+			LeftDelim:  "{{",
+			RightDelim: "}}",
+		},
+		OnConflict: string(ConflictOverwrite),
+	}
+	return config, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func runTestPass(config *PassConfig) error {
+	pass, err := config.NewPass(nil)
+	if err != nil {
+		return err
+	}
+	return pass.Exec()
+}
+
+func TestPassPruneKeepsSkippedTargets(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := newTestPassConfig(t, map[string]string{
+		"cargo.yaml": `Cargo:
+  Name: demo
+  onConflict:
+    README.md: skip
+`,
+		"src/_README.md": "# {{ .Cargo.Name }}\n",
+		"src/_old.txt":   "old\n",
+	})
+	defer cleanup()
+	config.Prune = true
+	if !assert.NoError(runTestPass(config)) {
+		return
+	}
+	readme := filepath.Join(config.DstDir, "README.md")
+	assert.FileExists(readme)
+	assert.FileExists(filepath.Join(config.DstDir, "old.txt"))
+
+	// README.md is skipped as it exists, but it's still generated, while old.txt is not anymore
+	assert.NoError(os.Remove(filepath.Join(config.SrcDir, "_old.txt")))
+	if !assert.NoError(runTestPass(config)) {
+		return
+	}
+	assert.FileExists(readme)
+	_, err := os.Stat(filepath.Join(config.DstDir, "old.txt"))
+	assert.True(os.IsNotExist(err))
+
+	// once README.md is not generated anymore, it's pruned
+	assert.NoError(os.Remove(filepath.Join(config.SrcDir, "_README.md")))
+	if !assert.NoError(runTestPass(config)) {
+		return
+	}
+	_, err = os.Stat(readme)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestPassPruneAllPackages(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := newTestPassConfig(t, map[string]string{
+		"cargo.yaml":         "Cargo:\n  Name: app\n",
+		"dep.yaml":           "Cargo:\n  Name: dep\n",
+		"src/app.txt":        "app\n",
+		"src/app-old.txt":    "app old\n",
+		"depsrc/dep.txt":     "dep\n",
+		"depsrc/dep-old.txt": "dep old\n",
+	})
+	defer cleanup()
+	depConfig := *config
+	depConfig.SrcDir = filepath.Join(filepath.Dir(config.SrcDir), "depsrc")
+	depConfig.Sources = []ContextSource{{
+		Path: filepath.Join(filepath.Dir(config.SrcDir), "dep.yaml"),
+	}}
+	run := func() error {
+		// dependencies render before the package, as Package.NewPass does
+		var renderers []*Renderer
+		for _, c := range []*PassConfig{&depConfig, config} {
+			renderer, err := c.NewRenderer()
+			if err != nil {
+				return err
+			}
+			renderers = append(renderers, renderer)
+		}
+		pass, err := NewPass(renderers, nil, true)
+		if err != nil {
+			return err
+		}
+		return pass.Exec()
+	}
+	if !assert.NoError(run()) {
+		return
+	}
+	for _, name := range []string{"app.txt", "app-old.txt", "dep.txt", "dep-old.txt"} {
+		assert.FileExists(filepath.Join(config.DstDir, name))
+	}
+	assert.NoError(os.Remove(filepath.Join(config.SrcDir, "app-old.txt")))
+	assert.NoError(os.Remove(filepath.Join(depConfig.SrcDir, "dep-old.txt")))
+	if !assert.NoError(run()) {
+		return
+	}
+	for _, name := range []string{"app.txt", "dep.txt"} {
+		assert.FileExists(filepath.Join(config.DstDir, name))
+	}
+	for _, name := range []string{"app-old.txt", "dep-old.txt"} {
+		_, err := os.Stat(filepath.Join(config.DstDir, name))
+		assert.True(os.IsNotExist(err), name)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jawher/mow.cli"
+	"github.com/troven/cargo/version"
+)
+
+func planCmd(cmd *cli.Cmd) {
+	opts := addRunOptions(cmd)
+	onConflict := addConflictOption(cmd)
+	force := addForceOption(cmd)
+	prune := cmd.BoolOpt("prune", false, "Delete files generated by previous runs of the package, that are not generated anymore.")
+	outFile := cmd.StringOpt("f out", "", "Write the plan into a file instead of stdout.")
+
+	srcDir := cmd.StringArg("SRC", "cargo/", "Specify source files dir for your site.")
+	dstDir := cmd.StringArg("DST", "build/", "Specify destination dir for your site publication.")
+
+	cmd.Spec = "[OPTIONS] SRC [DST]"
+	cmd.Action = func() {
+		config, err := opts.PassConfig(*srcDir, *dstDir)
+		if err != nil {
+			fatalln(err)
+		}
+		config.OnConflict = *onConflict
+		config.Force = *force
+		config.Prune = *prune
+		if err := checkPlanSources(config.Sources); err != nil {
+			fatalln(err)
+		}
+		// decisions of the prompt policy are made now and recorded in the plan
+		plan, err := NewPlan(config, NewOverwritePrompt(os.Stdin, os.Stderr))
+		if err != nil {
+			fatalln(err)
+		}
+		w := io.Writer(os.Stdout)
+		if len(*outFile) > 0 {
+			f, err := os.Create(*outFile)
+			if err != nil {
+				fatalln(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := plan.Write(w); err != nil {
+			fatalln(err)
+		}
+	}
+}
+
+func applyCmd(cmd *cli.Cmd) {
+	addLogLevelOption(cmd)
+	planFile := cmd.StringOpt("plan", "", "Plan file created by cargo plan.")
+
+	cmd.Spec = "[-l | --debug]... --plan"
+	cmd.Action = func() {
+		saved, err := ReadPlan(*planFile)
+		if err != nil {
+			fatalln(err)
+		}
+		if err := saved.Apply(); err != nil {
+			fatalln(err)
+		}
+	}
+}
+
+// checkPlanSources rejects context sources read from the standard input,
+// since they can't be read again when the plan is applied.
+func checkPlanSources(sources []ContextSource) error {
+	for _, source := range sources {
+		if source.Path == StdinPath {
+			err := errors.New("context source can't be read from the standard input when planning, " +
+				"cargo apply would not read the same context: save it into a file and specify the file")
+			return err
+		}
+	}
+	return nil
+}
+
+// Plan is a machine-readable description of a pass, that can be reviewed
+// and applied later, as long as nothing it depends on has changed.
+type Plan struct {
+	GeneratorVersion string
+	// Config has absolute paths, so the plan can be applied from any working dir.
+	Config PassConfig
+	// Inputs are sources and context sources the plan has been rendered from.
+	Inputs []*PlanInput
+	// Actions are all actions of the pass, in order of execution.
+	Actions []*PlanAction
+
+	pass *Pass
+}
+
+type PlanInput struct {
+	Path string
+	Hash string
+}
+
+// PlanAction describes an action, with paths relative to the source and destination dirs.
+type PlanAction struct {
+	Type   ActionType
+	Target string
+	Source string       `json:",omitempty"`
+	Size   int64        `json:",omitempty"`
+	Hash   string       `json:",omitempty"`
+	Mode   TemplateMode `json:",omitempty"`
+	Item   *OutputItem  `json:",omitempty"`
+}
+
+// NewPlan renders a pass of the config and describes it.
+func NewPlan(config *PassConfig, prompt func(target string) (bool, error)) (*Plan, error) {
+	absConfig, err := config.Abs()
+	if err != nil {
+		return nil, err
+	}
+	pass, err := absConfig.NewPass(prompt)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{
+		GeneratorVersion: version.Version,
+		Config:           *absConfig,
+		pass:             pass,
+	}
+	if err := p.addInputs(); err != nil {
+		return nil, err
+	}
+	outputs := make(map[string]*Output)
+	for _, output := range pass.Outputs() {
+		outputs[output.Target] = output
+	}
+	for _, action := range pass.Queue {
+		info := action.Info()
+		a := &PlanAction{
+			Type:   info.Type,
+			Target: p.relPath(p.Config.DstDir, info.Target),
+			Size:   info.Size,
+			Hash:   info.Hash,
+		}
+		if output, ok := outputs[info.Target]; ok {
+			a.Source = p.relPath(p.Config.SrcDir, output.Source)
+			a.Mode = output.Mode
+			a.Item = output.Item
+		}
+		p.Actions = append(p.Actions, a)
+	}
+	return p, nil
+}
+
+func (p *Plan) addInputs() error {
+	var paths []string
+	for _, renderer := range p.pass.Renderers {
+		for _, mode := range []TemplateMode{TemplateModeVerbatim, TemplateModeSingle, TemplateModeCollection} {
+			renderer.Loader.ForEachSource(mode, func(source string) error {
+				paths = append(paths, source)
+				return nil
+			})
+		}
+		for _, partial := range renderer.Loader.Partials() {
+			paths = append(paths, partial.Path)
+		}
+	}
+	for _, source := range p.Config.Sources {
+		paths = append(paths, source.Path)
+	}
+	for _, path := range paths {
+		hash, err := fileHash(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		p.Inputs = append(p.Inputs, &PlanInput{
+			Path: path,
+			Hash: hash,
+		})
+	}
+	return nil
+}
+
+func (p *Plan) relPath(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// ReadPlan reads a plan written by Plan.Write.
+func ReadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Plan)
+	if err := json.Unmarshal(data, p); err != nil {
+		err = fmt.Errorf("error loading plan %s: %v", path, err)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Plan) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(p, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Prompt returns a function that answers overwrite prompts with decisions recorded in the plan.
+func (p *Plan) Prompt() func(target string) (bool, error) {
+	decisions := make(map[string]bool, len(p.Actions))
+	for _, a := range p.Actions {
+		target := filepath.Join(p.Config.DstDir, filepath.FromSlash(a.Target))
+		decisions[dstPath(p.Config.DstDir, target)] = a.Type != ActionSkip
+	}
+	return func(target string) (bool, error) {
+		ok, found := decisions[target]
+		if !found {
+			err := fmt.Errorf("plan has no decision for %s", target)
+			return false, err
+		}
+		return ok, nil
+	}
+}
+
+// Changes lists differences in inputs and actions of the other plan.
+func (p *Plan) Changes(other *Plan) []string {
+	var changes []string
+	inputs := make(map[string]string, len(other.Inputs))
+	for _, input := range other.Inputs {
+		inputs[input.Path] = input.Hash
+	}
+	for _, input := range p.Inputs {
+		hash, ok := inputs[input.Path]
+		if !ok {
+			changes = append(changes, "input removed: "+input.Path)
+		} else if hash != input.Hash {
+			changes = append(changes, "input changed: "+input.Path)
+		}
+		delete(inputs, input.Path)
+	}
+	for _, input := range other.Inputs {
+		if _, ok := inputs[input.Path]; ok {
+			changes = append(changes, "input added: "+input.Path)
+		}
+	}
+	if len(p.Actions) != len(other.Actions) {
+		changes = append(changes, fmt.Sprintf("%d actions planned, but %d are needed now",
+			len(p.Actions), len(other.Actions)))
+		return changes
+	}
+	for i, a := range p.Actions {
+		b := other.Actions[i]
+		if a.Type == b.Type && a.Target == b.Target && a.Hash != b.Hash {
+			changes = append(changes, fmt.Sprintf("action#%d changed: contents of %s", i+1, a.Target))
+		} else if a.Type != b.Type || a.Target != b.Target {
+			changes = append(changes, fmt.Sprintf("action#%d changed: %s %s, now %s %s",
+				i+1, a.Type, a.Target, b.Type, b.Target))
+		}
+	}
+	return changes
+}
+
+// Apply renders the plan again and executes it, if nothing the plan depends on has changed.
+func (p *Plan) Apply() error {
+	plan, err := NewPlan(&p.Config, p.Prompt())
+	if err != nil {
+		return err
+	}
+	if changes := p.Changes(plan); len(changes) > 0 {
+		err := fmt.Errorf("the plan is outdated, sources, context or DST have changed since it has been created:\n%s",
+			strings.Join(changes, "\n"))
+		return err
+	}
+	return plan.Exec()
+}
+
+// Exec executes the pass the plan describes.
+func (p *Plan) Exec() error {
+	return p.pass.Exec()
+}
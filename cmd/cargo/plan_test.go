@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanApplyRefusesChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(config *PassConfig)
+		err    string
+	}{{
+		name: "unchanged",
+	}, {
+		name: "input",
+		change: func(config *PassConfig) {
+			ioutil.WriteFile(filepath.Join(config.SrcDir, "_a.txt"), []byte("{{ .Cargo.Name }} v2"), 0644)
+		},
+		err: "input changed: [src]/_a.txt\naction#2 changed: contents of a.txt",
+	}, {
+		name: "action",
+		change: func(config *PassConfig) {
+			os.Setenv("CARGO_TEST_PLAN", "changed")
+		},
+		err: "action#3 changed: contents of env.txt",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			config, cleanup := newTestPassConfig(t, map[string]string{
+				"cargo.yaml":   "Cargo:\n  Name: demo\n",
+				"src/_a.txt":   "{{ .Cargo.Name }}",
+				"src/_env.txt": "{{ .Env.CARGO_TEST_PLAN }}",
+			})
+			defer cleanup()
+			os.Setenv("CARGO_TEST_PLAN", "planned")
+			defer os.Unsetenv("CARGO_TEST_PLAN")
+			plan, err := NewPlan(config, nil)
+			if !assert.NoError(err) {
+				return
+			}
+			path := filepath.Join(filepath.Dir(config.SrcDir), "plan.json")
+			f, err := os.Create(path)
+			if !assert.NoError(err) {
+				return
+			} else if err := plan.Write(f); !assert.NoError(err) {
+				return
+			}
+			f.Close()
+			if test.change != nil {
+				test.change(config)
+			}
+			saved, err := ReadPlan(path)
+			if !assert.NoError(err) {
+				return
+			}
+			err = saved.Apply()
+			if len(test.err) == 0 {
+				assert.NoError(err)
+				data, _ := ioutil.ReadFile(filepath.Join(config.DstDir, "env.txt"))
+				assert.Equal("planned", string(data))
+				return
+			}
+			if assert.Error(err) {
+				message := strings.Replace(err.Error(), config.SrcDir+string(filepath.Separator), "[src]/", -1)
+				assert.Contains(message, test.err)
+			}
+			_, err = os.Stat(config.DstDir)
+			assert.True(os.IsNotExist(err), "nothing must be written")
+		})
+	}
+}
+
+func TestPlanRejectsStdinSources(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(checkPlanSources([]ContextSource{{Path: "cargo.yaml"}, {Name: "Values", Path: "values.yaml"}}))
+	err := checkPlanSources([]ContextSource{{Path: "cargo.yaml"}, {Name: "Values", Path: StdinPath}})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "standard input")
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -32,29 +32,42 @@ func (q Queue) Description(title string) string {
 	return t.String()
 }
 
-func (q Queue) Exec() bool {
-	qq := make(Queue, 0, len(q))
+// Exec runs all actions in a transaction over the destination dir. All actions are staged first,
+// then committed in order. If any action fails, all committed actions are reverted,
+// so the destination dir is left as it was before.
+func (q Queue) Exec(dstDir string) bool {
+	tx, err := NewTransaction(dstDir)
+	if err != nil {
+		log.Errorf("transaction error: %v", err)
+		return false
+	}
+	defer func() {
+		if err := tx.Close(); err != nil {
+			log.Warningf("transaction cleanup failed: %v", err)
+		}
+	}()
+	for i, action := range q {
+		if err := action.Stage(tx); err != nil {
+			log.Errorf("action#%d staging error: %v", i+1, err)
+			tx.Revert()
+			return false
+		}
+	}
 	revertPrevious := func(qq Queue) {
 		for i := len(qq) - 1; i >= 0; i-- {
-			if err := qq[i].Revert(); err != nil {
+			if err := qq[i].Revert(tx); err != nil {
 				log.Errorf("revert Action#%d failed: %v", i+1, err)
 			} else {
 				log.Warningf("reverted Action#%d", i+1)
 			}
 		}
+		tx.Revert()
 	}
 	for i, action := range q {
 		log.Infof("action#%d: %s", i+1, action.Comment())
-		f, err := action.Run()
-		if err != nil {
+		if err := action.Commit(tx); err != nil {
 			log.Errorf("action#%d error: %v", i+1, err)
-			revertPrevious(qq)
-			return false
-		}
-		qq = append(qq, action)
-		if err := action.Finalize(f); err != nil {
-			log.Errorf("finalizer#%d error: %v", i+1, err)
-			revertPrevious(qq)
+			revertPrevious(q[:i])
 			return false
 		}
 	}
@@ -62,154 +75,462 @@ func (q Queue) Exec() bool {
 }
 
 type QueueAction interface {
-	Run() (*os.File, error)
 	Comment() string
-	Finalize(f *os.File) error
-	Revert() error
+	// Info describes the action for machine-readable plans.
+	Info() ActionInfo
+	// Stage prepares everything the action needs in the transaction,
+	// without touching the destination dir.
+	Stage(tx *Transaction) error
+	// Commit applies the staged action to the destination dir.
+	Commit(tx *Transaction) error
+	// Revert restores the destination dir as it was before Commit.
+	Revert(tx *Transaction) error
+}
+
+// ActionInfo describes what an action does to its target.
+type ActionInfo struct {
+	Type   ActionType
+	Target string
+	Size   int64  `json:",omitempty"`
+	Hash   string `json:",omitempty"`
+}
+
+type ActionType string
+
+const (
+	ActionCheckDir  ActionType = "check-dir"
+	ActionNewDir    ActionType = "new-dir"
+	ActionNewFile   ActionType = "new-file"
+	ActionOverwrite ActionType = "overwrite-file"
+	ActionCopy      ActionType = "copy-file"
+	ActionCopyNew   ActionType = "copy-new-file"
+	ActionSkip      ActionType = "skip-file"
+	ActionDelete    ActionType = "delete-file"
+)
+
+// Transaction keeps staged files and backups of overwritten files in a temporary
+// dir under the destination dir, so files can be moved with atomic renames.
+type Transaction struct {
+	dstDir      string
+	stageDir    string
+	createdDirs []string
+	seq         int
+}
+
+// NewTransaction creates the destination dir if it doesn't exist, and a staging dir under it.
+func NewTransaction(dstDir string) (*Transaction, error) {
+	createdDirs, err := mkDirAll(dstDir)
+	if err != nil {
+		return nil, err
+	}
+	stageDir, err := ioutil.TempDir(dstDir, ".cargo-stage-")
+	if err != nil {
+		removeDirs(createdDirs)
+		return nil, err
+	}
+	tx := &Transaction{
+		dstDir:      dstDir,
+		stageDir:    stageDir,
+		createdDirs: createdDirs,
+	}
+	return tx, nil
+}
+
+// TempPath returns a new unique path in the staging dir.
+func (tx *Transaction) TempPath(name string) string {
+	tx.seq++
+	return filepath.Join(tx.stageDir, fmt.Sprintf("%d-%s", tx.seq, filepath.Base(name)))
+}
+
+// Revert removes the destination dir, if it has been created by the transaction.
+func (tx *Transaction) Revert() {
+	tx.Close()
+	removeDirs(tx.createdDirs)
+}
+
+// Close removes the staging dir with all backups.
+func (tx *Transaction) Close() error {
+	return os.RemoveAll(tx.stageDir)
 }
 
 func CheckDirAction(dstDir, path string) QueueAction {
 	return &queueAction{
-		action: func() (*os.File, error) {
+		info: ActionInfo{
+			Type:   ActionCheckDir,
+			Target: path,
+		},
+		commit: func(tx *Transaction) error {
 			info, err := os.Stat(path)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			if !info.IsDir() {
-				return nil, errors.New(path + " is not a dir")
+				return errors.New(path + " is not a dir")
 			}
-			return nil, nil
+			return nil
 		},
 		comment: fmt.Sprintf("dir %s must exist", dstPath(dstDir, path)),
 	}
 }
 
 func NewDirAction(dstDir, path string) QueueAction {
+	var createdDirs []string
 	return &queueAction{
-		action: func() (*os.File, error) {
-			err := os.MkdirAll(path, 0755)
-			return nil, err
+		info: ActionInfo{
+			Type:   ActionNewDir,
+			Target: path,
+		},
+		commit: func(tx *Transaction) (err error) {
+			createdDirs, err = mkDirAll(path)
+			return err
 		},
 		comment: fmt.Sprintf("new dir %s if not exists", dstPath(dstDir, path)),
-		revert: func() error {
-			return os.Remove(path)
+		revert: func(tx *Transaction) error {
+			return removeDirs(createdDirs)
 		},
 	}
 }
 
-func mkDirFor(path string) error {
-	targetDir := filepath.Dir(path)
-	if info, err := os.Stat(targetDir); os.IsNotExist(err) {
-		if err = os.MkdirAll(targetDir, 0755); err != nil {
-			return err
+// mkDirAll creates a dir along with any missing parents,
+// it returns created dirs, so they could be removed on revert.
+func mkDirAll(path string) ([]string, error) {
+	var missing []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				err := fmt.Errorf("target directory is not a directory: %s", dir)
+				return nil, err
+			}
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		missing = append(missing, dir)
+		if parent := filepath.Dir(dir); parent == dir {
+			break
 		}
-	} else if !info.IsDir() {
-		err := fmt.Errorf("target directory is not a directory: %s", targetDir)
-		return err
 	}
-	return nil
+	var created []string
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0755); err != nil && !os.IsExist(err) {
+			removeDirs(created)
+			return nil, err
+		}
+		created = append(created, missing[i])
+	}
+	return created, nil
+}
+
+// removeDirs removes dirs created by mkDirAll, deepest first.
+// Dirs that are not empty are kept.
+func removeDirs(dirs []string) error {
+	var lastErr error
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil && !os.IsNotExist(err) {
+			lastErr = err
+		}
+	}
+	return lastErr
 }
 
 func CreateNewFileAction(dstDir, path string, contents []byte) QueueAction {
-	return &queueAction{
-		action: func() (f *os.File, err error) {
-			if err := mkDirFor(path); err != nil {
-				return nil, err
-			}
-			return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-		},
+	return &fileAction{
+		typ:       ActionNewFile,
+		target:    path,
+		contents:  contents,
+		exclusive: true,
 		comment: fmt.Sprintf("new file %s size=%s (no overwrite)",
 			dstPath(dstDir, path), contentSize(contents)),
-		finalize: func(f *os.File) error {
-			if f == nil {
-				return nil
-			}
-			defer f.Close()
-			return flushBufferToFile(contents, f)
-		},
-		revert: func() error {
-			return os.Remove(path)
-		},
 	}
 }
 
 func OverwriteFileAction(dstDir, path string, contents []byte) QueueAction {
-	return &queueAction{
-		action: func() (f *os.File, err error) {
-			if err := mkDirFor(path); err != nil {
-				return nil, err
-			}
-			return os.Create(path)
-		},
+	return &fileAction{
+		typ:      ActionOverwrite,
+		target:   path,
+		contents: contents,
 		comment: fmt.Sprintf("overwrite file %s size=%s",
 			dstPath(dstDir, path), contentSize(contents)),
-		finalize: func(f *os.File) error {
-			if f == nil {
-				return nil
-			}
-			defer f.Close()
-			return flushBufferToFile(contents, f)
-		},
-		revert: func() error {
-			return os.Remove(path)
-		},
 	}
 }
 
 func CopyFileAction(dstDir, dst, src string) QueueAction {
+	return &fileAction{
+		typ:     ActionCopy,
+		target:  dst,
+		source:  src,
+		comment: fmt.Sprintf("copy file %s", dstPath(dstDir, dst)),
+	}
+}
+
+func CopyNewFileAction(dstDir, dst, src string) QueueAction {
+	return &fileAction{
+		typ:       ActionCopyNew,
+		target:    dst,
+		source:    src,
+		exclusive: true,
+		comment:   fmt.Sprintf("copy file %s (no overwrite)", dstPath(dstDir, dst)),
+	}
+}
+
+func SkipFileAction(dstDir, path string) QueueAction {
+	return &skipFileAction{
+		queueAction: queueAction{
+			info: ActionInfo{
+				Type:   ActionSkip,
+				Target: path,
+			},
+			comment: fmt.Sprintf("skip existing file %s", dstPath(dstDir, path)),
+		},
+	}
+}
+
+type skipFileAction struct {
+	queueAction
+}
+
+func isSkipAction(action QueueAction) bool {
+	if a, ok := action.(*annotatedAction); ok {
+		action = a.QueueAction
+	}
+	_, ok := action.(*skipFileAction)
+	return ok
+}
+
+// DeleteFileAction removes a file from the destination dir, along with parent dirs
+// that become empty. The file is moved into the staging dir, so it can be restored.
+func DeleteFileAction(dstDir, path string) QueueAction {
+	var backup string
+	info := ActionInfo{
+		Type:   ActionDelete,
+		Target: path,
+	}
+	if stat, err := os.Stat(path); err == nil {
+		info.Size = stat.Size()
+	}
+	info.Hash, _ = fileHash(path)
 	return &queueAction{
-		action: func() (f *os.File, err error) {
-			if err := mkDirFor(dst); err != nil {
-				return nil, err
+		info:    info,
+		comment: fmt.Sprintf("delete file %s", dstPath(dstDir, path)),
+		commit: func(tx *Transaction) error {
+			backup = tx.TempPath(path)
+			if err := os.Rename(path, backup); err != nil {
+				backup = ""
+				return err
 			}
-			return os.Create(dst)
+			stop := filepath.Clean(dstDir)
+			for dir := filepath.Dir(path); dir != stop && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+				if err := os.Remove(dir); err != nil {
+					break
+				}
+			}
+			return nil
 		},
-		comment: fmt.Sprintf("copy file %s", dstPath(dstDir, dst)),
-		finalize: func(dstFile *os.File) error {
-			if dstFile == nil {
+		revert: func(tx *Transaction) error {
+			if len(backup) == 0 {
 				return nil
 			}
-			defer dstFile.Close()
-			srcFile, err := os.Open(src)
-			if err != nil {
+			if _, err := mkDirAll(filepath.Dir(path)); err != nil {
 				return err
 			}
-			return copyFileToFile(dstFile, srcFile)
-		},
-		revert: func() error {
-			return os.Remove(dst)
+			return os.Rename(backup, path)
 		},
 	}
 }
 
-type queueAction struct {
-	action   func() (*os.File, error)
+// fileAction writes the target file into the staging dir first, then moves it
+// into the destination. An existing target is backed up, so it can be restored.
+// The file is written with contents, or copied from source if there are no contents.
+type fileAction struct {
+	typ      ActionType
+	target   string
 	comment  string
-	finalize func(f *os.File) error
-	revert   func() error
+	contents []byte
+	source   string
+	// exclusive actions fail if the target exists at the time of commit.
+	exclusive bool
+
+	staged      string
+	backup      string
+	createdDirs []string
+}
+
+func (a *fileAction) Comment() string {
+	return a.comment
+}
+
+func (a *fileAction) Info() ActionInfo {
+	info := ActionInfo{
+		Type:   a.typ,
+		Target: a.target,
+	}
+	if len(a.source) == 0 {
+		info.Size = int64(len(a.contents))
+		info.Hash = contentHash(a.contents)
+		return info
+	}
+	if stat, err := os.Stat(a.source); err == nil {
+		info.Size = stat.Size()
+	}
+	info.Hash, _ = fileHash(a.source)
+	return info
+}
+
+func (a *fileAction) Stage(tx *Transaction) error {
+	a.staged = tx.TempPath(a.target)
+	f, err := os.OpenFile(a.staged, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := a.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (a *fileAction) write(f *os.File) error {
+	if len(a.source) == 0 {
+		return flushBufferToFile(a.contents, f)
+	}
+	srcFile, err := os.Open(a.source)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	return copyFileToFile(f, srcFile)
+}
+
+func (a *fileAction) Commit(tx *Transaction) (err error) {
+	a.createdDirs, err = mkDirAll(filepath.Dir(a.target))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			removeDirs(a.createdDirs)
+		}
+	}()
+	if a.exclusive {
+		// linking fails if the target exists, unlike renaming; where linking is not supported,
+		// the target is created exclusively and the staged file is copied into it
+		if err := linkFile(a.staged, a.target); os.IsExist(err) {
+			return err
+		} else if err != nil {
+			if err := copyFileExclusive(a.staged, a.target); err != nil {
+				return err
+			}
+		}
+		return os.Remove(a.staged)
+	}
+	if info, err := os.Lstat(a.target); err == nil {
+		if info.IsDir() {
+			err := fmt.Errorf("target is a directory: %s", a.target)
+			return err
+		}
+		backup := tx.TempPath(a.target)
+		if err := backupFile(a.target, backup); err != nil {
+			return err
+		}
+		a.backup = backup
+		if err := os.Chmod(a.staged, info.Mode().Perm()); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(a.staged, a.target)
+}
+
+func (a *fileAction) Revert(tx *Transaction) error {
+	if len(a.backup) > 0 {
+		if err := os.Rename(a.backup, a.target); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return removeDirs(a.createdDirs)
 }
 
-func (q *queueAction) Run() (*os.File, error) {
-	if q.action != nil {
-		return q.action()
+// linkFile creates a hard link, it's replaced in tests to simulate filesystems without links.
+var linkFile = os.Link
+
+// backupFile links the file to backup path, or copies it if linking is not possible.
+func backupFile(path, backup string) error {
+	if err := linkFile(path, backup); err == nil {
+		return nil
 	}
-	return nil, nil
+	return copyFileExclusive(path, backup)
+}
+
+// copyFileExclusive copies the file to the path with the same permissions,
+// failing if the path exists.
+func copyFileExclusive(path, target string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := copyFileToFile(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// annotatedAction adds a note to the comment of an action.
+type annotatedAction struct {
+	QueueAction
+	note string
+}
+
+func (a *annotatedAction) Comment() string {
+	return fmt.Sprintf("%s (%s)", a.QueueAction.Comment(), a.note)
+}
+
+type queueAction struct {
+	info    ActionInfo
+	comment string
+	stage   func(tx *Transaction) error
+	commit  func(tx *Transaction) error
+	revert  func(tx *Transaction) error
 }
 
 func (q *queueAction) Comment() string {
 	return q.comment
 }
 
-func (q *queueAction) Finalize(f *os.File) error {
-	if q.finalize != nil {
-		return q.finalize(f)
+func (q *queueAction) Info() ActionInfo {
+	return q.info
+}
+
+func (q *queueAction) Stage(tx *Transaction) error {
+	if q.stage != nil {
+		return q.stage(tx)
+	}
+	return nil
+}
+
+func (q *queueAction) Commit(tx *Transaction) error {
+	if q.commit != nil {
+		return q.commit(tx)
 	}
 	return nil
 }
 
-func (q *queueAction) Revert() error {
+func (q *queueAction) Revert(tx *Transaction) error {
 	if q.revert != nil {
-		return q.revert()
+		return q.revert(tx)
 	}
 	return nil
 }
@@ -228,6 +549,6 @@ func copyFileToFile(dst, src *os.File) error {
 }
 
 func flushBufferToFile(buf []byte, f *os.File) error {
-	_, err := io.Copy(f, bytes.NewReader(buf))
+	_, err := f.Write(buf)
 	return err
 }
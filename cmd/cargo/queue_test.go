@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueExecRestoresOnFailure(t *testing.T) {
+	assert := assert.New(t)
+	dstDir, err := ioutil.TempDir("", "cargo-queue-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dstDir)
+	existing := filepath.Join(dstDir, "existing.txt")
+	ioutil.WriteFile(existing, []byte("original"), 0600)
+	ioutil.WriteFile(filepath.Join(dstDir, "blocker"), []byte("not a dir"), 0644)
+	stale := filepath.Join(dstDir, "stale", "stale.txt")
+	os.Mkdir(filepath.Dir(stale), 0755)
+	ioutil.WriteFile(stale, []byte("stale"), 0644)
+
+	q := NewQueue(
+		NewDirAction(dstDir, dstDir),
+		OverwriteFileAction(dstDir, existing, []byte("overwritten")),
+		DeleteFileAction(dstDir, stale),
+		CreateNewFileAction(dstDir, filepath.Join(dstDir, "sub", "new.txt"), []byte("new")),
+		CreateNewFileAction(dstDir, filepath.Join(dstDir, "blocker", "fail.txt"), []byte("fail")),
+	)
+	assert.False(q.Exec(dstDir))
+
+	data, err := ioutil.ReadFile(existing)
+	assert.NoError(err)
+	assert.Equal("original", string(data))
+	if info, err := os.Stat(existing); assert.NoError(err) {
+		assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	}
+	files, _ := ioutil.ReadDir(dstDir)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.Equal([]string{"blocker", "existing.txt", "stale"}, names)
+	data, err = ioutil.ReadFile(stale)
+	assert.NoError(err)
+	assert.Equal("stale", string(data))
+}
+
+func TestQueueExecCommits(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "cargo-queue-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	dstDir := filepath.Join(dir, "build")
+	existing := filepath.Join(dstDir, "existing.txt")
+
+	q := NewQueue(
+		NewDirAction(dstDir, dstDir),
+		CreateNewFileAction(dstDir, existing, []byte("original")),
+	)
+	assert.True(q.Exec(dstDir))
+	q = NewQueue(
+		OverwriteFileAction(dstDir, existing, []byte("overwritten")),
+		CreateNewFileAction(dstDir, filepath.Join(dstDir, "sub", "new.txt"), []byte("new")),
+	)
+	assert.True(q.Exec(dstDir))
+
+	data, _ := ioutil.ReadFile(existing)
+	assert.Equal("overwritten", string(data))
+	data, _ = ioutil.ReadFile(filepath.Join(dstDir, "sub", "new.txt"))
+	assert.Equal("new", string(data))
+	files, _ := ioutil.ReadDir(dstDir)
+	assert.Len(files, 2, "staging dir must be removed")
+}
+
+func TestQueueExecWithoutLinks(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "cargo-queue-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	defer func(link func(oldname, newname string) error) {
+		linkFile = link
+	}(linkFile)
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	existing := filepath.Join(dir, "existing.txt")
+	ioutil.WriteFile(existing, []byte("original"), 0644)
+
+	q := NewQueue(
+		CreateNewFileAction(dir, filepath.Join(dir, "sub", "new.txt"), []byte("new")),
+		OverwriteFileAction(dir, existing, []byte("overwritten")),
+	)
+	assert.True(q.Exec(dir))
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "sub", "new.txt"))
+	assert.Equal("new", string(data))
+	data, _ = ioutil.ReadFile(existing)
+	assert.Equal("overwritten", string(data))
+
+	// the target created exclusively must not be overwritten
+	q = NewQueue(
+		CreateNewFileAction(dir, existing, []byte("created")),
+	)
+	assert.False(q.Exec(dir))
+	data, _ = ioutil.ReadFile(existing)
+	assert.Equal("overwritten", string(data))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(files, 2, "staging dir must be removed")
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Renderer plans publication of the sources known to TemplateLoader into the
+// destination dir, rendering templates against the TemplateContext.
+type Renderer struct {
+	Loader  *TemplateLoader
+	Context TemplateContext
+	// Prefix is a path relative to the destination dir, outputs are placed under it.
+	Prefix string
+
+	// srcDir is an absolute path with a trailing slash, so it can be trimmed
+	// from source paths to get paths relative to the source root.
+	srcDir string
+	dstDir string
+}
+
+func NewRenderer(loader *TemplateLoader, context TemplateContext, srcDir, dstDir string) (*Renderer, error) {
+	srcAbsPath, err := filepath.Abs(srcDir)
+	if err != nil {
+		err = fmt.Errorf("cannot get absolute path for: %s", srcDir)
+		return nil, err
+	} else if !strings.HasSuffix(srcAbsPath, "/") {
+		srcAbsPath += "/"
+	}
+	r := &Renderer{
+		Loader:  loader,
+		Context: context,
+		srcDir:  srcAbsPath,
+		dstDir:  dstDir,
+	}
+	return r, nil
+}
+
+// Output is a single file planned for publication into the destination dir.
+type Output struct {
+	Mode   TemplateMode
+	Source string
+	Target string
+	// Contents are the rendered contents of the target file,
+	// nil if the source is copied verbatim.
+	Contents []byte
+	// Item is the collection item the output has been rendered for, if any.
+	Item *OutputItem
+}
+
+// OutputItem identifies an item of the collection, Index is -1 if
+// the whole collection has been used.
+type OutputItem struct {
+	Collection string
+	Index      int
+}
+
+// Hash returns the hash of output contents, in the same format as fileHash does.
+func (o *Output) Hash() (string, error) {
+	if o.IsCopy() {
+		return fileHash(o.Source)
+	}
+	return contentHash(o.Contents), nil
+}
+
+// IsCopy reports whether the source file is copied as is.
+func (o *Output) IsCopy() bool {
+	return o.Contents == nil
+}
+
+// Action returns a queue action that publishes the output, depending on
+// whether the target exists in the destination dir. Existing targets are
+// handled according to the conflict rules.
+func (o *Output) Action(dstDir string, rules *ConflictRules) (QueueAction, error) {
+	if info, err := os.Stat(o.Target); os.IsNotExist(err) {
+		if o.IsCopy() {
+			return CopyFileAction(dstDir, o.Target, o.Source), nil
+		}
+		return CreateNewFileAction(dstDir, o.Target, o.Contents), nil
+	} else if err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		err := fmt.Errorf("target is a directory: %s", o.Target)
+		return nil, err
+	}
+	return rules.existingTargetAction(dstDir, o)
+}
+
+// OutputActions returns a queue of actions needed to publish all outputs.
+func OutputActions(dstDir string, outputs []*Output, rules *ConflictRules) (Queue, error) {
+	actions := make(Queue, 0, len(outputs))
+	for _, output := range outputs {
+		action, err := output.Action(dstDir, rules)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// renderSteps lists rendering modes in order they are published, with their titles.
+var renderSteps = []struct {
+	Mode  TemplateMode
+	Title string
+}{
+	{TemplateModeVerbatim, "Verbatim Files"},
+	{TemplateModeSingle, "Single Templates"},
+	{TemplateModeCollection, "Collection Templates"},
+}
+
+// Render renders all sources of the given mode. Rendering goes on after errors,
+// so all of them are returned at once in ErrorList.
+func (r *Renderer) Render(mode TemplateMode) ([]*Output, error) {
+	var outputs []*Output
+	var errs ErrorList
+	r.Loader.ForEachSource(mode, func(source string) error {
+		sourceOutputs, err := r.RenderSource(mode, source)
+		errs.Add(err)
+		outputs = append(outputs, sourceOutputs...)
+		return nil
+	})
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// RenderAll renders sources of all modes, in order they are published.
+func (r *Renderer) RenderAll() ([]*Output, error) {
+	var outputs []*Output
+	var errs ErrorList
+	for _, step := range renderSteps {
+		stepOutputs, err := r.Render(step.Mode)
+		errs.Add(err)
+		outputs = append(outputs, stepOutputs...)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// RenderSource renders a single source, yielding zero or more outputs. A template
+// that renders into empty contents yields no output. Errors of all collection items
+// are returned at once in ErrorList.
+func (r *Renderer) RenderSource(mode TemplateMode, source string) ([]*Output, error) {
+	modePrefix := r.Loader.opts.ModePrefix
+	relativePath := strings.TrimPrefix(source, r.srcDir)
+	switch mode {
+	case TemplateModeVerbatim:
+		output := &Output{
+			Mode:   mode,
+			Source: source,
+			Target: filepath.Join(r.dstDir, r.Prefix, relativePath),
+		}
+		return []*Output{output}, nil
+	case TemplateModeSingle:
+		contents, err := r.Loader.Execute(mode, source, r.Context)
+		if err != nil {
+			return nil, r.Loader.TemplateError(source, err)
+		} else if isEmptyOrWhitespace(contents) {
+			return nil, nil
+		}
+		output := &Output{
+			Mode:     mode,
+			Source:   source,
+			Target:   removeModePrefix(filepath.Join(r.dstDir, r.Prefix, relativePath), modePrefix),
+			Contents: contents,
+		}
+		return []*Output{output}, nil
+	case TemplateModeCollection:
+		tpl := r.Loader.Template(mode, source)
+		items, err := r.Loader.RenderFilepathItems(r.Context, source)
+		if err != nil {
+			err = &TemplateError{
+				Source: source,
+				Err:    fmt.Sprintf("file path template validation failed: %v", err),
+			}
+			return nil, err
+		}
+		var errs ErrorList
+		outputs := make([]*Output, 0, len(items))
+		for _, item := range items {
+			relativeOutput := strings.TrimPrefix(item.Path, r.srcDir)
+			output := &Output{
+				Mode:   mode,
+				Source: source,
+				Target: removeModePrefix(filepath.Join(r.dstDir, r.Prefix, relativeOutput), modePrefix),
+			}
+			if len(item.Collection) > 0 {
+				output.Item = &OutputItem{
+					Collection: item.Collection,
+					Index:      item.Index,
+				}
+			}
+			if tpl != nil {
+				contents, err := r.Loader.Execute(mode, source, item.Context)
+				if err != nil {
+					tplErr := r.Loader.TemplateError(source, err)
+					tplErr.Item = output.Item
+					tplErr.Target = dstPath(r.dstDir, output.Target)
+					errs.Add(tplErr)
+					continue
+				} else if isEmptyOrWhitespace(contents) {
+					continue
+				}
+				output.Contents = contents
+			}
+			outputs = append(outputs, output)
+		}
+		if err := errs.Err(); err != nil {
+			return nil, err
+		}
+		return outputs, nil
+	}
+	err := fmt.Errorf("unknown template mode: %s", mode)
+	return nil, err
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/ghodss/yaml"
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+)
+
+func repoCmd(cmd *cli.Cmd) {
+	cmd.Command("add", "Adds a repository, given as a file:// or http:// URL or a local dir, "+
+		"and downloads its packages.", repoAddCmd)
+	cmd.Command("refresh", "Downloads the index and new packages of all repositories, "+
+		"or of the named ones.", repoRefreshCmd)
+	cmd.Command("list", "Lists the repositories added.", repoListCmd)
+	cmd.Command("index", "Writes index.yaml of a dir with package tarballs, "+
+		"so the dir can be served as a repository.", repoIndexCmd)
+}
+
+func repoAddCmd(cmd *cli.Cmd) {
+	addLogLevelOption(cmd)
+	trust := addTrustOptions(cmd)
+	name := cmd.StringArg("NAME", "", "Specify the repository name.")
+	location := cmd.StringArg("URL", "", "Specify the repository URL, or its local dir.")
+
+	cmd.Spec = "[OPTIONS] NAME URL"
+	cmd.Action = func() {
+		config, err := LoadRepoConfig("")
+		if err != nil {
+			fatalln(err)
+		}
+		verifier, err := trust.Verifier()
+		if err != nil {
+			fatalln(err)
+		}
+		repo, err := config.Add(*name, *location)
+		if err != nil {
+			fatalln(err)
+		}
+		// the repository is registered only if its index can be downloaded
+		index, err := config.Refresh(repo, verifier)
+		if err != nil {
+			fatalln(err)
+		} else if err := config.Write(); err != nil {
+			fatalln(err)
+		}
+		fmt.Printf("added %s with %d packages\n", repo.Name, len(index.Packages))
+	}
+}
+
+func repoRefreshCmd(cmd *cli.Cmd) {
+	addLogLevelOption(cmd)
+	trust := addTrustOptions(cmd)
+	names := cmd.StringsArg("NAME", nil, "Specify repositories to refresh, all by default.")
+
+	cmd.Spec = "[OPTIONS] [NAME...]"
+	cmd.Action = func() {
+		config, err := LoadRepoConfig("")
+		if err != nil {
+			fatalln(err)
+		}
+		verifier, err := trust.Verifier()
+		if err != nil {
+			fatalln(err)
+		}
+		repos, err := config.Select(*names)
+		if err != nil {
+			fatalln(err)
+		}
+		var errs ErrorList
+		for _, repo := range repos {
+			index, err := config.Refresh(repo, verifier)
+			if err != nil {
+				errs.Add(fmt.Errorf("%s: %v", repo.Name, err))
+				continue
+			}
+			fmt.Printf("refreshed %s with %d packages\n", repo.Name, len(index.Packages))
+		}
+		if err := errs.Err(); err != nil {
+			fatalln(err)
+		}
+	}
+}
+
+func repoListCmd(cmd *cli.Cmd) {
+	cmd.Action = func() {
+		config, err := LoadRepoConfig("")
+		if err != nil {
+			fatalln(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, repo := range config.Repositories {
+			fmt.Fprintf(w, "%s\t%s\n", repo.Name, repo.URL)
+		}
+		w.Flush()
+	}
+}
+
+func repoIndexCmd(cmd *cli.Cmd) {
+	addLogLevelOption(cmd)
+	dir := cmd.StringArg("DIR", ".", "Specify the dir with package tarballs.")
+
+	cmd.Spec = "[OPTIONS] [DIR]"
+	cmd.Action = func() {
+		index, err := BuildRepoIndex(*dir)
+		if err != nil {
+			fatalln(err)
+		}
+		path := filepath.Join(*dir, RepoIndexFile)
+		if err := index.Write(path); err != nil {
+			fatalln(err)
+		}
+		fmt.Printf("indexed %d packages into %s\n", len(index.Packages), path)
+	}
+}
+
+func listCmd(cmd *cli.Cmd) {
+	all := cmd.BoolOpt("a all", false, "List all versions of packages, not only the latest ones.")
+
+	cmd.Spec = "[OPTIONS]"
+	cmd.Action = func() {
+		printPackages("", *all)
+	}
+}
+
+func searchCmd(cmd *cli.Cmd) {
+	all := cmd.BoolOpt("a all", false, "List all versions of packages found, not only the latest ones.")
+	term := cmd.StringArg("TERM", "", "Specify the text to find in package names, descriptions and authors.")
+
+	cmd.Spec = "[OPTIONS] TERM"
+	cmd.Action = func() {
+		printPackages(*term, *all)
+	}
+}
+
+func printPackages(term string, all bool) {
+	config, err := LoadRepoConfig("")
+	if err != nil {
+		fatalln(err)
+	}
+	found, err := config.Search(term, all)
+	if err != nil {
+		fatalln(err)
+	} else if len(found) == 0 {
+		fmt.Println("no packages found")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVERSION\tDESCRIPTION")
+	for _, pkg := range found {
+		fmt.Fprintf(w, "%s/%s\t%s\t%s\n", pkg.Repo, pkg.Name, pkg.Version, pkg.Description)
+	}
+	w.Flush()
+}
+
+// RepoFile lists the repositories added, it is in the cargo home dir.
+const RepoFile = "repositories.yaml"
+
+// RepoIndexFile lists packages of a repository, it is at the root of the repository.
+const RepoIndexFile = "index.yaml"
+
+// RepoIndexVersion is the version of the index format.
+const RepoIndexVersion = "v1"
+
+// repoClient downloads from HTTP repositories.
+var repoClient = &http.Client{
+	Timeout: 5 * time.Minute,
+}
+
+// Repo is a repository of packages, served over HTTP or from a local dir.
+type Repo struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// RepoConfig is the list of repositories added.
+type RepoConfig struct {
+	// Home is the cargo home dir, packages of repositories are cached in its cache dir.
+	Home         string  `json:"-"`
+	Repositories []*Repo `json:"repositories"`
+}
+
+// PackageInfo describes a version of a package in the repository index.
+type PackageInfo struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+	Author      string `json:"author,omitempty"`
+	// File is the path of the package tarball, relative to the repository URL.
+	File string `json:"file"`
+	// Digest is the hash of the package tarball, as in the generated files manifest.
+	Digest string `json:"digest"`
+	// Signature is the detached signature of the package tarball, if it's signed.
+	Signature string `json:"signature,omitempty"`
+	// Repo is the name of the repository the package is found in, it is not indexed.
+	Repo string `json:"-"`
+}
+
+// RepoIndex lists packages of a repository, by name, with their versions from the latest one.
+type RepoIndex struct {
+	APIVersion string                    `json:"apiVersion"`
+	Packages   map[string][]*PackageInfo `json:"packages"`
+}
+
+// cargoHome returns the dir that keeps the repositories added and their cache.
+func cargoHome() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cargo"), nil
+}
+
+// LoadRepoConfig loads the repositories added, from the home dir or the default one.
+func LoadRepoConfig(home string) (*RepoConfig, error) {
+	if len(home) == 0 {
+		var err error
+		if home, err = cargoHome(); err != nil {
+			return nil, err
+		}
+	}
+	config := &RepoConfig{
+		Home: home,
+	}
+	data, err := ioutil.ReadFile(filepath.Join(home, RepoFile))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		err = fmt.Errorf("error loading %s: %v", RepoFile, err)
+		return nil, err
+	}
+	return config, nil
+}
+
+// Write saves the list of repositories into the home dir.
+func (c *RepoConfig) Write() error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(c.Home, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.Home, RepoFile), data, 0644)
+}
+
+// Add adds a repository to the list, local dirs are added as file:// URLs.
+func (c *RepoConfig) Add(name, location string) (*Repo, error) {
+	if !packageNameRx.MatchString(name) {
+		err := fmt.Errorf("repository name is not valid: %s", name)
+		return nil, err
+	} else if c.Repo(name) != nil {
+		err := fmt.Errorf("repository %s is added already", name)
+		return nil, err
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "file":
+		if !filepath.IsAbs(filepath.FromSlash(u.Path)) {
+			err := fmt.Errorf("file:// URL must have an absolute path: %s", location)
+			return nil, err
+		}
+	case "":
+		dir, err := filepath.Abs(location)
+		if err != nil {
+			return nil, err
+		}
+		u = &url.URL{Scheme: "file", Path: filepath.ToSlash(dir)}
+	default:
+		err := fmt.Errorf("repository URL scheme is not supported: %s", location)
+		return nil, err
+	}
+	repo := &Repo{
+		Name: name,
+		URL:  u.String(),
+	}
+	c.Repositories = append(c.Repositories, repo)
+	return repo, nil
+}
+
+// Repo returns the named repository, nil if it's not added.
+func (c *RepoConfig) Repo(name string) *Repo {
+	for _, repo := range c.Repositories {
+		if repo.Name == name {
+			return repo
+		}
+	}
+	return nil
+}
+
+// Select returns the named repositories, all of them if no names are given.
+func (c *RepoConfig) Select(names []string) ([]*Repo, error) {
+	if len(names) == 0 {
+		return c.Repositories, nil
+	}
+	repos := make([]*Repo, 0, len(names))
+	for _, name := range names {
+		repo := c.Repo(name)
+		if repo == nil {
+			err := fmt.Errorf("repository %s is not added", name)
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+// CacheDir returns the dir packages of the repository are cached in.
+func (c *RepoConfig) CacheDir(repo string) string {
+	return filepath.Join(c.Home, "cache", repo)
+}
+
+// PackageDir returns the dir a version of the package is extracted into.
+func (c *RepoConfig) PackageDir(repo, name, version string) string {
+	return filepath.Join(c.CacheDir(repo), name, version)
+}
+
+// ArchivePath returns the path a version of the package tarball is kept at,
+// so the package can be verified again when it's installed.
+func (c *RepoConfig) ArchivePath(repo, name, version string) string {
+	return c.PackageDir(repo, name, version) + ".tgz"
+}
+
+// Refresh downloads the index of the repository and extracts the packages that are not cached
+// yet, after verifying their signatures. Versions of packages are not expected to change,
+// so the cached ones are kept as is.
+func (c *RepoConfig) Refresh(repo *Repo, verifier *Verifier) (*RepoIndex, error) {
+	data, err := repo.fetch(RepoIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	index, err := parseRepoIndex(data)
+	if err != nil {
+		err = fmt.Errorf("error loading %s: %v", RepoIndexFile, err)
+		return nil, err
+	}
+	for _, name := range index.Names() {
+		for _, info := range index.Packages[name] {
+			if c.isCached(repo.Name, name, info.Version) {
+				continue
+			}
+			log.WithFields(log.Fields{
+				"repo":    repo.Name,
+				"package": name,
+				"version": info.Version,
+			}).Infoln("downloading package")
+			if err := c.download(repo, info, verifier); err != nil {
+				err = fmt.Errorf("%s %s: %v", name, info.Version, err)
+				return nil, err
+			}
+		}
+	}
+	if err := index.Write(filepath.Join(c.CacheDir(repo.Name), RepoIndexFile)); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (c *RepoConfig) isCached(repo, name, version string) bool {
+	if _, err := os.Stat(c.PackageDir(repo, name, version)); err != nil {
+		return false
+	} else if _, err := os.Stat(c.ArchivePath(repo, name, version)); err != nil {
+		return false
+	}
+	return true
+}
+
+// download extracts the package into a temporary dir first, so the cache
+// never has partially extracted packages.
+func (c *RepoConfig) download(repo *Repo, info *PackageInfo, verifier *Verifier) error {
+	data, err := repo.fetch(info.File)
+	if err != nil {
+		return err
+	} else if hash := contentHash(data); hash != info.Digest {
+		err := fmt.Errorf("digest of %s mismatch: %s, indexed %s", info.File, hash, info.Digest)
+		return err
+	} else if err := verifier.Verify(info.Name+" "+info.Version, data, info.Signature); err != nil {
+		return err
+	}
+	dir := c.PackageDir(repo.Name, info.Name, info.Version)
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	} else if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), "."+info.Version+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := extractArchive(data, tmpDir); err != nil {
+		return err
+	} else if err := ioutil.WriteFile(c.ArchivePath(repo.Name, info.Name, info.Version), data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, dir)
+}
+
+// VerifyCached checks the cached tarball of the package against its digest, and its signature
+// in the cached repository index, so packages cached in insecure mode are not trusted later.
+func (c *RepoConfig) VerifyCached(locked *LockedPackage, verifier *Verifier) error {
+	name := locked.Name + " " + locked.Version
+	index, err := ReadRepoIndex(filepath.Join(c.CacheDir(locked.Repo), RepoIndexFile))
+	if err != nil {
+		return err
+	}
+	var signature string
+	for _, info := range index.Packages[locked.Name] {
+		if info.Version == locked.Version {
+			signature = info.Signature
+		}
+	}
+	data, err := ioutil.ReadFile(c.ArchivePath(locked.Repo, locked.Name, locked.Version))
+	if os.IsNotExist(err) {
+		err := fmt.Errorf("package %s is not cached, run cargo repo refresh %s", name, locked.Repo)
+		return err
+	} else if err != nil {
+		return err
+	} else if hash := contentHash(data); hash != locked.Digest {
+		err := fmt.Errorf("digest of cached package %s mismatch: %s, locked %s", name, hash, locked.Digest)
+		return err
+	}
+	return verifier.Verify(name, data, signature)
+}
+
+// Search finds packages in the cached indexes of all repositories, that have the
+// term in their name, description or author, ignoring case. All packages are found
+// if the term is empty. Only the latest versions of packages are returned, unless all is set.
+func (c *RepoConfig) Search(term string, all bool) ([]*PackageInfo, error) {
+	term = strings.ToLower(term)
+	var found []*PackageInfo
+	for _, repo := range c.Repositories {
+		index, err := ReadRepoIndex(filepath.Join(c.CacheDir(repo.Name), RepoIndexFile))
+		if os.IsNotExist(err) {
+			log.WithField("repo", repo.Name).Warningln("repository is not refreshed yet")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, name := range index.Names() {
+			for _, info := range index.Packages[name] {
+				if info.matches(term) {
+					info.Repo = repo.Name
+					found = append(found, info)
+					if !all {
+						break
+					}
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+func (i *PackageInfo) matches(term string) bool {
+	for _, field := range []string{i.Name, i.Description, i.Author} {
+		if strings.Contains(strings.ToLower(field), term) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch reads the file at the path relative to the repository URL.
+func (r *Repo) fetch(path string) ([]byte, error) {
+	base, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	u := base.ResolveReference(ref)
+	switch u.Scheme {
+	case "file":
+		return ioutil.ReadFile(filepath.FromSlash(u.Path))
+	case "http", "https":
+		resp, err := repoClient.Get(u.String())
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err := fmt.Errorf("GET %s: %s", u, resp.Status)
+			return nil, err
+		}
+		return ioutil.ReadAll(resp.Body)
+	default:
+		err := fmt.Errorf("repository URL scheme is not supported: %s", u)
+		return nil, err
+	}
+}
+
+// BuildRepoIndex indexes package tarballs found in the dir.
+func BuildRepoIndex(dir string) (*RepoIndex, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tgz"))
+	if err != nil {
+		return nil, err
+	}
+	index := &RepoIndex{
+		APIVersion: RepoIndexVersion,
+		Packages:   make(map[string][]*PackageInfo),
+	}
+	var errs ErrorList
+	for _, file := range files {
+		info, err := indexArchive(file)
+		if err != nil {
+			errs.Add(fmt.Errorf("%s: %v", filepath.Base(file), err))
+			continue
+		}
+		index.Packages[info.Name] = append(index.Packages[info.Name], info)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	} else if err := index.validate(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func indexArchive(file string) (*PackageInfo, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pkgData, err := readArchiveFile(data, PackageFile)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := parsePackage(PackageFile, pkgData)
+	if err != nil {
+		return nil, err
+	}
+	name, err := pkg.ArchiveName()
+	if err != nil {
+		return nil, err
+	} else if name != filepath.Base(file) {
+		log.WithField("file", file).Warningln("package tarball is renamed, expected", name)
+	}
+	signature, err := readSignature(file)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := semver.NewVersion(pkg.Version())
+	info := &PackageInfo{
+		Name:        pkg.Name(),
+		Version:     v.String(),
+		Description: pkg.Description(),
+		Author:      pkg.Author(),
+		File:        filepath.Base(file),
+		Digest:      contentHash(data),
+		Signature:   signature,
+	}
+	return info, nil
+}
+
+// ReadRepoIndex reads the index file.
+func ReadRepoIndex(path string) (*RepoIndex, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRepoIndex(data)
+}
+
+func parseRepoIndex(data []byte) (*RepoIndex, error) {
+	var index RepoIndex
+	if err := yaml.Unmarshal(data, &index); err != nil {
+		return nil, err
+	} else if index.APIVersion != RepoIndexVersion {
+		err := fmt.Errorf("index apiVersion is not supported: %s", index.APIVersion)
+		return nil, err
+	} else if err := index.validate(); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// validate checks names and versions of packages, since they are used as paths in the cache,
+// and sorts the versions from the latest one.
+func (i *RepoIndex) validate() error {
+	for name, infos := range i.Packages {
+		if !packageNameRx.MatchString(name) {
+			err := fmt.Errorf("package name is not valid: %s", name)
+			return err
+		}
+		versions := make(map[string]*semver.Version, len(infos))
+		for _, info := range infos {
+			if info.Name != name {
+				err := fmt.Errorf("package %s is listed as %s", info.Name, name)
+				return err
+			} else if len(info.File) == 0 || len(info.Digest) == 0 {
+				err := fmt.Errorf("package %s %s has no file or digest", name, info.Version)
+				return err
+			}
+			v, err := semver.NewVersion(info.Version)
+			if err != nil || v.String() != info.Version {
+				err := fmt.Errorf("package %s version is not valid: %s", name, info.Version)
+				return err
+			} else if _, ok := versions[info.Version]; ok {
+				err := fmt.Errorf("package %s version %s is listed twice", name, info.Version)
+				return err
+			}
+			versions[info.Version] = v
+		}
+		sort.SliceStable(infos, func(a, b int) bool {
+			return versions[infos[a].Version].GreaterThan(versions[infos[b].Version])
+		})
+	}
+	return nil
+}
+
+// Names returns names of packages in the index, sorted.
+func (i *RepoIndex) Names() []string {
+	names := make([]string, 0, len(i.Packages))
+	for name := range i.Packages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Write writes the index file.
+func (i *RepoIndex) Write(path string) error {
+	if i.Packages == nil {
+		i.Packages = make(map[string][]*PackageInfo)
+	}
+	data, err := yaml.Marshal(i)
+	if err != nil {
+		return err
+	} else if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
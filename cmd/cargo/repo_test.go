@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestPackage(dir, version string) {
+	os.MkdirAll(filepath.Join(dir, "cargo"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, PackageFile), []byte(`
+Cargo:
+  name: demo
+  version: `+version+`
+  description: Demo site
+  author:
+    name: Troven
+    email: cto@troven.co
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cargo", "index.html"), []byte("<h1>{{ .Cargo.name }}</h1>"), 0644)
+}
+
+func TestRepoRefreshOverHTTP(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "cargo-repo-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	repoDir := filepath.Join(root, "repo")
+	for _, version := range []string{"0.1.0", "0.2.0"} {
+		pkgDir := filepath.Join(root, "demo-"+version)
+		writeTestPackage(pkgDir, version)
+		pkg, err := LoadPackage(pkgDir)
+		if !assert.NoError(err) {
+			return
+		}
+		if _, err := pkg.WriteArchive(repoDir, ""); !assert.NoError(err) {
+			return
+		}
+	}
+	index, err := BuildRepoIndex(repoDir)
+	if !assert.NoError(err) {
+		return
+	}
+	if assert.Len(index.Packages["demo"], 2) {
+		assert.Equal("0.2.0", index.Packages["demo"][0].Version)
+		assert.Equal("Troven <cto@troven.co>", index.Packages["demo"][0].Author)
+	}
+	if !assert.NoError(index.Write(filepath.Join(repoDir, RepoIndexFile))) {
+		return
+	}
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(repoDir)))
+	defer srv.Close()
+
+	config, err := LoadRepoConfig(filepath.Join(root, "home"))
+	if !assert.NoError(err) {
+		return
+	}
+	repo, err := config.Add("troven", srv.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	if _, err := config.Refresh(repo, &Verifier{Insecure: true}); !assert.NoError(err) {
+		return
+	}
+	data, err := ioutil.ReadFile(filepath.Join(config.PackageDir("troven", "demo", "0.1.0"), "cargo", "index.html"))
+	if assert.NoError(err) {
+		assert.Equal("<h1>{{ .Cargo.name }}</h1>", string(data))
+	}
+	assert.FileExists(filepath.Join(config.PackageDir("troven", "demo", "0.2.0"), PackageFile))
+
+	found, err := config.Search("TROVEN", false)
+	if assert.NoError(err) && assert.Len(found, 1) {
+		assert.Equal("troven", found[0].Repo)
+		assert.Equal("0.2.0", found[0].Version)
+	}
+	found, err = config.Search("", true)
+	if assert.NoError(err) {
+		assert.Len(found, 2)
+	}
+	found, err = config.Search("nothing", true)
+	if assert.NoError(err) {
+		assert.Empty(found)
+	}
+}
+
+func TestRepoRefreshChecksDigest(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "cargo-repo-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	repoDir := filepath.Join(root, "repo")
+	writeTestPackage(filepath.Join(root, "demo"), "1.0.0")
+	pkg, err := LoadPackage(filepath.Join(root, "demo"))
+	if !assert.NoError(err) {
+		return
+	}
+	if _, err := pkg.WriteArchive(repoDir, ""); !assert.NoError(err) {
+		return
+	}
+	index, err := BuildRepoIndex(repoDir)
+	if !assert.NoError(err) {
+		return
+	}
+	index.Packages["demo"][0].Digest = contentHash([]byte("tampered"))
+	if !assert.NoError(index.Write(filepath.Join(repoDir, RepoIndexFile))) {
+		return
+	}
+
+	config, err := LoadRepoConfig(filepath.Join(root, "home"))
+	if !assert.NoError(err) {
+		return
+	}
+	repo, err := config.Add("local", repoDir)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = config.Refresh(repo, &Verifier{Insecure: true})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "digest")
+	}
+	_, err = os.Stat(config.PackageDir("local", "demo", "1.0.0"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestRepoRefreshVerifiesSignatures(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "cargo-repo-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if !assert.NoError(err) {
+		return
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if !assert.NoError(err) {
+		return
+	}
+	keyPath := filepath.Join(root, "author.key")
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	repoDir := filepath.Join(root, "repo")
+	writeTestPackage(filepath.Join(root, "demo"), "1.0.0")
+	pkg, err := LoadPackage(filepath.Join(root, "demo"))
+	if !assert.NoError(err) {
+		return
+	}
+	archive, err := pkg.WriteArchive(repoDir, keyPath)
+	if !assert.NoError(err) || !assert.NotEmpty(archive.Signature) {
+		return
+	}
+	index, err := BuildRepoIndex(repoDir)
+	if !assert.NoError(err) || !assert.NoError(index.Write(filepath.Join(repoDir, RepoIndexFile))) {
+		return
+	}
+
+	config, err := LoadRepoConfig(filepath.Join(root, "home"))
+	if !assert.NoError(err) {
+		return
+	}
+	repo, err := config.Add("local", repoDir)
+	if !assert.NoError(err) {
+		return
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, err = config.Refresh(repo, &Verifier{Keys: []ed25519.PublicKey{other}})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "signature is not valid")
+	}
+	_, err = config.Refresh(repo, &Verifier{Keys: []ed25519.PublicKey{other, pub}})
+	assert.NoError(err)
+
+	locked := &LockedPackage{Name: "demo", Version: "1.0.0", Repo: "local", Digest: archive.Hash}
+	assert.NoError(config.VerifyCached(locked, &Verifier{Keys: []ed25519.PublicKey{pub}}))
+	assert.Error(config.VerifyCached(locked, &Verifier{Keys: []ed25519.PublicKey{other}}))
+}
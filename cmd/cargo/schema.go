@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ghodss/yaml"
+)
+
+// Schema is a JSON Schema a context root is validated against, declared in Cargo.schemas, that maps
+// names of context roots to schema files in JSON or YAML. Paths are relative to the dir of the package.
+//
+//	schemas:
+//	    Values: schema.json
+//
+// The keywords of draft 7 are supported, except for formats, dependencies and remote references:
+// type, enum, const, properties, required, additionalProperties, patternProperties, min/maxProperties,
+// items, additionalItems, min/maxItems, uniqueItems, contains, min/maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, multipleOf, allOf, anyOf, oneOf, not, if/then/else, and $ref
+// to definitions in the same file. Defaults of properties are set in the context, if they are missing.
+type Schema struct {
+	Name string
+	Path string
+
+	doc      interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// ParseSchemas reads the schemas field of global Cargo context, the schemas are loaded from files
+// relative to baseDir, which is the dir of the package. Schemas are sorted by names of context roots.
+func ParseSchemas(global Cargo, baseDir string) ([]*Schema, error) {
+	v, ok := global.Lookup("schemas")
+	if !ok || v == nil {
+		return nil, nil
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		err := errors.New("Cargo.schemas must map names of context roots to schema files")
+		return nil, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	schemas := make([]*Schema, 0, len(names))
+	for _, name := range names {
+		path, ok := fields[name].(string)
+		if !ok || len(path) == 0 {
+			err := fmt.Errorf("Cargo.schemas.%s must specify the path of schema file", name)
+			return nil, err
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		schema, err := LoadSchema(name, path)
+		if err != nil {
+			err = fmt.Errorf("Cargo.schemas.%s: %v", name, err)
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+// LoadSchema loads the schema of the context root name from a JSON or YAML file.
+func LoadSchema(name, path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		err = fmt.Errorf("error loading %s: %v", path, err)
+		return nil, err
+	}
+	switch doc.(type) {
+	case map[string]interface{}, bool:
+	default:
+		err := fmt.Errorf("error loading %s: schema must be an object or a boolean", path)
+		return nil, err
+	}
+	schema := &Schema{
+		Name:     name,
+		Path:     path,
+		doc:      doc,
+		patterns: make(map[string]*regexp.Regexp),
+	}
+	return schema, nil
+}
+
+// Validate validates context roots against their schemas, setting defaults of the schemas in
+// the context. All violations are reported, located by JSON pointers within the roots.
+func (c TemplateContext) Validate(schemas []*Schema) error {
+	var errs ErrorList
+	for _, schema := range schemas {
+		root := c[schema.Name]
+		if global, ok := root.(Cargo); ok {
+			root = map[string]interface{}(global)
+		}
+		v, err := schema.Apply(root)
+		if cargo, ok := v.(map[string]interface{}); ok && schema.Name == "Cargo" {
+			v = Cargo(cargo)
+		}
+		if v != nil {
+			c[schema.Name] = v
+		}
+		errs.Add(err)
+	}
+	return errs.Err()
+}
+
+// SchemaError is a violation of a schema by the value at the JSON pointer in a context root.
+type SchemaError struct {
+	Root    string
+	Pointer string
+	Err     string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s%s: %s", e.Root, e.Pointer, e.Err)
+}
+
+// Apply sets defaults of the schema in the value and validates it, the value is returned with defaults,
+// it's a new map if the value is missing and the schema has properties. All violations are returned.
+func (s *Schema) Apply(v interface{}) (interface{}, error) {
+	if doc, ok := s.doc.(map[string]interface{}); ok && v == nil && doc["properties"] != nil {
+		v = make(map[string]interface{})
+	}
+	var errs ErrorList
+	v = s.apply(s.doc, v, "", true, &errs)
+	return v, errs.Err()
+}
+
+// matches tells whether the value is valid against the subschema, defaults are not set.
+func (s *Schema) matches(schema, v interface{}, ptr string) bool {
+	var errs ErrorList
+	s.apply(schema, v, ptr, false, &errs)
+	return len(errs) == 0
+}
+
+// apply validates the value at the pointer against the subschema, adding violations to errs.
+// Defaults are set in the value if setDefaults is set, the value is returned with defaults.
+func (s *Schema) apply(schema, v interface{}, ptr string, setDefaults bool, errs *ErrorList) interface{} {
+	fail := func(format string, args ...interface{}) {
+		errs.Add(&SchemaError{
+			Root:    s.Name,
+			Pointer: ptr,
+			Err:     fmt.Sprintf(format, args...),
+		})
+	}
+	doc, ok := schema.(map[string]interface{})
+	if allowed, isBool := schema.(bool); isBool {
+		if !allowed {
+			fail("no value is allowed")
+		}
+		return v
+	} else if !ok {
+		fail("schema is not valid: %v", schema)
+		return v
+	}
+	if ref, ok := doc["$ref"].(string); ok {
+		target, err := s.resolveRef(ref)
+		if err != nil {
+			fail("%v", err)
+			return v
+		}
+		v = s.apply(target, v, ptr, setDefaults, errs)
+	}
+	if fields, ok := v.(map[string]interface{}); ok && setDefaults {
+		properties, _ := doc["properties"].(map[string]interface{})
+		for name, property := range properties {
+			if property, ok := property.(map[string]interface{}); ok {
+				if def, ok := property["default"]; ok && fields[name] == nil {
+					fields[name] = copyJSONValue(def)
+				}
+			}
+		}
+	}
+
+	if t, ok := doc["type"]; ok && !matchesType(t, v) {
+		fail("expected %s, found %s", typeNames(t), jsonTypeOf(v))
+		return v
+	}
+	if enum, ok := doc["enum"].([]interface{}); ok {
+		found := false
+		for _, item := range enum {
+			if jsonEqual(item, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %s", jsonString(enum))
+		}
+	}
+	if c, ok := doc["const"]; ok && !jsonEqual(c, v) {
+		fail("must be %s", jsonString(c))
+	}
+
+	switch value := v.(type) {
+	case string:
+		length := utf8.RuneCountInString(value)
+		if n, ok := schemaNumber(doc, "minLength"); ok && float64(length) < n {
+			fail("must be at least %v characters long", n)
+		}
+		if n, ok := schemaNumber(doc, "maxLength"); ok && float64(length) > n {
+			fail("must be at most %v characters long", n)
+		}
+		if pattern, ok := doc["pattern"].(string); ok {
+			if rx, err := s.compile(pattern); err != nil {
+				fail("pattern %s is not valid: %v", pattern, err)
+			} else if !rx.MatchString(value) {
+				fail("must match pattern %s", pattern)
+			}
+		}
+	case map[string]interface{}:
+		v = s.applyObject(doc, value, ptr, setDefaults, errs, fail)
+	case []interface{}:
+		v = s.applyArray(doc, value, ptr, setDefaults, errs, fail)
+	default:
+		if n, ok := jsonNumber(v); ok {
+			s.validateNumber(doc, n, fail)
+		}
+	}
+
+	if all, ok := doc["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v = s.apply(sub, v, ptr, setDefaults, errs)
+		}
+	}
+	if anyOf, ok := doc["anyOf"].([]interface{}); ok {
+		found := false
+		for _, sub := range anyOf {
+			if s.matches(sub, v, ptr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must match at least one schema of anyOf")
+		}
+	}
+	if oneOf, ok := doc["oneOf"].([]interface{}); ok {
+		count := 0
+		for _, sub := range oneOf {
+			if s.matches(sub, v, ptr) {
+				count++
+			}
+		}
+		if count != 1 {
+			fail("must match exactly one schema of oneOf, matches %d", count)
+		}
+	}
+	if not, ok := doc["not"]; ok && s.matches(not, v, ptr) {
+		fail("must not match the schema of not")
+	}
+	if cond, ok := doc["if"]; ok {
+		if s.matches(cond, v, ptr) {
+			if then, ok := doc["then"]; ok {
+				v = s.apply(then, v, ptr, setDefaults, errs)
+			}
+		} else if otherwise, ok := doc["else"]; ok {
+			v = s.apply(otherwise, v, ptr, setDefaults, errs)
+		}
+	}
+	return v
+}
+
+func (s *Schema) applyObject(doc, fields map[string]interface{}, ptr string, setDefaults bool,
+	errs *ErrorList, fail func(format string, args ...interface{})) interface{} {
+
+	if required, ok := doc["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, ok := fields[name]; !ok {
+					fail("property %s is required", name)
+				}
+			}
+		}
+	}
+	if n, ok := schemaNumber(doc, "minProperties"); ok && float64(len(fields)) < n {
+		fail("must have at least %v properties", n)
+	}
+	if n, ok := schemaNumber(doc, "maxProperties"); ok && float64(len(fields)) > n {
+		fail("must have at most %v properties", n)
+	}
+	properties, _ := doc["properties"].(map[string]interface{})
+	patternProperties, _ := doc["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := doc["additionalProperties"]
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		propPtr := ptr + "/" + escapeJSONPointer(name)
+		matched := false
+		if property, ok := properties[name]; ok {
+			fields[name] = s.apply(property, fields[name], propPtr, setDefaults, errs)
+			matched = true
+		}
+		for pattern, property := range patternProperties {
+			rx, err := s.compile(pattern)
+			if err != nil {
+				fail("pattern %s is not valid: %v", pattern, err)
+				continue
+			} else if rx.MatchString(name) {
+				fields[name] = s.apply(property, fields[name], propPtr, setDefaults, errs)
+				matched = true
+			}
+		}
+		if matched || !hasAdditional {
+			continue
+		}
+		if allowed, ok := additional.(bool); ok && !allowed {
+			fail("property %s is not allowed", name)
+			continue
+		}
+		fields[name] = s.apply(additional, fields[name], propPtr, setDefaults, errs)
+	}
+	return fields
+}
+
+func (s *Schema) applyArray(doc map[string]interface{}, items []interface{}, ptr string, setDefaults bool,
+	errs *ErrorList, fail func(format string, args ...interface{})) interface{} {
+
+	if n, ok := schemaNumber(doc, "minItems"); ok && float64(len(items)) < n {
+		fail("must have at least %v items", n)
+	}
+	if n, ok := schemaNumber(doc, "maxItems"); ok && float64(len(items)) > n {
+		fail("must have at most %v items", n)
+	}
+	if unique, _ := doc["uniqueItems"].(bool); unique {
+		seen := make(map[string]int, len(items))
+		for i, item := range items {
+			key := jsonString(item)
+			if j, ok := seen[key]; ok {
+				fail("items must be unique, items %d and %d are equal", j, i)
+				break
+			}
+			seen[key] = i
+		}
+	}
+	switch schema := doc["items"].(type) {
+	case nil:
+	case []interface{}:
+		for i := range items {
+			itemPtr := ptr + "/" + strconv.Itoa(i)
+			if i < len(schema) {
+				items[i] = s.apply(schema[i], items[i], itemPtr, setDefaults, errs)
+			} else if additional, ok := doc["additionalItems"]; ok {
+				items[i] = s.apply(additional, items[i], itemPtr, setDefaults, errs)
+			}
+		}
+	default:
+		for i := range items {
+			items[i] = s.apply(schema, items[i], ptr+"/"+strconv.Itoa(i), setDefaults, errs)
+		}
+	}
+	if contains, ok := doc["contains"]; ok {
+		found := false
+		for i, item := range items {
+			if s.matches(contains, item, ptr+"/"+strconv.Itoa(i)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must contain an item matching the schema of contains")
+		}
+	}
+	return items
+}
+
+func (s *Schema) validateNumber(doc map[string]interface{}, n float64, fail func(format string, args ...interface{})) {
+	if min, ok := schemaNumber(doc, "minimum"); ok && n < min {
+		fail("must be at least %v", min)
+	}
+	if max, ok := schemaNumber(doc, "maximum"); ok && n > max {
+		fail("must be at most %v", max)
+	}
+	if min, ok := schemaNumber(doc, "exclusiveMinimum"); ok && n <= min {
+		fail("must be greater than %v", min)
+	}
+	if max, ok := schemaNumber(doc, "exclusiveMaximum"); ok && n >= max {
+		fail("must be less than %v", max)
+	}
+	if m, ok := schemaNumber(doc, "multipleOf"); ok && m > 0 {
+		if q := n / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("must be a multiple of %v", m)
+		}
+	}
+}
+
+// resolveRef resolves references to definitions in the same file, like #/definitions/port.
+func (s *Schema) resolveRef(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		err := fmt.Errorf("$ref %s is not supported, only references within the schema are", ref)
+		return nil, err
+	}
+	target := s.doc
+	for _, token := range strings.Split(strings.TrimPrefix(ref[1:], "/"), "/") {
+		if len(token) == 0 {
+			continue
+		}
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch t := target.(type) {
+		case map[string]interface{}:
+			target = t[token]
+		case []interface{}:
+			idx, err := strconv.Atoi(token)
+			if err != nil || idx < 0 || idx >= len(t) {
+				return nil, fmt.Errorf("$ref %s is not found in the schema", ref)
+			}
+			target = t[idx]
+		default:
+			target = nil
+		}
+		if target == nil {
+			return nil, fmt.Errorf("$ref %s is not found in the schema", ref)
+		}
+	}
+	return target, nil
+}
+
+func (s *Schema) compile(pattern string) (*regexp.Regexp, error) {
+	if rx, ok := s.patterns[pattern]; ok {
+		return rx, nil
+	}
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.patterns[pattern] = rx
+	return rx, nil
+}
+
+// matchesType tells whether the value is of the type, or one of the types listed.
+func matchesType(t, v interface{}) bool {
+	types, ok := t.([]interface{})
+	if !ok {
+		types = []interface{}{t}
+	}
+	actual := jsonTypeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeNames(t interface{}) string {
+	types, ok := t.([]interface{})
+	if !ok {
+		return fmt.Sprintf("%v", t)
+	}
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		names = append(names, fmt.Sprintf("%v", t))
+	}
+	return strings.Join(names, " or ")
+}
+
+// jsonTypeOf returns the JSON type of a context value, numbers without fraction are integers.
+func jsonTypeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string, time.Time:
+		return "string"
+	case map[string]interface{}, map[string]string, Cargo:
+		return "object"
+	case []interface{}:
+		return "array"
+	default:
+		if n, ok := jsonNumber(v); ok {
+			if n == math.Trunc(n) {
+				return "integer"
+			}
+			return "number"
+		}
+		switch reflect.ValueOf(v).Kind() {
+		case reflect.Slice, reflect.Array:
+			return "array"
+		case reflect.Map, reflect.Struct:
+			return "object"
+		}
+		return "string"
+	}
+}
+
+// jsonNumber returns the value of numbers of any Go type.
+func jsonNumber(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func schemaNumber(doc map[string]interface{}, keyword string) (float64, bool) {
+	v, ok := doc[keyword]
+	if !ok {
+		return 0, false
+	}
+	return jsonNumber(v)
+}
+
+// jsonEqual tells whether values are equal as JSON, regardless of Go types of numbers.
+func jsonEqual(a, b interface{}) bool {
+	return jsonString(a) == jsonString(b)
+}
+
+func jsonString(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// copyJSONValue returns a deep copy of a value of the schema, so defaults set in the context
+// are not shared between roots or items.
+func copyJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			fields[k] = copyJSONValue(item)
+		}
+		return fields
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = copyJSONValue(item)
+		}
+		return items
+	}
+	return v
+}
+
+func escapeJSONPointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSchema = `{
+  "type": "object",
+  "required": ["image", "servers"],
+  "properties": {
+    "replicas": {"type": "integer", "minimum": 1, "default": 1},
+    "image": {
+      "type": "object",
+      "properties": {
+        "repository": {"type": "string", "pattern": "^[a-z/]+$"},
+        "tag": {"type": "string", "default": "latest"},
+        "pullPolicy": {"enum": ["Always", "IfNotPresent"]}
+      },
+      "additionalProperties": false
+    },
+    "servers": {
+      "type": "array",
+      "minItems": 1,
+      "items": {"$ref": "#/definitions/server"}
+    }
+  },
+  "definitions": {
+    "server": {
+      "type": "object",
+      "required": ["name"],
+      "properties": {
+        "name": {"type": "string"},
+        "port": {"type": "integer", "maximum": 65535, "default": 80}
+      }
+    }
+  }
+}`
+
+func TestSchemaApply(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "cargo-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "schema.json"), []byte(testSchema), 0644))
+	schemas, err := ParseSchemas(Cargo{"schemas": map[string]interface{}{"Values": "schema.json"}}, dir)
+	if !assert.NoError(err) || !assert.Len(schemas, 1) {
+		return
+	}
+
+	ctx := NewTemplateContext()
+	ctx["Values"] = map[string]interface{}{
+		"image":   map[string]interface{}{"repository": "nginx"},
+		"servers": []interface{}{map[string]interface{}{"name": "web"}},
+	}
+	if !assert.NoError(ctx.Validate(schemas)) {
+		return
+	}
+	assert.Equal(map[string]interface{}{
+		"replicas": float64(1),
+		"image":    map[string]interface{}{"repository": "nginx", "tag": "latest"},
+		"servers":  []interface{}{map[string]interface{}{"name": "web", "port": float64(80)}},
+	}, ctx["Values"])
+
+	ctx["Values"] = map[string]interface{}{
+		"replicas": int64(0),
+		"image":    map[string]interface{}{"repository": "Nginx", "pullPolicy": "Never", "digest": "sha"},
+		"servers":  []interface{}{map[string]interface{}{"port": "80"}},
+	}
+	err = ctx.Validate(schemas)
+	if !assert.Error(err) {
+		return
+	}
+	var messages []string
+	for _, err := range err.(ErrorList) {
+		messages = append(messages, err.Error())
+	}
+	assert.Equal([]string{
+		"Values/image: property digest is not allowed",
+		`Values/image/pullPolicy: must be one of ["Always","IfNotPresent"]`,
+		"Values/image/repository: must match pattern ^[a-z/]+$",
+		"Values/replicas: must be at least 1",
+		"Values/servers/0: property name is required",
+		"Values/servers/0/port: expected integer, found string",
+	}, messages)
+
+	ctx = NewTemplateContext()
+	err = ctx.Validate(schemas)
+	if assert.Error(err) {
+		assert.Equal("Values: property image is required\n\nValues: property servers is required", err.Error())
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+)
+
+func serveCmd(cmd *cli.Cmd) {
+	opts := addRunOptions(cmd)
+	addr := cmd.StringOpt("a addr", "localhost:8000", "Address to serve the rendered site on.")
+	interval := cmd.StringOpt("i interval", "500ms", "Polling interval for changes in sources and context sources.")
+
+	srcDir := cmd.StringArg("SRC", "cargo/", "Specify source files dir for your site.")
+
+	cmd.Spec = "[OPTIONS] SRC"
+	cmd.Action = func() {
+		pollInterval, err := time.ParseDuration(*interval)
+		if err != nil {
+			log.Fatalln("incorrect interval specification:", *interval)
+		}
+		dstDir, err := ioutil.TempDir("", "cargo-serve-")
+		if err != nil {
+			fatalln(err)
+		}
+		defer os.RemoveAll(dstDir)
+
+		w, err := NewWatcher(opts, *srcDir, dstDir)
+		if err != nil {
+			fatalln(err)
+		}
+		if err := w.Build(); err != nil {
+			fatalln(err)
+		}
+		srv := NewPreviewServer(dstDir)
+		w.OnUpdate = srv.Reload
+
+		stop := make(chan struct{})
+		go w.Run(pollInterval, stop)
+		go func() {
+			if err := http.ListenAndServe(*addr, srv); err != nil {
+				log.Errorln(err)
+			}
+			close(stop)
+		}()
+		log.Warningf("serving %s on http://%s", *srcDir, *addr)
+
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-interrupt:
+		case <-stop:
+		}
+	}
+}
+
+// reloadPath is the endpoint of the event stream that notifies browsers about updates.
+const reloadPath = "/_cargo/reload"
+
+const reloadScript = `<script>
+new EventSource("` + reloadPath + `").addEventListener("reload", function() { location.reload(); });
+</script>
+`
+
+// PreviewServer serves files from the root dir, injecting a live reload script
+// into HTML pages. Browsers reload the page on each call of Reload.
+type PreviewServer struct {
+	root  string
+	files http.Handler
+
+	mux     sync.Mutex
+	clients map[chan struct{}]struct{}
+}
+
+func NewPreviewServer(root string) *PreviewServer {
+	return &PreviewServer{
+		root:    root,
+		files:   http.FileServer(http.Dir(root)),
+		clients: make(map[chan struct{}]struct{}),
+	}
+}
+
+// Reload notifies all connected browsers that they should reload the page.
+func (s *PreviewServer) Reload(targets []string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// client has a pending reload already
+		}
+	}
+}
+
+func (s *PreviewServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == reloadPath {
+		s.serveEvents(w, r)
+		return
+	}
+	name := filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		name = filepath.Join(name, "index.html")
+	}
+	if ext := filepath.Ext(name); ext != ".html" && ext != ".htm" {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(name)))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(injectReloadScript(contents))
+}
+
+func (s *PreviewServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan struct{}, 1)
+	s.mux.Lock()
+	s.clients[ch] = struct{}{}
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		delete(s.clients, ch)
+		s.mux.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			fmt.Fprint(w, "event: reload\ndata: {}\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// injectReloadScript puts the reload script right before the closing body tag,
+// or appends it to the page if there is no such tag.
+func injectReloadScript(page []byte) []byte {
+	idx := bytes.LastIndex(bytes.ToLower(page), []byte("</body>"))
+	if idx < 0 {
+		return append(page, reloadScript...)
+	}
+	buf := make([]byte, 0, len(page)+len(reloadScript))
+	buf = append(buf, page[:idx]...)
+	buf = append(buf, reloadScript...)
+	buf = append(buf, page[idx:]...)
+	return buf
+}
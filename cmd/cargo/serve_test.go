@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreviewServerInjectsReloadScript(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "cargo-serve-test-")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "index.html"), []byte("<html><body>hello</body></html>"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "style.css"), []byte("body {}"), 0644)
+
+	srv := httptest.NewServer(NewPreviewServer(root))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if assert.NoError(err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal("<html><body>hello"+reloadScript+"</body></html>", string(body))
+	}
+	resp, err = http.Get(srv.URL + "/style.css")
+	if assert.NoError(err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal("body {}", string(body))
+	}
+}
+
+func TestPreviewServerPushesReload(t *testing.T) {
+	assert := assert.New(t)
+	preview := NewPreviewServer(os.TempDir())
+	srv := httptest.NewServer(preview)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + reloadPath)
+	if !assert.NoError(err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "event:") {
+				events <- line
+			}
+		}
+	}()
+	// wait until the client is subscribed
+	for i := 0; i < 100; i++ {
+		preview.mux.Lock()
+		n := len(preview.clients)
+		preview.mux.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	preview.Reload([]string{"index.html"})
+	select {
+	case event := <-events:
+		assert.Equal("event: reload", event)
+	case <-time.After(5 * time.Second):
+		assert.Fail("no reload event received")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+)
+
+// SignatureExt is the extension of detached signatures, written next to package tarballs.
+const SignatureExt = ".sig"
+
+// TrustedKeysFile lists public keys that packages are trusted from, it is in the cargo home dir.
+const TrustedKeysFile = "trusted-keys.pem"
+
+// trustOptions are shared by all commands that download or install packages.
+type trustOptions struct {
+	TrustedKeys *string
+	Insecure    *bool
+}
+
+func addTrustOptions(cmd *cli.Cmd) *trustOptions {
+	opts := &trustOptions{
+		TrustedKeys: cmd.StringOpt("trusted-keys", "", "PEM file with public ed25519 keys "+
+			"packages are trusted from, defaults to ~/.cargo/"+TrustedKeysFile+"."),
+		Insecure: cmd.BoolOpt("insecure", false, "Accept unsigned packages and packages with invalid signatures."),
+	}
+	return opts
+}
+
+// Verifier returns the verifier of packages with the trusted keys. Trusted keys are
+// optional in insecure mode, so packages can be installed before any key is trusted.
+func (o *trustOptions) Verifier() (*Verifier, error) {
+	path := *o.TrustedKeys
+	if len(path) == 0 {
+		home, err := cargoHome()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, TrustedKeysFile)
+	}
+	keys, err := ReadPublicKeys(path)
+	if os.IsNotExist(err) && *o.Insecure {
+		keys = nil
+	} else if os.IsNotExist(err) {
+		err = fmt.Errorf("trusted keys file %s is not found, add public keys of package authors "+
+			"to it, or pass --insecure", path)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	v := &Verifier{
+		Keys:     keys,
+		Insecure: *o.Insecure,
+	}
+	return v, nil
+}
+
+// ReadPrivateKey reads an ed25519 private key in PKCS #8 PEM format,
+// as generated by openssl genpkey -algorithm ed25519.
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		err := fmt.Errorf("%s: PEM encoded private key is not found", path)
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", path, err)
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		err := fmt.Errorf("%s: private key is not an ed25519 key", path)
+		return nil, err
+	}
+	return edKey, nil
+}
+
+// ReadPublicKeys reads ed25519 public keys in PKIX PEM format, as written by
+// openssl pkey -pubout, the file may have many keys one after another.
+func ReadPublicKeys(path string) ([]ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		} else if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", path, err)
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			log.WithField("path", path).Warningln("skipping public key, it is not an ed25519 key")
+			continue
+		}
+		keys = append(keys, edKey)
+	}
+	return keys, nil
+}
+
+// SignArchive returns the base64 encoded signature of the package tarball.
+func SignArchive(key ed25519.PrivateKey, data []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+}
+
+// readSignature reads the detached signature of the tarball, it's empty if the tarball is not signed.
+func readSignature(path string) (string, error) {
+	data, err := ioutil.ReadFile(path + SignatureExt)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Verifier checks signatures of packages against the trusted keys.
+type Verifier struct {
+	Keys []ed25519.PublicKey
+	// Insecure accepts packages that are unsigned or have invalid signatures, with a warning.
+	Insecure bool
+}
+
+// Verify checks the base64 encoded signature of the package tarball, the package is named in errors.
+func (v *Verifier) Verify(name string, data []byte, signature string) error {
+	var err error
+	if len(signature) == 0 {
+		err = fmt.Errorf("package %s is not signed", name)
+	} else if sig, decodeErr := base64.StdEncoding.DecodeString(signature); decodeErr != nil {
+		err = fmt.Errorf("package %s signature is malformed: %v", name, decodeErr)
+	} else if !v.trusts(data, sig) {
+		err = fmt.Errorf("package %s signature is not valid for any trusted key", name)
+	}
+	if err != nil && v.Insecure {
+		log.Warningln(err, "(--insecure)")
+		return nil
+	}
+	return err
+}
+
+func (v *Verifier) trusts(data, sig []byte) bool {
+	for _, key := range v.Keys {
+		if ed25519.Verify(key, data, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKeyPath returns the path of the key to sign the package with, the path given, or
+// Cargo.keyFile relative to the package dir. The package is not signed if neither is set.
+func (p *Package) signingKeyPath(path string) (string, error) {
+	if len(path) > 0 {
+		return filepath.Abs(path)
+	}
+	v, ok := p.Cargo.Lookup("keyFile")
+	if !ok || v == nil {
+		return "", nil
+	}
+	keyFile, ok := v.(string)
+	if !ok || len(keyFile) == 0 {
+		err := errors.New("Cargo.keyFile must be the path of the private key")
+		return "", err
+	} else if !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(p.Dir, keyFile)
+	}
+	return keyFile, nil
+}
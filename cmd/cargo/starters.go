@@ -0,0 +1,264 @@
+package main
+
+// Starter is a package built into cargo, to scaffold new packages from with cargo init.
+// Files are slash-separated paths relative to the package dir, Cargo has fields added to
+// the generated Cargo section of cargo.yaml, Contexts map names of the context sources in
+// tests/ to their paths, they are passed to cargo run when the fixture is rendered.
+type Starter struct {
+	Name        string
+	Description string
+	Cargo       string
+	Files       map[string]string
+	Contexts    map[string]string
+}
+
+// DefaultStarter is the starter used by cargo init if none is specified.
+const DefaultStarter = "blank"
+
+// starters are listed by cargo init, in this order.
+var starters = []*Starter{
+	blankStarter,
+	staticSiteStarter,
+	goServiceStarter,
+	helmChartStarter,
+}
+
+// FindStarter returns the starter by its name, or nil if there is no such starter.
+func FindStarter(name string) *Starter {
+	for _, starter := range starters {
+		if starter.Name == name {
+			return starter
+		}
+	}
+	return nil
+}
+
+var blankStarter = &Starter{
+	Name:        "blank",
+	Description: "A package with a single template and a collection template.",
+	Files: map[string]string{
+		"cargo/_README.md": `# {{ .Cargo.Name }}
+
+{{ .Cargo.Description }}
+
+Version {{ .Cargo.Version }}, by {{ .Cargo.Author.Name }}.
+
+Items:
+{{ range .Items }}
+* {{ .Name }}: {{ .Description }}
+{{- end }}
+`,
+		"cargo/items/{{.Items.Name}}.txt": `{{ .Current.Name }}: {{ .Current.Description }}
+`,
+		"tests/items.yaml": `- Name: first
+  Description: The first item.
+- Name: second
+  Description: The second item.
+`,
+	},
+	Contexts: map[string]string{
+		"Items": "tests/items.yaml",
+	},
+}
+
+var staticSiteStarter = &Starter{
+	Name:        "static-site",
+	Description: "A static website with a page per item of the Pages collection.",
+	Files: map[string]string{
+		"cargo/_index.html": `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>{{ .Cargo.Name }}</title>
+  <link rel="stylesheet" href="style.css">
+</head>
+<body>
+  <h1>{{ .Cargo.Name }}</h1>
+  <p>{{ .Cargo.Description }}</p>
+  <ul>
+{{- range .Pages }}
+    <li><a href="{{ .Slug }}.html">{{ .Title }}</a></li>
+{{- end }}
+  </ul>
+</body>
+</html>
+`,
+		"cargo/{{.Pages.Slug}}.html": `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>{{ .Current.Title }} - {{ .Cargo.Name }}</title>
+  <link rel="stylesheet" href="style.css">
+</head>
+<body>
+  <p><a href="index.html">{{ .Cargo.Name }}</a></p>
+  <h1>{{ .Current.Title }}</h1>
+  <p>{{ .Current.Body }}</p>
+</body>
+</html>
+`,
+		"cargo/style.css": `body {
+  font-family: sans-serif;
+  margin: 2em auto;
+  max-width: 40em;
+}
+`,
+		"tests/pages.yaml": `- Slug: about
+  Title: About
+  Body: What this site is about.
+- Slug: contact
+  Title: Contact
+  Body: How to get in touch.
+`,
+	},
+	Contexts: map[string]string{
+		"Pages": "tests/pages.yaml",
+	},
+}
+
+var goServiceStarter = &Starter{
+	Name:        "go-service",
+	Description: "A Go HTTP service with a handler per item of the Endpoints collection.",
+	Cargo: `Cargo:
+  parameters:
+    port:
+      type: int
+      description: Port the service listens on
+      default: 8080
+`,
+	Files: map[string]string{
+		"cargo/_go.mod": `module example.com/{{ .Cargo.Name }}
+
+go 1.21
+`,
+		"cargo/_main.go": `package main
+
+import (
+	"log"
+	"net/http"
+)
+
+func main() {
+	mux := http.NewServeMux()
+{{- range .Endpoints }}
+	mux.HandleFunc("{{ .Path }}", {{ .Name }}Handler)
+{{- end }}
+	log.Println("{{ .Cargo.Name }} is listening on :{{ .Params.port }}")
+	log.Fatal(http.ListenAndServe(":{{ .Params.port }}", mux))
+}
+`,
+		"cargo/{{.Endpoints.Name}}.go": `package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// {{ .Current.Name }}Handler serves {{ .Current.Path }}.
+func {{ .Current.Name }}Handler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "{{ .Current.Response }}")
+}
+`,
+		"cargo/_Dockerfile": `FROM golang:1.21 AS build
+WORKDIR /src
+COPY . .
+RUN CGO_ENABLED=0 go build -o /service .
+
+FROM scratch
+COPY --from=build /service /service
+EXPOSE {{ .Params.port }}
+ENTRYPOINT ["/service"]
+`,
+		"tests/endpoints.yaml": `- Name: health
+  Path: /health
+  Response: ok
+- Name: hello
+  Path: /hello
+  Response: Hello, World!
+`,
+	},
+	Contexts: map[string]string{
+		"Endpoints": "tests/endpoints.yaml",
+	},
+}
+
+// helmChartStarter keeps Helm templates verbatim, so their {{ }} actions are left to Helm.
+var helmChartStarter = &Starter{
+	Name:        "helm-chart",
+	Description: "A Helm chart with a ConfigMap per item of the ConfigMaps collection.",
+	Cargo: `Cargo:
+  parameters:
+    image:
+      description: Container image of the application
+      default: nginx
+    replicas:
+      type: int
+      default: 1
+    port:
+      type: int
+      default: 80
+`,
+	Files: map[string]string{
+		"cargo/_Chart.yaml": `apiVersion: v2
+name: {{ .Cargo.Name }}
+description: {{ .Cargo.Description }}
+type: application
+version: {{ .Cargo.Version }}
+appVersion: "{{ .Cargo.Version }}"
+`,
+		"cargo/_values.yaml": `replicaCount: {{ .Params.replicas }}
+image:
+  repository: {{ .Params.image }}
+  tag: latest
+service:
+  port: {{ .Params.port }}
+`,
+		"cargo/templates/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .Release.Name }}
+spec:
+  replicas: {{ .Values.replicaCount }}
+  selector:
+    matchLabels:
+      app: {{ .Release.Name }}
+  template:
+    metadata:
+      labels:
+        app: {{ .Release.Name }}
+    spec:
+      containers:
+        - name: {{ .Chart.Name }}
+          image: "{{ .Values.image.repository }}:{{ .Values.image.tag }}"
+          ports:
+            - containerPort: {{ .Values.service.port }}
+`,
+		"cargo/templates/service.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .Release.Name }}
+spec:
+  selector:
+    app: {{ .Release.Name }}
+  ports:
+    - port: {{ .Values.service.port }}
+`,
+		"cargo/templates/{{.ConfigMaps.Name}}-configmap.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Cargo.Name }}-{{ .Current.Name }}
+data:
+{{- range $key, $value := .Current.Data }}
+  {{ $key }}: {{ $value | quote }}
+{{- end }}
+`,
+		"tests/configmaps.yaml": `- Name: app
+  Data:
+    LOG_LEVEL: info
+    FEATURES: search,export
+`,
+	},
+	Contexts: map[string]string{
+		"ConfigMaps": "tests/configmaps.yaml",
+	},
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+)
+
+func statusCmd(cmd *cli.Cmd) {
+	dstDir := cmd.StringArg("DST", "build/", "Specify destination dir with generated files.")
+
+	cmd.Spec = "[DST]"
+	cmd.Action = func() {
+		drifted, err := printStatus(os.Stdout, *dstDir)
+		if err != nil {
+			log.Fatalln(err)
+		} else if drifted {
+			cli.Exit(1)
+		}
+	}
+}
+
+// printStatus prints generated files that have been modified or deleted since they were generated,
+// reporting whether there are any.
+func printStatus(w io.Writer, dstDir string) (bool, error) {
+	manifest, err := ReadManifest(dstDir)
+	if err != nil {
+		return false, err
+	} else if len(manifest.Files) == 0 {
+		fmt.Fprintln(w, "no generated files recorded in", dstDir)
+		return false, nil
+	}
+	counts := make(map[FileStatus]int, 3)
+	for _, f := range manifest.Files {
+		status, err := f.Status(dstDir)
+		if err != nil {
+			return false, err
+		}
+		counts[status]++
+		if status == FileStatusUnchanged {
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s (from %s)\n", status, f.Path, f.Source)
+	}
+	fmt.Fprintf(w, "%d generated files, %d modified, %d deleted\n", len(manifest.Files),
+		counts[FileStatusModified], counts[FileStatusDeleted])
+	return counts[FileStatusModified] > 0 || counts[FileStatusDeleted] > 0, nil
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// parseTOML parses a TOML document into maps, lists and values: strings, int64, float64, bool,
+// time.Time for offset date-times, and strings for local dates and times.
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	p := &tomlParser{
+		src:  data,
+		root: make(map[string]interface{}),
+	}
+	p.current = p.root
+	if err := p.parse(); err != nil {
+		return nil, fmt.Errorf("line %d: %v", p.line(), err)
+	}
+	return p.root, nil
+}
+
+type tomlParser struct {
+	src     []byte
+	pos     int
+	root    map[string]interface{}
+	current map[string]interface{}
+}
+
+func (p *tomlParser) line() int {
+	return bytes.Count(p.src[:p.pos], []byte("\n")) + 1
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *tomlParser) hasPrefix(s string) bool {
+	return bytes.HasPrefix(p.src[p.pos:], []byte(s))
+}
+
+// skipSpace skips spaces and tabs, and a comment up to the end of line, if any.
+func (p *tomlParser) skipSpace() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+	if p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+}
+
+// skipBlank skips whitespace, comments and line breaks.
+func (p *tomlParser) skipBlank() {
+	for {
+		p.skipSpace()
+		if p.peek() == '\n' || p.peek() == '\r' {
+			p.pos++
+			continue
+		}
+		return
+	}
+}
+
+// endOfLine expects nothing but a comment up to the end of line.
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace()
+	if p.hasPrefix("\r\n") {
+		p.pos += 2
+	} else if p.peek() == '\n' {
+		p.pos++
+	} else if !p.eof() {
+		return fmt.Errorf("unexpected %q after value", p.peek())
+	}
+	return nil
+}
+
+func (p *tomlParser) parse() error {
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+		if p.hasPrefix("[[") {
+			p.pos += 2
+			keys, err := p.parseKey()
+			if err != nil {
+				return err
+			} else if !p.hasPrefix("]]") {
+				return fmt.Errorf("array of tables header must end with ]]")
+			}
+			p.pos += 2
+			if p.current, err = p.appendTable(keys); err != nil {
+				return err
+			}
+		} else if p.peek() == '[' {
+			p.pos++
+			keys, err := p.parseKey()
+			if err != nil {
+				return err
+			} else if p.peek() != ']' {
+				return fmt.Errorf("table header must end with ]")
+			}
+			p.pos++
+			if p.current, err = p.table(p.root, keys); err != nil {
+				return err
+			}
+		} else {
+			keys, err := p.parseKey()
+			if err != nil {
+				return err
+			} else if p.peek() != '=' {
+				return fmt.Errorf("expected = after key %s", strings.Join(keys, "."))
+			}
+			p.pos++
+			p.skipSpace()
+			value, err := p.parseValue()
+			if err != nil {
+				return err
+			} else if err := p.set(p.current, keys, value); err != nil {
+				return err
+			}
+		}
+		if err := p.endOfLine(); err != nil {
+			return err
+		}
+	}
+}
+
+// table returns the table at keys, creating missing tables. The last table
+// of an array of tables is taken, when the keys lead to the array.
+func (p *tomlParser) table(t map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, key := range keys {
+		switch v := t[key].(type) {
+		case nil:
+			next := make(map[string]interface{})
+			t[key] = next
+			t = next
+		case map[string]interface{}:
+			t = v
+		case []interface{}:
+			last, ok := v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("key %s is an array, not a table", key)
+			}
+			t = last
+		default:
+			return nil, fmt.Errorf("key %s is a value, not a table", key)
+		}
+	}
+	return t, nil
+}
+
+// appendTable appends a new table to the array of tables at keys.
+func (p *tomlParser) appendTable(keys []string) (map[string]interface{}, error) {
+	parent, err := p.table(p.root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	key := keys[len(keys)-1]
+	next := make(map[string]interface{})
+	switch v := parent[key].(type) {
+	case nil:
+		parent[key] = []interface{}{next}
+	case []interface{}:
+		parent[key] = append(v, next)
+	default:
+		return nil, fmt.Errorf("key %s is not an array of tables", key)
+	}
+	return next, nil
+}
+
+// set sets the value of dotted keys, the keys must not be defined before.
+func (p *tomlParser) set(t map[string]interface{}, keys []string, value interface{}) error {
+	t, err := p.table(t, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	key := keys[len(keys)-1]
+	if _, ok := t[key]; ok {
+		return fmt.Errorf("key %s is defined twice", strings.Join(keys, "."))
+	}
+	t[key] = value
+	return nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// parseKey parses a dotted key of bare and quoted parts.
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace()
+		var key string
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.parseBasicString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		case c == '\'':
+			s, err := p.parseLiteralString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		case isBareKeyChar(c):
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			key = string(p.src[start:p.pos])
+		default:
+			return nil, fmt.Errorf("expected key, found %q", c)
+		}
+		keys = append(keys, key)
+		p.skipSpace()
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	switch {
+	case p.hasPrefix(`"""`):
+		return p.parseMultilineString(`"""`, true)
+	case p.hasPrefix("'''"):
+		return p.parseMultilineString("'''", false)
+	case p.peek() == '"':
+		return p.parseBasicString()
+	case p.peek() == '\'':
+		return p.parseLiteralString()
+	case p.peek() == '[':
+		return p.parseArray()
+	case p.peek() == '{':
+		return p.parseInlineTable()
+	case p.hasPrefix("true") && !p.bareAt(4):
+		p.pos += 4
+		return true, nil
+	case p.hasPrefix("false") && !p.bareAt(5):
+		p.pos += 5
+		return false, nil
+	}
+	return p.parseScalar()
+}
+
+// bareAt reports whether the char at offset from pos continues a bare token.
+func (p *tomlParser) bareAt(offset int) bool {
+	return p.pos+offset < len(p.src) && isBareKeyChar(p.src[p.pos+offset])
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	p.pos++
+	var buf strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", fmt.Errorf("string is not terminated")
+		}
+		c := p.peek()
+		if c == '"' {
+			p.pos++
+			return buf.String(), nil
+		} else if c == '\\' {
+			if err := p.parseEscape(&buf); err != nil {
+				return "", err
+			}
+			continue
+		}
+		buf.WriteByte(c)
+		p.pos++
+	}
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	p.pos++
+	start := p.pos
+	for !p.eof() && p.peek() != '\'' {
+		if p.peek() == '\n' {
+			return "", fmt.Errorf("string is not terminated")
+		}
+		p.pos++
+	}
+	if p.eof() {
+		return "", fmt.Errorf("string is not terminated")
+	}
+	s := string(p.src[start:p.pos])
+	p.pos++
+	return s, nil
+}
+
+// parseMultilineString parses a multi-line string, the line break right after the opening
+// delimiter is trimmed. In basic strings, a backslash at the end of line trims the whitespace after it.
+func (p *tomlParser) parseMultilineString(delim string, basic bool) (string, error) {
+	p.pos += len(delim)
+	if p.hasPrefix("\r\n") {
+		p.pos += 2
+	} else if p.peek() == '\n' {
+		p.pos++
+	}
+	var buf strings.Builder
+	for {
+		if p.eof() {
+			return "", fmt.Errorf("string is not terminated")
+		}
+		if p.hasPrefix(delim) {
+			// up to two quotes right before the closing delimiter belong to the string
+			extra := 0
+			for extra < 2 && p.pos+len(delim)+extra < len(p.src) && p.src[p.pos+len(delim)+extra] == delim[0] {
+				extra++
+			}
+			buf.Write(p.src[p.pos : p.pos+extra])
+			p.pos += len(delim) + extra
+			return buf.String(), nil
+		}
+		c := p.peek()
+		if basic && c == '\\' {
+			rest := p.pos + 1
+			for rest < len(p.src) && (p.src[rest] == ' ' || p.src[rest] == '\t') {
+				rest++
+			}
+			if rest < len(p.src) && (p.src[rest] == '\n' || p.src[rest] == '\r') {
+				p.pos = rest
+				for !p.eof() && strings.IndexByte(" \t\r\n", p.peek()) >= 0 {
+					p.pos++
+				}
+				continue
+			}
+			if err := p.parseEscape(&buf); err != nil {
+				return "", err
+			}
+			continue
+		}
+		buf.WriteByte(c)
+		p.pos++
+	}
+}
+
+func (p *tomlParser) parseEscape(buf *strings.Builder) error {
+	p.pos++
+	if p.eof() {
+		return fmt.Errorf("string is not terminated")
+	}
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'b':
+		buf.WriteByte('\b')
+	case 't':
+		buf.WriteByte('\t')
+	case 'n':
+		buf.WriteByte('\n')
+	case 'f':
+		buf.WriteByte('\f')
+	case 'r':
+		buf.WriteByte('\r')
+	case 'e':
+		buf.WriteByte(0x1b)
+	case '"', '\\':
+		buf.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			return fmt.Errorf("invalid unicode escape")
+		}
+		code, err := strconv.ParseUint(string(p.src[p.pos:p.pos+n]), 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return fmt.Errorf("invalid unicode escape \\%c%s", c, p.src[p.pos:p.pos+n])
+		}
+		buf.WriteRune(rune(code))
+		p.pos += n
+	default:
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+func (p *tomlParser) parseArray() ([]interface{}, error) {
+	p.pos++
+	values := make([]interface{}, 0)
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return values, nil
+		default:
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (map[string]interface{}, error) {
+	p.pos++
+	t := make(map[string]interface{})
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.pos++
+		return t, nil
+	}
+	for {
+		keys, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		} else if p.peek() != '=' {
+			return nil, fmt.Errorf("expected = after key %s", strings.Join(keys, "."))
+		}
+		p.pos++
+		p.skipSpace()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		} else if err := p.set(t, keys, value); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return t, nil
+		default:
+			return nil, fmt.Errorf("expected , or } in inline table")
+		}
+	}
+}
+
+var (
+	tomlDateRx    = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	tomlIntRx     = regexp.MustCompile(`^[+-]?(0|[1-9](_?\d)*)$`)
+	tomlFloatRx   = regexp.MustCompile(`^[+-]?(0|[1-9](_?\d)*)(\.\d(_?\d)*)?([eE][+-]?\d(_?\d)*)?$`)
+	tomlLocalRx   = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?)?|\d{2}:\d{2}(:\d{2}(\.\d+)?)?)$`)
+	tomlPrefixInt = map[string]int{"0x": 16, "0o": 8, "0b": 2}
+)
+
+// parseScalar parses numbers and date-times.
+func (p *tomlParser) parseScalar() (interface{}, error) {
+	start := p.pos
+	for !p.eof() && strings.IndexByte(" \t\r\n,]}#", p.peek()) < 0 {
+		p.pos++
+	}
+	token := string(p.src[start:p.pos])
+	// date and time may be separated with a space
+	if tomlDateRx.MatchString(token) && p.peek() == ' ' && p.pos+1 < len(p.src) &&
+		p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9' {
+		p.pos++
+		for !p.eof() && strings.IndexByte(" \t\r\n,]}#", p.peek()) < 0 {
+			p.pos++
+		}
+		token = string(p.src[start:p.pos])
+	}
+	switch strings.TrimLeft(token, "+-") {
+	case "inf":
+		if strings.HasPrefix(token, "-") {
+			return math.Inf(-1), nil
+		}
+		return math.Inf(1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	if len(token) > 2 {
+		if base, ok := tomlPrefixInt[token[:2]]; ok {
+			n, err := strconv.ParseInt(strings.Replace(token[2:], "_", "", -1), base, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer %s", token)
+			}
+			return n, nil
+		}
+	}
+	if tomlIntRx.MatchString(token) {
+		n, err := strconv.ParseInt(strings.Replace(token, "_", "", -1), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %s", token)
+		}
+		return n, nil
+	} else if tomlFloatRx.MatchString(token) {
+		f, err := strconv.ParseFloat(strings.Replace(token, "_", "", -1), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float %s", token)
+		}
+		return f, nil
+	}
+	normalized := strings.Replace(token, " ", "T", 1)
+	if t, err := time.Parse(time.RFC3339Nano, strings.ToUpper(normalized)); err == nil {
+		return t, nil
+	} else if tomlLocalRx.MatchString(token) {
+		return token, nil
+	}
+	if len(token) == 0 {
+		return nil, fmt.Errorf("expected value")
+	}
+	return nil, fmt.Errorf("invalid value %s", token)
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// AnswersPath is the path of the record of the package installed into the destination dir,
+// with values of its parameters, relative to the destination dir.
+const AnswersPath = ".cargo/answers.yaml"
+
+// UpgradeStatePath is the path of the record of an upgrade stopped on conflicts,
+// relative to the destination dir. It's removed when the upgrade is continued.
+const UpgradeStatePath = ".cargo/upgrade.yaml"
+
+func upgradeCmd(cmd *cli.Cmd) {
+	opts := addRunOptions(cmd)
+	dryRun := cmd.BoolOpt("d dry-run", false, "Do not modify filesystem, only print planned actions and conflicts.")
+	to := cmd.StringOpt("to", "", "Semver constraint of the version to upgrade to, the latest version by default.")
+	resume := cmd.BoolOpt("continue", false, "Finish the upgrade stopped on conflicts, once they are resolved.")
+	trust := addTrustOptions(cmd)
+
+	dstDir := cmd.StringArg("DST", ".", "Specify the destination dir the package has been installed into.")
+
+	cmd.Spec = "[OPTIONS] [DST]"
+	cmd.Action = func() {
+		if *resume {
+			state, err := ContinueUpgrade(*dstDir)
+			if err != nil {
+				fatalln(err)
+			}
+			fmt.Printf("upgraded %s from %s to %s\n", state.Package, state.From, state.To)
+			return
+		}
+		if state, err := ReadUpgradeState(*dstDir); err == nil {
+			err := fmt.Errorf("upgrade of %s from %s to %s is stopped on conflicts, resolve them "+
+				"and run cargo upgrade --continue", state.Package, state.From, state.To)
+			fatalln(err)
+		} else if !os.IsNotExist(err) {
+			fatalln(err)
+		}
+		record, err := ReadInstallRecord(*dstDir)
+		if err != nil {
+			fatalln(err)
+		}
+		config, err := opts.PassConfig("", *dstDir)
+		if err != nil {
+			fatalln(err)
+		}
+		// the context specified overrides cargo.yaml of the package and its dependencies
+		if config.Sources, _, err = opts.specifiedSources(); err != nil {
+			fatalln(err)
+		}
+		repos, err := LoadRepoConfig("")
+		if err != nil {
+			fatalln(err)
+		}
+		verifier, err := trust.Verifier()
+		if err != nil {
+			fatalln(err)
+		}
+		upgrade, err := PlanUpgrade(config, repos, verifier, record, *to)
+		if err != nil {
+			fatalln(err)
+		} else if upgrade.To == nil {
+			fmt.Printf("%s is up to date at %s\n", record.Package, record.Version)
+			return
+		}
+		if *dryRun {
+			fmt.Println(upgrade.Queue.Description(fmt.Sprintf("Upgrade %s from %s to %s",
+				record.Package, upgrade.From.Version, upgrade.To.Version)))
+			upgrade.printConflicts()
+			return
+		}
+		ts := time.Now()
+		if !upgrade.Queue.Exec(*dstDir) {
+			log.Fatalf("failed in %v", time.Since(ts))
+		}
+		if len(upgrade.Conflicts) > 0 {
+			upgrade.printConflicts()
+			log.Errorf("upgrade to %s stopped on %d conflicts, resolve them and run cargo upgrade --continue",
+				upgrade.To.Version, len(upgrade.Conflicts))
+			cli.Exit(1)
+		}
+		log.Infoln("upgraded", record.Package, "to", upgrade.To.Version, "in", time.Since(ts))
+	}
+}
+
+// InstallRecord is the package installed into the destination dir, with values of its
+// parameters given and prompted for. It's written into answers.yaml, where the fields
+// of the record are prefixed with "_", so the file can be passed to --answers as it is.
+type InstallRecord struct {
+	Package string `json:"_package"`
+	Version string `json:"_version"`
+	// Repo is the repository the package has been installed from, it's empty for local packages.
+	Repo string           `json:"_repo,omitempty"`
+	Only []string         `json:"_only,omitempty"`
+	Lock []*LockedPackage `json:"_lock,omitempty"`
+
+	Params map[string]interface{} `json:"-"`
+}
+
+// ReadInstallRecord reads answers.yaml of the destination dir.
+func ReadInstallRecord(dstDir string) (*InstallRecord, error) {
+	path := filepath.Join(dstDir, AnswersPath)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err := fmt.Errorf("%s is not found, no package has been installed by cargo install", path)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	record := new(InstallRecord)
+	if err := yaml.Unmarshal(data, record); err != nil {
+		err = fmt.Errorf("error loading %s: %v", path, err)
+		return nil, err
+	} else if len(record.Package) == 0 || len(record.Version) == 0 {
+		err := fmt.Errorf("error loading %s: _package and _version are required", path)
+		return nil, err
+	}
+	if record.Params, err = ReadAnswers(path); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Action returns a queue action that writes answers.yaml into the destination dir.
+// Fields of the record go first, followed by parameters sorted by name.
+func (r *InstallRecord) Action(dstDir string) (QueueAction, error) {
+	doc := yamlv2.MapSlice{
+		{Key: "_package", Value: r.Package},
+		{Key: "_version", Value: r.Version},
+	}
+	if len(r.Repo) > 0 {
+		doc = append(doc, yamlv2.MapItem{Key: "_repo", Value: r.Repo})
+	}
+	if len(r.Only) > 0 {
+		doc = append(doc, yamlv2.MapItem{Key: "_only", Value: r.Only})
+	}
+	if len(r.Lock) > 0 {
+		doc = append(doc, yamlv2.MapItem{Key: "_lock", Value: r.Lock})
+	}
+	names := make([]string, 0, len(r.Params))
+	for name := range r.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		doc = append(doc, yamlv2.MapItem{Key: name, Value: r.Params[name]})
+	}
+	data, err := yamlv2.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return writeFileAction(dstDir, filepath.Join(dstDir, AnswersPath), data), nil
+}
+
+// UpgradeState is an upgrade stopped on conflicts, the files upgraded are in place already,
+// but conflicts have to be resolved by hand before the upgrade is continued.
+type UpgradeState struct {
+	Package   string             `json:"package"`
+	From      string             `json:"from"`
+	To        string             `json:"to"`
+	Conflicts []*UpgradeConflict `json:"conflicts"`
+}
+
+// UpgradeConflict is a file changed both in the destination dir and upstream, that
+// can't be merged automatically. Path is slash-separated, relative to the destination dir.
+type UpgradeConflict struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	// Marked conflicts are written into the file between conflict markers.
+	Marked bool `json:"marked,omitempty"`
+}
+
+// ReadUpgradeState reads the upgrade stopped in the destination dir.
+func ReadUpgradeState(dstDir string) (*UpgradeState, error) {
+	path := filepath.Join(dstDir, UpgradeStatePath)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := new(UpgradeState)
+	if err := yaml.Unmarshal(data, state); err != nil {
+		err = fmt.Errorf("error loading %s: %v", path, err)
+		return nil, err
+	}
+	return state, nil
+}
+
+// ContinueUpgrade finishes the upgrade stopped on conflicts, if there are no conflict markers left.
+func ContinueUpgrade(dstDir string) (*UpgradeState, error) {
+	state, err := ReadUpgradeState(dstDir)
+	if os.IsNotExist(err) {
+		err := fmt.Errorf("no upgrade is stopped in %s", dstDir)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	var errs ErrorList
+	for _, conflict := range state.Conflicts {
+		if !conflict.Marked {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dstDir, filepath.FromSlash(conflict.Path)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			errs.Add(err)
+		} else if HasConflictMarkers(data) {
+			errs.Add(fmt.Errorf("%s: conflict markers are left", conflict.Path))
+		}
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(filepath.Join(dstDir, UpgradeStatePath)); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Upgrade is a planned upgrade of the package installed into the destination dir.
+type Upgrade struct {
+	DstDir string
+	From   *InstallRecord
+	// To is the record of the version upgraded to, it's nil if the package is up to date.
+	To        *InstallRecord
+	Conflicts []*UpgradeConflict
+	// Queue has actions that write merged files, the manifest, answers.yaml, and the upgrade
+	// state if there are conflicts.
+	Queue Queue
+}
+
+// PlanUpgrade renders the version of the package installed and the latest version that satisfies
+// the constraint, both from the cached repositories, then merges the changes between them into the
+// files of the destination dir, as in a three-way merge. The recorded values of parameters are used,
+// values of the config override them for the new version, parameters added are prompted for.
+func PlanUpgrade(config *PassConfig, repos *RepoConfig, verifier *Verifier,
+	record *InstallRecord, constraint string) (*Upgrade, error) {
+
+	installed := &PackageDependency{
+		Name:    record.Package,
+		Repo:    record.Repo,
+		Version: "=" + record.Version,
+	}
+	if err := installed.compile(); err != nil {
+		err = fmt.Errorf("%s: %v", AnswersPath, err)
+		return nil, err
+	}
+	oldLocked, oldPkg, err := repos.FindPackage(installed, AnswersPath)
+	if err != nil {
+		return nil, err
+	}
+	// packages are upgraded from the same repository they have been installed from
+	latest := &PackageDependency{
+		Name:    record.Package,
+		Repo:    oldLocked.Repo,
+		Version: constraint,
+	}
+	if err := latest.compile(); err != nil {
+		err = fmt.Errorf("--to: %v", err)
+		return nil, err
+	}
+	newLocked, newPkg, err := repos.FindPackage(latest, "--to")
+	if err != nil {
+		return nil, err
+	}
+	u := &Upgrade{
+		DstDir: config.DstDir,
+		From:   record,
+	}
+	if newLocked.Version == record.Version {
+		return u, nil
+	}
+	log.WithFields(log.Fields{
+		"repo": newLocked.Repo,
+		"from": record.Version,
+	}).Infoln("upgrading", record.Package, "to", newLocked.Version)
+
+	oldConfig := *config
+	oldConfig.Force = true
+	oldConfig.Params = copyParams(record.Params)
+	oldConfig.Overrides = contextOverrides(config.Overrides)
+	oldConfig.ParamPrompt = nil
+	oldPass, err := newUpgradePass(&oldConfig, repos, verifier, oldLocked, oldPkg, record.Lock, record.Only)
+	if err != nil {
+		err = fmt.Errorf("%s %s: %v", record.Package, record.Version, err)
+		return nil, err
+	}
+	newConfig := *config
+	newConfig.Force = true
+	newConfig.Params = copyParams(record.Params)
+	for name, value := range config.Params {
+		newConfig.Params[name] = value
+	}
+	newPass, err := newUpgradePass(&newConfig, repos, verifier, newLocked, newPkg, record.Lock, record.Only)
+	if err != nil {
+		err = fmt.Errorf("%s %s: %v", record.Package, newLocked.Version, err)
+		return nil, err
+	}
+	u.To = &InstallRecord{
+		Package: record.Package,
+		Version: newLocked.Version,
+		Repo:    newLocked.Repo,
+		Only:    record.Only,
+		Lock:    newPass.lock,
+		Params:  newConfig.Params,
+	}
+	if err := u.plan(oldPass.Pass, newPass.Pass); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// upgradePass is a pass rendering a version of the package, with the lock of its dependencies.
+type upgradePass struct {
+	*Pass
+	lock []*LockedPackage
+}
+
+func newUpgradePass(config *PassConfig, repos *RepoConfig, verifier *Verifier, locked *LockedPackage,
+	pkg *Package, lockHint []*LockedPackage, only []string) (*upgradePass, error) {
+
+	if err := repos.VerifyCached(locked, verifier); err != nil {
+		return nil, err
+	}
+	entries, err := pkg.Select(only)
+	if err != nil {
+		return nil, err
+	}
+	p := new(upgradePass)
+	var deps []*Package
+	if len(pkg.Dependencies) > 0 {
+		var lock *Lock
+		if lock, deps, err = repos.resolveVerified(pkg, &Lock{Packages: lockHint}, verifier); err != nil {
+			return nil, err
+		}
+		p.lock = lock.Packages
+	}
+	if p.Pass, err = pkg.NewPass(config, deps, entries, nil); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// plan merges the outputs of the new version into the destination dir, as changes to the outputs of
+// the old version. Files left as generated by the old version are replaced, or deleted, files edited
+// are merged, and those that can't be merged are conflicts.
+func (u *Upgrade) plan(oldPass, newPass *Pass) error {
+	label := fmt.Sprintf("%s %s", u.To.Package, u.To.Version)
+	u.Queue = NewQueue(NewDirAction(u.DstDir, u.DstDir))
+	oldOutputs := make(map[string]*Output)
+	for _, output := range oldPass.Outputs() {
+		oldOutputs[output.Target] = output
+	}
+	newTargets := make(map[string]struct{})
+	for _, output := range newPass.Outputs() {
+		newTargets[output.Target] = struct{}{}
+		theirs, err := outputContents(output)
+		if err != nil {
+			return err
+		}
+		var base []byte
+		old, inBase := oldOutputs[output.Target]
+		if inBase {
+			if base, err = outputContents(old); err != nil {
+				return err
+			}
+		}
+		ours, err := ioutil.ReadFile(output.Target)
+		exists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		relPath, err := filepath.Rel(u.DstDir, output.Target)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		switch {
+		case exists && bytes.Equal(ours, theirs):
+		case exists && newPass.Rules.PolicyFor(relPath) == ConflictSkip:
+		case inBase && bytes.Equal(base, theirs):
+			// not changed upstream, the file is kept as it is, or as deleted
+		case !exists && inBase:
+			u.conflict(relPath, "changed upstream, but deleted in DST, kept deleted", false)
+		case !exists, inBase && bytes.Equal(ours, base):
+			if output.IsCopy() {
+				u.Queue = append(u.Queue, CopyFileAction(u.DstDir, output.Target, output.Source))
+			} else {
+				u.Queue = append(u.Queue, writeFileAction(u.DstDir, output.Target, theirs))
+			}
+		case isBinary(base) || isBinary(ours) || isBinary(theirs):
+			u.conflict(relPath, "binary file changed upstream and edited in DST, kept as edited", false)
+		default:
+			merged, conflicts := Merge3(base, ours, theirs, "DST", label)
+			u.Queue = append(u.Queue, OverwriteFileAction(u.DstDir, output.Target, merged))
+			if conflicts > 0 {
+				u.conflict(relPath, fmt.Sprintf("%d conflicts between edits in DST and changes upstream", conflicts), true)
+			}
+		}
+	}
+	var deleted []*ManifestFile
+	for _, output := range oldPass.Outputs() {
+		if _, ok := newTargets[output.Target]; ok {
+			continue
+		}
+		base, err := outputContents(output)
+		if err != nil {
+			return err
+		}
+		ours, err := ioutil.ReadFile(output.Target)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(u.DstDir, output.Target)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if !bytes.Equal(ours, base) {
+			u.conflict(relPath, "deleted upstream, but edited in DST, kept as edited", false)
+			continue
+		}
+		u.Queue = append(u.Queue, DeleteFileAction(u.DstDir, output.Target))
+		deleted = append(deleted, &ManifestFile{Path: relPath})
+	}
+	newPass.Manifest.Remove(deleted)
+	manifestAction, err := newPass.Manifest.Action(u.DstDir)
+	if err != nil {
+		return err
+	}
+	recordAction, err := u.To.Action(u.DstDir)
+	if err != nil {
+		return err
+	}
+	u.Queue = append(u.Queue, manifestAction, recordAction)
+	if len(u.Conflicts) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(&UpgradeState{
+		Package:   u.To.Package,
+		From:      u.From.Version,
+		To:        u.To.Version,
+		Conflicts: u.Conflicts,
+	})
+	if err != nil {
+		return err
+	}
+	statePath := filepath.Join(u.DstDir, UpgradeStatePath)
+	u.Queue = append(u.Queue, CreateNewFileAction(u.DstDir, statePath, data))
+	return nil
+}
+
+func (u *Upgrade) conflict(path, reason string, marked bool) {
+	u.Conflicts = append(u.Conflicts, &UpgradeConflict{
+		Path:   path,
+		Reason: reason,
+		Marked: marked,
+	})
+}
+
+func (u *Upgrade) printConflicts() {
+	if len(u.Conflicts) == 0 {
+		return
+	}
+	lines := make([]string, 0, len(u.Conflicts))
+	for _, conflict := range u.Conflicts {
+		lines = append(lines, fmt.Sprintf("  %s: %s", conflict.Path, conflict.Reason))
+	}
+	fmt.Fprintf(os.Stderr, "Conflicts:\n%s\n", strings.Join(lines, "\n"))
+}
+
+// outputContents returns the contents of the output, reading the source of verbatim copies.
+func outputContents(output *Output) ([]byte, error) {
+	if output.IsCopy() {
+		return ioutil.ReadFile(output.Source)
+	}
+	return output.Contents, nil
+}
+
+// writeFileAction returns an action that writes the file, whether it exists or not.
+func writeFileAction(dstDir, path string, contents []byte) QueueAction {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return CreateNewFileAction(dstDir, path, contents)
+	}
+	return OverwriteFileAction(dstDir, path, contents)
+}
+
+func copyParams(params map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(params))
+	for name, value := range params {
+		copied[name] = value
+	}
+	return copied
+}
+
+// contextOverrides returns overrides of paths within context roots, leaving out those with plain
+// names, which set parameters given for the new version that the old one might not declare.
+func contextOverrides(overrides []*ContextOverride) []*ContextOverride {
+	var paths []*ContextOverride
+	for _, o := range overrides {
+		if segments, err := parseOverridePath(o.Path); err == nil && len(segments) > 1 {
+			paths = append(paths, o)
+		}
+	}
+	return paths
+}
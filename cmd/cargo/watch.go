@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/jawher/mow.cli"
+	log "github.com/sirupsen/logrus"
+)
+
+func watchCmd(cmd *cli.Cmd) {
+	opts := addRunOptions(cmd)
+	interval := cmd.StringOpt("i interval", "500ms", "Polling interval for changes in sources and context sources.")
+	onConflict := addConflictOption(cmd)
+	force := addForceOption(cmd)
+
+	srcDir := cmd.StringArg("SRC", "cargo/", "Specify source files dir for your site.")
+	dstDir := cmd.StringArg("DST", "build/", "Specify destination dir for your site publication.")
+
+	cmd.Spec = "[OPTIONS] SRC [DST]"
+	cmd.Action = func() {
+		pollInterval, err := time.ParseDuration(*interval)
+		if err != nil {
+			log.Fatalln("incorrect interval specification:", *interval)
+		}
+		w, err := NewWatcher(opts, *srcDir, *dstDir)
+		if err != nil {
+			fatalln(err)
+		}
+		w.Rules, err = NewConflictRules(*onConflict, w.renderer.Context.Global())
+		if err != nil {
+			fatalln(err)
+		}
+		w.Rules.Prompt = NewOverwritePrompt(os.Stdin, os.Stderr)
+		w.Rules.Force = *force
+		if err := w.Build(); err != nil {
+			fatalln(err)
+		}
+		log.Infoln("watching for changes in", *srcDir)
+		w.Run(pollInterval, nil)
+	}
+}
+
+// Watcher keeps the destination dir up to date with sources and context sources,
+// re-rendering only the sources affected by each change.
+type Watcher struct {
+	// OnUpdate is called after each update with the list of targets written.
+	OnUpdate func(targets []string)
+	// Rules resolve policies for targets that exist already.
+	Rules *ConflictRules
+
+	renderer *Renderer
+	dstDir   string
+	config   *PassConfig
+
+	srcFiles fileSnapshot
+	ctxFiles fileSnapshot
+	// extFiles are partials and layouts outside the source dir
+	extFiles fileSnapshot
+	manifest *Manifest
+}
+
+func NewWatcher(opts *runOptions, srcDir, dstDir string) (*Watcher, error) {
+	config, err := opts.PassConfig(srcDir, dstDir)
+	if err != nil {
+		return nil, err
+	}
+	renderer, err := config.NewRenderer()
+	if err != nil {
+		return nil, err
+	}
+	// values of parameters are asked for once, on start
+	config.ParamPrompt = nil
+	w := &Watcher{
+		renderer: renderer,
+		dstDir:   dstDir,
+		config:   config,
+	}
+	return w, nil
+}
+
+// Build renders all sources and publishes them, taking a snapshot of files to watch.
+func (w *Watcher) Build() error {
+	if err := w.snapshot(); err != nil {
+		return err
+	}
+	manifest, err := ReadManifest(w.dstDir)
+	if err != nil {
+		return err
+	}
+	w.manifest = manifest
+	if w.Rules != nil {
+		w.Rules.Manifest = manifest
+	}
+	outputs, err := w.renderer.RenderAll()
+	if err != nil {
+		return err
+	}
+	return w.publish(outputs)
+}
+
+// Run polls for changes with the given interval, until stop is closed.
+func (w *Watcher) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := w.Poll(); err != nil {
+				logError(err)
+			}
+		}
+	}
+}
+
+type sourceRef struct {
+	Mode   TemplateMode
+	Source string
+}
+
+// Poll checks sources and context sources for changes since the last poll
+// and re-renders the affected sources.
+func (w *Watcher) Poll() error {
+	srcFiles, err := snapshotTree(w.renderer.srcDir)
+	if err != nil {
+		return err
+	}
+	ctxFiles := snapshotFiles(w.config.Sources)
+	extFiles := snapshotPaths(w.externalFiles())
+	srcAdded, srcRemoved, srcChanged := w.srcFiles.Diff(srcFiles)
+	ctxAdded, ctxRemoved, ctxChanged := w.ctxFiles.Diff(ctxFiles)
+	extAdded, extRemoved, extChanged := w.extFiles.Diff(extFiles)
+	w.srcFiles, w.ctxFiles, w.extFiles = srcFiles, ctxFiles, extFiles
+
+	var refs []sourceRef
+	seen := make(map[string]struct{})
+	addRef := func(mode TemplateMode, source string) {
+		if _, ok := seen[source]; ok {
+			return
+		}
+		seen[source] = struct{}{}
+		refs = append(refs, sourceRef{mode, source})
+	}
+
+	var reloadPartials, reloadTemplates bool
+	ctxChanged = append(ctxChanged, ctxAdded...)
+	ctxChanged = append(ctxChanged, ctxRemoved...)
+	if len(ctxChanged) > 0 {
+		rootContext, err := w.config.LoadContext()
+		if err != nil {
+			return err
+		}
+		w.renderer.Context = rootContext
+		roots := make(map[string]struct{})
+		for _, path := range ctxChanged {
+			log.WithField("path", path).Infoln("context source changed")
+			for _, source := range w.config.Sources {
+				if source.Path != path {
+					continue
+				}
+				for _, root := range source.Roots() {
+					roots[root] = struct{}{}
+				}
+			}
+		}
+		if _, ok := roots["Cargo"]; ok {
+			// partials and parameters might have been changed in the global context
+			reloadPartials = true
+			roots["Params"] = struct{}{}
+		}
+		for _, mode := range []TemplateMode{TemplateModeSingle, TemplateModeCollection} {
+			w.renderer.Loader.ForEachSource(mode, func(source string) error {
+				if w.dependsOn(mode, source, roots) {
+					addRef(mode, source)
+				}
+				return nil
+			})
+		}
+	}
+	extChanged = append(extChanged, extAdded...)
+	extChanged = append(extChanged, extRemoved...)
+	for _, path := range extChanged {
+		if w.renderer.Loader.IsPartial(path) {
+			log.WithField("path", path).Infoln("partial changed")
+			reloadPartials = true
+		} else {
+			log.WithField("path", path).Infoln("layout changed")
+			reloadTemplates = true
+		}
+	}
+	for _, path := range srcRemoved {
+		if w.renderer.Loader.IsLayout(path) {
+			log.WithField("path", path).Infoln("layout removed")
+			w.renderer.Loader.RemoveLayout(path)
+			reloadTemplates = true
+		} else if _, ok := w.renderer.Loader.RemoveSource(path); ok {
+			log.WithField("path", path).Infoln("source removed, its outputs are kept")
+		}
+	}
+	for _, path := range srcAdded {
+		if w.renderer.Loader.isLayoutFile(path) {
+			log.WithField("path", path).Infoln("layout added")
+			w.renderer.Loader.AddLayout(path)
+			reloadTemplates = true
+			continue
+		}
+		mode, err := w.renderer.Loader.AddSource(path)
+		if err != nil {
+			logError(err)
+			continue
+		}
+		log.WithField("path", path).Infoln("source added")
+		addRef(mode, path)
+	}
+	for _, path := range srcChanged {
+		if w.renderer.Loader.IsPartial(path) {
+			log.WithField("path", path).Infoln("partial changed")
+			reloadPartials = true
+			continue
+		}
+		if w.renderer.Loader.IsLayout(path) {
+			log.WithField("path", path).Infoln("layout changed")
+			reloadTemplates = true
+			continue
+		}
+		mode, _ := w.renderer.Loader.SourceMode(path)
+		if err := w.renderer.Loader.ReloadSource(path); err != nil {
+			logError(err)
+			continue
+		}
+		log.WithField("path", path).Infoln("source changed")
+		addRef(mode, path)
+	}
+	if reloadTemplates {
+		if err := w.renderer.Loader.ReloadTemplates(); err != nil {
+			return err
+		}
+	}
+	if reloadPartials {
+		partials, err := ParsePartials(w.renderer.Context.Global(), packageDir(w.config.Sources))
+		if err != nil {
+			return err
+		} else if err := w.renderer.Loader.LoadPartials(partials); err != nil {
+			return err
+		}
+	}
+	if reloadPartials || reloadTemplates {
+		// partials and layouts outside the source dir might have been added or removed
+		w.extFiles = snapshotPaths(w.externalFiles())
+		// any template might include partials or be wrapped into layouts
+		for _, mode := range []TemplateMode{TemplateModeSingle, TemplateModeCollection} {
+			w.renderer.Loader.ForEachSource(mode, func(source string) error {
+				addRef(mode, source)
+				return nil
+			})
+		}
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	var outputs []*Output
+	for _, ref := range refs {
+		sourceOutputs, err := w.renderer.RenderSource(ref.Mode, ref.Source)
+		if err != nil {
+			logError(err)
+			continue
+		}
+		outputs = append(outputs, sourceOutputs...)
+	}
+	return w.publish(outputs)
+}
+
+// publish writes outputs that differ from the existing targets.
+func (w *Watcher) publish(outputs []*Output) error {
+	var targets []string
+	var changed []*Output
+	var changedActions Queue
+	for _, output := range outputs {
+		if outputUnchanged(output) {
+			continue
+		}
+		action, err := output.Action(w.dstDir, w.Rules)
+		if err != nil {
+			return err
+		}
+		changed = append(changed, output)
+		changedActions = append(changedActions, action)
+		targets = append(targets, output.Target)
+	}
+	if len(targets) == 0 {
+		log.Debugln("no changes in outputs")
+		return nil
+	}
+	files, err := w.renderer.ManifestFiles(changed, changedActions)
+	if err != nil {
+		return err
+	}
+	w.manifest.Update(files)
+	manifestAction, err := w.manifest.Action(w.dstDir)
+	if err != nil {
+		return err
+	}
+	actions := NewQueue(
+		NewDirAction(w.dstDir, w.dstDir),
+	)
+	actions = append(actions, changedActions...)
+	actions = append(actions, manifestAction)
+	ts := time.Now()
+	if !actions.Exec(w.dstDir) {
+		log.Errorln("failed in", time.Since(ts))
+		return nil
+	}
+	log.Infoln("updated", len(targets), "files in", time.Since(ts))
+	if w.OnUpdate != nil {
+		w.OnUpdate(targets)
+	}
+	return nil
+}
+
+func (w *Watcher) snapshot() error {
+	srcFiles, err := snapshotTree(w.renderer.srcDir)
+	if err != nil {
+		return err
+	}
+	w.srcFiles = srcFiles
+	w.ctxFiles = snapshotFiles(w.config.Sources)
+	w.extFiles = snapshotPaths(w.externalFiles())
+	return nil
+}
+
+// externalFiles returns paths of partials and layouts outside the source dir,
+// changes of the ones inside are found in the snapshot of the source dir.
+func (w *Watcher) externalFiles() []string {
+	var paths []string
+	for _, partial := range w.renderer.Loader.Partials() {
+		paths = append(paths, partial.Path)
+	}
+	paths = append(paths, w.renderer.Loader.Layouts()...)
+	external := paths[:0]
+	for _, path := range paths {
+		if abs, err := filepath.Abs(path); err != nil || !strings.HasPrefix(abs, w.renderer.srcDir) {
+			external = append(external, path)
+		}
+	}
+	return external
+}
+
+// dependsOn reports whether the source template uses any of the context roots,
+// either in its contents, or in its file path for collections.
+func (w *Watcher) dependsOn(mode TemplateMode, source string, roots map[string]struct{}) bool {
+	if mode == TemplateModeCollection {
+		for _, field := range w.renderer.Loader.filepathTplRx.FindAllStringSubmatch(source, -1) {
+			root := strings.SplitN(strings.TrimPrefix(field[1], "."), ".", 2)[0]
+			if _, ok := roots[root]; ok {
+				return true
+			}
+		}
+	}
+	tpl := w.renderer.Loader.Template(mode, source)
+	if tpl == nil {
+		return false
+	}
+	used, ok := templateRoots(tpl)
+	if !ok {
+		return true
+	}
+	for root := range used {
+		if _, ok := roots[root]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// templateRoots collects names of the context root fields referenced by the template.
+// It returns false if the template passes the whole context around, so the fields
+// it depends on cannot be told.
+func templateRoots(tpl *template.Template) (map[string]struct{}, bool) {
+	roots := make(map[string]struct{})
+	known := true
+	var walk func(node parse.Node, rootDot bool)
+	walk = func(node parse.Node, rootDot bool) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, node := range n.Nodes {
+				walk(node, rootDot)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe, rootDot)
+		case *parse.TemplateNode:
+			walk(n.Pipe, rootDot)
+		case *parse.IfNode:
+			walk(n.Pipe, rootDot)
+			walk(n.List, rootDot)
+			walk(n.ElseList, rootDot)
+		case *parse.RangeNode:
+			walk(n.Pipe, rootDot)
+			walk(n.List, false)
+			walk(n.ElseList, rootDot)
+		case *parse.WithNode:
+			walk(n.Pipe, rootDot)
+			walk(n.List, false)
+			walk(n.ElseList, rootDot)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, cmd := range n.Cmds {
+				walk(cmd, rootDot)
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg, rootDot)
+			}
+		case *parse.ChainNode:
+			walk(n.Node, rootDot)
+		case *parse.FieldNode:
+			if rootDot {
+				roots[n.Ident[0]] = struct{}{}
+			}
+		case *parse.VariableNode:
+			if n.Ident[0] != "$" {
+				return
+			} else if len(n.Ident) > 1 {
+				roots[n.Ident[1]] = struct{}{}
+				return
+			}
+			known = false
+		case *parse.DotNode:
+			if rootDot {
+				known = false
+			}
+		}
+	}
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root, true)
+		}
+	}
+	return roots, known
+}
+
+// outputUnchanged reports whether the target already has the contents of output.
+func outputUnchanged(output *Output) bool {
+	current, err := ioutil.ReadFile(output.Target)
+	if err != nil {
+		return false
+	}
+	if output.IsCopy() {
+		contents, err := ioutil.ReadFile(output.Source)
+		if err != nil {
+			return false
+		}
+		return bytes.Equal(current, contents)
+	}
+	return bytes.Equal(current, output.Contents)
+}
+
+type fileStamp struct {
+	ModTime time.Time
+	Size    int64
+}
+
+// fileSnapshot maps file paths to their modification stamps.
+type fileSnapshot map[string]fileStamp
+
+func snapshotTree(dir string) (fileSnapshot, error) {
+	snapshot := make(fileSnapshot)
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return nil
+		}
+		snapshot[path] = fileStamp{
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func snapshotFiles(sources []ContextSource) fileSnapshot {
+	paths := make([]string, 0, len(sources))
+	for _, source := range sources {
+		paths = append(paths, source.Path)
+	}
+	return snapshotPaths(paths)
+}
+
+// snapshotPaths takes stamps of the files, the missing ones are left out.
+func snapshotPaths(paths []string) fileSnapshot {
+	snapshot := make(fileSnapshot, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		snapshot[path] = fileStamp{
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		}
+	}
+	return snapshot
+}
+
+// Diff compares the snapshot with a newer one, returning sorted lists of paths.
+func (s fileSnapshot) Diff(newer fileSnapshot) (added, removed, changed []string) {
+	for path, stamp := range newer {
+		if prev, ok := s[path]; !ok {
+			added = append(added, path)
+		} else if prev != stamp {
+			changed = append(changed, path)
+		}
+	}
+	for path := range s {
+		if _, ok := newer[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
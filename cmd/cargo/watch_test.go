@@ -0,0 +1,283 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestWatcher builds the destination dir of the config, returning the watcher of its sources.
+func newTestWatcher(config *PassConfig) (*Watcher, error) {
+	renderer, err := config.NewRenderer()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		renderer: renderer,
+		dstDir:   config.DstDir,
+		config:   config,
+	}
+	if err := w.Build(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// editTestFile writes the file and sets its modification time the age ago,
+// so the change is noticed regardless of the resolution of file times.
+func editTestFile(t *testing.T, path, contents string, age time.Duration) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().Add(-age)
+	if err := os.Chtimes(path, ts, ts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherExternalPartialsAndLayouts(t *testing.T) {
+	assert := assert.New(t)
+	config, cleanup := newTestPassConfig(t, map[string]string{
+		"cargo.yaml":          "Cargo:\n  Name: demo\n  partials:\n    footer: ./partials/footer.txt\n",
+		"partials/footer.txt": "footer v1",
+		"layouts/base.txt":    "[{{ content }}]",
+		"src/_page.txt":       `{{/* layout: ../layouts/base.txt */}}page, {{ template "footer" }}`,
+		"src/_plain.txt":      `{{/* layout: none */}}plain`,
+	})
+	defer cleanup()
+	w, err := newTestWatcher(config)
+	if !assert.NoError(err) {
+		return
+	}
+	var updated []string
+	w.OnUpdate = func(targets []string) {
+		updated = append(updated, targets...)
+	}
+	page := filepath.Join(config.DstDir, "page.txt")
+	check := func(expected string) {
+		data, err := ioutil.ReadFile(page)
+		if assert.NoError(err) {
+			assert.Equal(expected, string(data))
+		}
+	}
+	check("[page, footer v1]")
+
+	dir := filepath.Dir(config.SrcDir)
+	editTestFile(t, filepath.Join(dir, "partials", "footer.txt"), "footer v2", time.Minute)
+	if assert.NoError(w.Poll()) {
+		check("[page, footer v2]")
+		assert.Equal([]string{page}, updated)
+	}
+
+	updated = nil
+	editTestFile(t, filepath.Join(dir, "layouts", "base.txt"), "<{{ content }}>", time.Minute)
+	if assert.NoError(w.Poll()) {
+		check("<page, footer v2>")
+		assert.Equal([]string{page}, updated)
+	}
+
+	updated = nil
+	if assert.NoError(w.Poll()) {
+		assert.Empty(updated)
+	}
+}
+
+func TestTemplateRoots(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		roots []string
+		known bool
+	}{{
+		name:  "fields",
+		text:  "{{ .Cargo.Name }} {{ .Values.port }}",
+		roots: []string{"Cargo", "Values"},
+		known: true,
+	}, {
+		name:  "range",
+		text:  "{{ range .Friends }}{{ .name }} {{ $.Cargo.Name }}{{ end }}",
+		roots: []string{"Cargo", "Friends"},
+		known: true,
+	}, {
+		name:  "with and else",
+		text:  "{{ with .Site }}{{ .title }}{{ else }}{{ .Default }}{{ end }}",
+		roots: []string{"Default", "Site"},
+		known: true,
+	}, {
+		name:  "if",
+		text:  "{{ if .Debug }}debug{{ else if .Mode }}{{ .Mode }}{{ end }}",
+		roots: []string{"Debug", "Mode"},
+		known: true,
+	}, {
+		name:  "defined templates",
+		text:  `{{ define "footer" }}{{ .Footer }}{{ end }}{{ .Title }} {{ template "footer" .Site }}`,
+		roots: []string{"Footer", "Site", "Title"},
+		known: true,
+	}, {
+		name:  "dot passed",
+		text:  `{{ define "footer" }}{{ .Footer }}{{ end }}{{ template "footer" . }}`,
+		roots: []string{"Footer"},
+		known: false,
+	}, {
+		name:  "root variable",
+		text:  "{{ range .Friends }}{{ $ }}{{ end }}",
+		roots: []string{"Friends"},
+		known: false,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := assert.New(t)
+			tpl, err := template.New(test.name).Parse(test.text)
+			if !assert.NoError(err) {
+				return
+			}
+			roots, known := templateRoots(tpl)
+			var names []string
+			for root := range roots {
+				names = append(names, root)
+			}
+			sort.Strings(names)
+			assert.Equal(test.roots, names)
+			assert.Equal(test.known, known)
+		})
+	}
+}
+
+func TestFileSnapshotDiff(t *testing.T) {
+	assert := assert.New(t)
+	ts := time.Now()
+	older := fileSnapshot{
+		"a.txt": {ModTime: ts, Size: 1},
+		"b.txt": {ModTime: ts, Size: 1},
+		"c.txt": {ModTime: ts, Size: 1},
+		"d.txt": {ModTime: ts, Size: 1},
+	}
+	newer := fileSnapshot{
+		"a.txt": {ModTime: ts, Size: 1},
+		"b.txt": {ModTime: ts.Add(time.Second), Size: 1},
+		"c.txt": {ModTime: ts, Size: 2},
+		"e.txt": {ModTime: ts, Size: 1},
+	}
+	added, removed, changed := older.Diff(newer)
+	assert.Equal([]string{"e.txt"}, added)
+	assert.Equal([]string{"d.txt"}, removed)
+	assert.Equal([]string{"b.txt", "c.txt"}, changed)
+	added, removed, changed = newer.Diff(newer)
+	assert.Empty(added)
+	assert.Empty(removed)
+	assert.Empty(changed)
+}
+
+// newTestDepsWatcher returns the watcher of sources using different roots of the context,
+// with the Site context loaded from site.yaml.
+func newTestDepsWatcher(t *testing.T) (*Watcher, *PassConfig, func()) {
+	config, cleanup := newTestPassConfig(t, map[string]string{
+		"cargo.yaml":             "Cargo:\n  Name: demo\n  partials:\n    footer: ./partials/footer.txt\n",
+		"site.yaml":              "- name: home\n  title: Demo\n",
+		"partials/footer.txt":    "footer v1",
+		"src/_site.txt":          "{{ range .Site }}{{ .title }}{{ end }}",
+		"src/_name.txt":          "{{ .Cargo.Name }}",
+		"src/_footer.txt":        `{{ template "footer" . }}`,
+		"src/{{.Site.name}}.txt": "{{ .name }}",
+		"src/static.txt":         "static",
+	})
+	config.Sources = append(config.Sources, ContextSource{
+		Name: "Site",
+		Path: filepath.Join(filepath.Dir(config.SrcDir), "site.yaml"),
+	})
+	w, err := newTestWatcher(config)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return w, config, cleanup
+}
+
+func TestWatcherDependsOn(t *testing.T) {
+	w, config, cleanup := newTestDepsWatcher(t)
+	defer cleanup()
+	tests := []struct {
+		roots   []string
+		sources []string
+	}{{
+		roots:   []string{"Site"},
+		sources: []string{"_footer.txt", "_site.txt", "{{.Site.name}}.txt"},
+	}, {
+		roots:   []string{"Cargo"},
+		sources: []string{"_footer.txt", "_name.txt"},
+	}, {
+		roots:   []string{"Values"},
+		sources: []string{"_footer.txt"},
+	}}
+	for _, test := range tests {
+		roots := make(map[string]struct{})
+		for _, root := range test.roots {
+			roots[root] = struct{}{}
+		}
+		var sources []string
+		for _, mode := range []TemplateMode{TemplateModeVerbatim, TemplateModeSingle, TemplateModeCollection} {
+			w.renderer.Loader.ForEachSource(mode, func(source string) error {
+				if w.dependsOn(mode, source, roots) {
+					rel, _ := filepath.Rel(config.SrcDir, source)
+					sources = append(sources, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+		}
+		sort.Strings(sources)
+		assert.Equal(t, test.sources, sources, "roots %v", test.roots)
+	}
+}
+
+func TestWatcherRerendersChanges(t *testing.T) {
+	w, config, cleanup := newTestDepsWatcher(t)
+	defer cleanup()
+	var updated []string
+	w.OnUpdate = func(targets []string) {
+		updated = append(updated, targets...)
+	}
+	dir := filepath.Dir(config.SrcDir)
+	target := func(name string) string {
+		return filepath.Join(config.DstDir, name)
+	}
+	tests := []struct {
+		name    string
+		path    string
+		edit    string
+		updated []string
+	}{{
+		name:    "source",
+		path:    filepath.Join("src", "_name.txt"),
+		edit:    "name: {{ .Cargo.Name }}",
+		updated: []string{target("name.txt")},
+	}, {
+		name:    "partial",
+		path:    filepath.Join("partials", "footer.txt"),
+		edit:    "footer v2",
+		updated: []string{target("footer.txt")},
+	}, {
+		name:    "context",
+		path:    "site.yaml",
+		edit:    "- name: index\n  title: Docs\n",
+		updated: []string{target("index.txt"), target("site.txt")},
+	}, {
+		name: "unchanged",
+	}}
+	for i, test := range tests {
+		updated = nil
+		if len(test.path) > 0 {
+			editTestFile(t, filepath.Join(dir, test.path), test.edit, time.Duration(len(tests)-i)*time.Minute)
+		}
+		if !assert.NoError(t, w.Poll(), test.name) {
+			continue
+		}
+		sort.Strings(updated)
+		assert.Equal(t, test.updated, updated, test.name)
+	}
+}